@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+// How long a client that nothing is using is kept open, so that
+// reconnecting clients and reloads of the serve database can pick
+// it up again rather than creating a new one.
+const clientLinger = time.Minute
+
+// The period of clients that are never to send on time alone, which
+// is never reached.
+const neverPeriod = time.Duration(math.MaxInt64)
+
+// Clients are shared between users with the same serve, URL, and
+// batching and compression configuration.
+type clientPoolKey struct {
+	sKey
+	url string
+
+	requestSizeTrigger int
+	concurrency        int
+	period             time.Duration
+	timeTrigger        logplexc.TimeTriggerBehavior
+
+	compression          string
+	compressionLevel     int
+	compressionThreshold int
+}
+
+type pooledClient struct {
+	key    clientPoolKey
+	client *logplexc.Client
+	refs   int
+
+	// Whether the client has a ticker to flush it periodically.
+	ticker bool
+}
+
+// Whether a client made with cfg flushes periodically.  logplexc only
+// starts a ticker, which Client.Close stops, for those that do.
+func hasTicker(cfg logplexc.Config) bool {
+	return cfg.TimeTrigger == logplexc.TimeTriggerPeriodic &&
+		cfg.Period > 0
+}
+
+// Every logplexc.Client ever acquired and not yet closed.
+//
+// Each logplexc.Client has its own ticker goroutine and its own
+// bucket of concurrent requests, and batches only what is buffered
+// in it, so having one per connection (pg_logfebe makes one
+// connection per backend) results in many small requests and much
+// churn.
+var clientPool = struct {
+	sync.Mutex
+	byKey    map[clientPoolKey]*pooledClient
+	byClient map[*logplexc.Client]*pooledClient
+}{
+	byKey:    make(map[clientPoolKey]*pooledClient),
+	byClient: make(map[*logplexc.Client]*pooledClient),
+}
+
+// Get a client that sends to u on behalf of sr, creating one if
+// necessary.  Callers must call releaseClient when they are done
+// with it, and must not Close it themselves.
+func acquireClient(sr *serveRecord, cfg logplexc.Config,
+	u *url.URL) (*logplexc.Client, error) {
+	key := clientPoolKey{
+		sKey:               sr.sKey,
+		url:                u.String(),
+		requestSizeTrigger: cfg.RequestSizeTrigger,
+		concurrency:        cfg.Concurrency,
+		period:             cfg.Period,
+		timeTrigger:        cfg.TimeTrigger,
+
+		compression:          sr.compression,
+		compressionLevel:     sr.compressionLevel,
+		compressionThreshold: sr.compressionThreshold,
+	}
+
+	clientPool.Lock()
+	defer clientPool.Unlock()
+
+	if pc, ok := clientPool.byKey[key]; ok {
+		pc.refs++
+		return pc.client, nil
+	}
+
+	// logplexc gives clients that never send on time no ticker,
+	// which Client.Close needs, so that what they hold when
+	// they are closed would be lost.  Give them one that never
+	// fires instead.
+	if cfg.TimeTrigger == logplexc.TimeTriggerNever {
+		cfg.TimeTrigger = logplexc.TimeTriggerPeriodic
+		cfg.Period = neverPeriod
+	}
+
+	cfg.Logplex = *u
+	client, err := logplexc.NewClient(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &pooledClient{key: key, client: client, refs: 1,
+		ticker: hasTicker(cfg)}
+	clientPool.byKey[key] = pc
+	clientPool.byClient[client] = pc
+
+	return client, nil
+}
+
+// Give up a reference to a client obtained from acquireClient.  Once
+// no references remain, and none are taken for a while, the client
+// is flushed and closed.
+func releaseClient(client *logplexc.Client) {
+	clientPool.Lock()
+	defer clientPool.Unlock()
+
+	pc, ok := clientPool.byClient[client]
+	if !ok {
+		panic("releasing a client that is not in the pool")
+	}
+
+	pc.refs--
+	if pc.refs > 0 {
+		return
+	}
+
+	time.AfterFunc(clientLinger, func() {
+		clientPool.Lock()
+
+		// Someone may have taken the client up again in the
+		// meantime.
+		if pc.refs > 0 || clientPool.byClient[client] != pc {
+			clientPool.Unlock()
+			return
+		}
+
+		delete(clientPool.byKey, pc.key)
+		delete(clientPool.byClient, client)
+		clientPool.Unlock()
+
+		// Closing waits for outstanding requests, so do it
+		// without holding up the pool.
+		pc.close()
+	})
+}
+
+// Flush and close a client that is no longer in the pool.  Close
+// cannot be called on clients without a ticker, which are only those
+// that send every record at once, and so hold nothing back.
+func (pc *pooledClient) close() {
+	if pc.ticker {
+		pc.client.Close()
+	}
+}
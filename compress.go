@@ -0,0 +1,118 @@
+// Compression of the requests that carry batches of records, which
+// serves may opt into.  Logs full of repeated SQL shrink a great
+// deal, so this saves on egress in exchange for some CPU.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+const (
+	// Requests with smaller bodies than this are sent as-is by
+	// default, as compressing them saves little.
+	defaultCompressionThreshold = 1 * KB
+)
+
+// The encodings that may be named by a serve's "compression", and the
+// Content-Encoding each is sent with.  "deflate" is, as HTTP would
+// have it, the zlib format.
+func validCompression(encoding string) bool {
+	return encoding == "gzip" || encoding == "deflate"
+}
+
+// Both gzip.Writer and zlib.Writer, so that writers can be reused.
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// An http.RoundTripper that compresses request bodies before passing
+// them on to another.
+type compressingTransport struct {
+	next      http.RoundTripper
+	sr        *serveRecord
+	encoding  string
+	level     int
+	threshold int
+
+	writers sync.Pool
+}
+
+func newCompressingTransport(next http.RoundTripper,
+	sr *serveRecord) *compressingTransport {
+	return &compressingTransport{
+		next:      next,
+		sr:        sr,
+		encoding:  sr.compression,
+		level:     sr.compressionLevel,
+		threshold: sr.compressionThreshold,
+	}
+}
+
+func (t *compressingTransport) writer(w io.Writer) (compressWriter, error) {
+	if cw, ok := t.writers.Get().(compressWriter); ok {
+		cw.Reset(w)
+		return cw, nil
+	}
+
+	if t.encoding == "gzip" {
+		return gzip.NewWriterLevel(w, t.level)
+	}
+
+	return zlib.NewWriterLevel(w, t.level)
+}
+
+func (t *compressingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.ContentLength < int64(t.threshold) {
+		t.sr.stats().incr("compression_skipped")
+		return t.next.RoundTrip(req)
+	}
+
+	raw, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	cw, err := t.writer(&compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cw.Write(raw); err != nil {
+		return nil, err
+	}
+
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+
+	t.writers.Put(cw)
+
+	stats := t.sr.stats()
+	stats.add("raw_bytes", uint64(len(raw)))
+	stats.add("compressed_bytes", uint64(compressed.Len()))
+
+	// A RoundTripper must not modify the request it is given, so
+	// send a copy.
+	creq := new(http.Request)
+	*creq = *req
+	creq.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		creq.Header[k] = v
+	}
+
+	creq.Header.Set("Content-Encoding", t.encoding)
+	creq.ContentLength = int64(compressed.Len())
+	creq.Body = ioutil.NopCloser(&compressed)
+
+	return t.next.RoundTrip(creq)
+}
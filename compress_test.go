@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Records the last request it was given.
+type recordingTripper struct {
+	req  *http.Request
+	body []byte
+}
+
+func (rt *recordingTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.req = req
+	rt.body = body
+
+	return &http.Response{StatusCode: http.StatusNoContent,
+		Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func TestCompressingTransport(t *testing.T) {
+	payload := strings.Repeat("LOG:  statement: SELECT 1\n", 100)
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		sr := &serveRecord{
+			sKey:                 sKey{I: "compress-" + encoding},
+			compression:          encoding,
+			compressionLevel:     gzip.BestCompression,
+			compressionThreshold: 100,
+		}
+
+		rt := &recordingTripper{}
+		tr := newCompressingTransport(rt, sr)
+
+		req, _ := http.NewRequest("POST", "https://localhost/logs",
+			strings.NewReader(payload))
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("round trip failed: %v", err)
+		}
+
+		if got := rt.req.Header.Get("Content-Encoding"); got != encoding {
+			t.Fatalf("expected Content-Encoding %q, got %q",
+				encoding, got)
+		}
+
+		if req.Header.Get("Content-Encoding") != "" {
+			t.Fatal("original request should not be modified")
+		}
+
+		var r io.Reader
+		var err error
+		if encoding == "gzip" {
+			r, err = gzip.NewReader(bytes.NewReader(rt.body))
+		} else {
+			r, err = zlib.NewReader(bytes.NewReader(rt.body))
+		}
+		if err != nil {
+			t.Fatalf("could not decode %s body: %v", encoding, err)
+		}
+
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil || string(decoded) != payload {
+			t.Fatalf("body did not survive compression: %v", err)
+		}
+
+		snap := sr.stats().snapshot()
+		if snap["raw_bytes"] != uint64(len(payload)) ||
+			snap["compressed_bytes"] != uint64(len(rt.body)) {
+			t.Fatalf("unexpected stats %v", snap)
+		}
+
+		// Small requests go uncompressed.
+		req, _ = http.NewRequest("POST", "https://localhost/logs",
+			strings.NewReader("short"))
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("round trip failed: %v", err)
+		}
+
+		if rt.req.Header.Get("Content-Encoding") != "" ||
+			string(rt.body) != "short" {
+			t.Fatalf("small request should be sent as-is")
+		}
+	}
+}
+
+func TestCompressionValidation(t *testing.T) {
+	for _, tt := range []struct {
+		extra string
+		ok    bool
+	}{
+		{`"compression": "gzip"`, true},
+		{`"compression": "deflate", "compression_level": 1, ` +
+			`"compression_threshold": 0`, true},
+		{`"compression": "brotli"`, false},
+		{`"compression": "gzip", "compression_level": 10`, false},
+		{`"compression": "gzip", "compression_level": "fast"`, false},
+		{`"compression": "gzip", "compression_threshold": -1`, false},
+	} {
+		var v interface{}
+		err := json.Unmarshal([]byte(`{"i": "x", "p": "/p", `+
+			`"url": "https://token:t@localhost", `+tt.extra+`}`), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := projectFromJSON(v); (err == nil) != tt.ok {
+			t.Errorf("%s: expected ok %v, got error %v",
+				tt.extra, tt.ok, err)
+		}
+	}
+}
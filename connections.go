@@ -0,0 +1,321 @@
+// Audit events for connections, from what Postgres logs about them
+// with log_connections and log_disconnections:
+//
+//     connection received: host=10.0.0.1 port=51234
+//     connection authenticated: identity="bob" method=scram-sha-256 (pg_hba.conf:95)
+//     connection authorized: user=bob database=db application_name=psql SSL enabled (...)
+//     replication connection authorized: user=rep
+//     disconnection: session time: 0:00:01.234 user=bob database=db host=10.0.0.1 port=51234
+//
+// and about failures to authenticate, which have SQLSTATE 28P01 or
+// 28000:
+//
+//     password authentication failed for user "bob"
+//     DETAIL:  Connection matched pg_hba.conf line 95: "host all all 0.0.0.0/0 md5"
+//
+//     no pg_hba.conf entry for host "10.0.0.1", user "bob", database "db", SSL off
+//
+// Failures are also counted per client address over a sliding
+// window, and once a threshold is crossed, a brute_force_suspected
+// event is made.  It is not made again for the address until its
+// failures fall back below the threshold.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuthFailureThreshold = 10
+	defaultAuthFailureWindow    = time.Minute
+
+	// Bounds on memory: the most client addresses whose failures
+	// are tracked at once, and the most users remembered for each
+	// to say who was tried.
+	maxAuthFailureAddrs = 10000
+	maxAuthFailureUsers = 10
+
+	authFailureEvent = "auth_failure"
+)
+
+var (
+	connReceived = regexp.MustCompile(
+		`^connection received: host=(\S+)(?: port=(\S+))?`)
+	connAuthenticated = regexp.MustCompile(
+		`^connection authenticated: identity="([^"]*)" method=(\S+)`)
+	connAuthorized = regexp.MustCompile(
+		`^(replication )?connection authorized: user=(\S+)` +
+			`(?: database=(\S+))?` +
+			`(?: application_name=(.*?))?(?: (?:SSL|GSS) enabled.*)?$`)
+	disconnection = regexp.MustCompile(
+		`^disconnection: session time: (\d+):(\d+):([\d.]+) ` +
+			`user=(\S*) database=(\S*) host=(\S+)(?: port=(\S+))?`)
+
+	authFailedMethod = regexp.MustCompile(
+		`^(\S+) authentication failed for user "([^"]*)"`)
+	noHbaEntry = regexp.MustCompile(`^(?:no pg_hba\.conf entry|` +
+		`pg_hba\.conf rejects connection) for (?:replication ` +
+		`connection from )?host "([^"]*)", user "([^"]*)"` +
+		`(?:, database "([^"]*)")?`)
+	hbaLine = regexp.MustCompile(
+		`Connection matched pg_hba\.conf line \d+: "(?:.*\s)?(\S+)"`)
+)
+
+// The address of the client of a record, without any port, which
+// Postgres writes in parentheses.
+func recordClientAddr(lr *logRecord) string {
+	if lr.ClientAddr == nil {
+		return ""
+	}
+
+	addr := *lr.ClientAddr
+	if i := strings.IndexByte(addr, '('); i > 0 {
+		addr = addr[:i]
+	}
+
+	return addr
+}
+
+// The session time of a match of disconnection, in seconds.
+func parseSessionTime(m []string) float64 {
+	hours, _ := strconv.ParseFloat(m[1], 64)
+	minutes, _ := strconv.ParseFloat(m[2], 64)
+	seconds, _ := strconv.ParseFloat(m[3], 64)
+
+	return hours*3600 + minutes*60 + seconds
+}
+
+func nullString(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
+
+func isAuthFailure(lr *logRecord) bool {
+	return lr.SQLState != nil &&
+		(*lr.SQLState == "28P01" || *lr.SQLState == "28000")
+}
+
+// Make an event of a record about a connection, with the metrics to
+// count it by, or return nil if it is about none.
+func connectionEventOf(lr *logRecord) (*event, []metric) {
+	if lr.ErrMessage == nil {
+		return nil, nil
+	}
+
+	msg := *lr.ErrMessage
+
+	count := func(name string) []metric {
+		return []metric{{kind: "count",
+			name: "postgres.connections." + name, value: 1}}
+	}
+
+	if m := connReceived.FindStringSubmatch(msg); m != nil {
+		e := newEvent("connection_received").
+			add("pid", lr.Pid).
+			add("client_addr", m[1]).
+			add("port", m[2])
+
+		return e, count("received")
+	}
+
+	if m := connAuthenticated.FindStringSubmatch(msg); m != nil {
+		e := newEvent("connection_authenticated").
+			add("pid", lr.Pid).
+			add("identity", m[1]).
+			add("method", m[2]).
+			add("client_addr", recordClientAddr(lr))
+
+		return e, count("authenticated")
+	}
+
+	if m := connAuthorized.FindStringSubmatch(msg); m != nil {
+		e := newEvent("connection_authorized").
+			add("pid", lr.Pid).
+			add("user", m[2]).
+			add("database", m[3]).
+			add("application_name", m[4]).
+			add("client_addr", recordClientAddr(lr))
+		if m[1] != "" {
+			e.add("replication", true)
+		}
+
+		return e, count("authorized")
+	}
+
+	if m := disconnection.FindStringSubmatch(msg); m != nil {
+		sessionTime := parseSessionTime(m)
+
+		e := newEvent("disconnection").
+			add("pid", lr.Pid).
+			add("user", m[4]).
+			add("database", m[5]).
+			add("client_addr", m[6]).
+			add("port", m[7]).
+			add("session_time_s", sessionTime)
+
+		return e, append(count("disconnections"), metric{
+			kind: "measure", name: "postgres.connections.session_time",
+			value: sessionTime, unit: "s"})
+	}
+
+	if isAuthFailure(lr) {
+		return authFailureEventOf(lr, msg), count("auth_failures")
+	}
+
+	return nil, nil
+}
+
+func authFailureEventOf(lr *logRecord, msg string) *event {
+	user := nullString(lr.UserName)
+	database := nullString(lr.DatabaseName)
+	addr := recordClientAddr(lr)
+	method := ""
+
+	if m := authFailedMethod.FindStringSubmatch(msg); m != nil {
+		method, user = strings.ToLower(m[1]), m[2]
+	} else if m := noHbaEntry.FindStringSubmatch(msg); m != nil {
+		addr, user = m[1], m[2]
+		if m[3] != "" {
+			database = m[3]
+		}
+	}
+
+	// The method that the matching pg_hba.conf line names is more
+	// precise than the message's, which says "password" for all
+	// of password, md5, and scram-sha-256.
+	if lr.ErrDetail != nil {
+		if m := hbaLine.FindStringSubmatch(*lr.ErrDetail); m != nil {
+			method = m[1]
+		}
+	}
+
+	return newEvent(authFailureEvent).
+		add("pid", lr.Pid).
+		add("user", user).
+		add("database", database).
+		add("client_addr", addr).
+		add("method", method).
+		add("sqlstate", *lr.SQLState).
+		add("message", msg)
+}
+
+// Recent authentication failures from one client address.
+type authFailureWindow struct {
+	times   []time.Time
+	users   []string
+	alerted bool
+}
+
+// Sliding windows of authentication failures of a serve, by client
+// address.
+type authFailureTracker struct {
+	lock   sync.Mutex
+	byAddr map[string]*authFailureWindow
+}
+
+// All authFailureTrackers, which outlive reloads of the serve
+// database like serveStats do.
+var authFailureRegistry = struct {
+	sync.Mutex
+	m map[sKey]*authFailureTracker
+}{m: make(map[sKey]*authFailureTracker)}
+
+func (sr *serveRecord) authFailures() *authFailureTracker {
+	authFailureRegistry.Lock()
+	defer authFailureRegistry.Unlock()
+
+	t, ok := authFailureRegistry.m[sr.sKey]
+	if !ok {
+		t = &authFailureTracker{
+			byAddr: make(map[string]*authFailureWindow)}
+		authFailureRegistry.m[sr.sKey] = t
+	}
+
+	return t
+}
+
+// Drop the failures of w from before since.
+func (w *authFailureWindow) expire(since time.Time) {
+	i := sort.Search(len(w.times), func(i int) bool {
+		return w.times[i].After(since)
+	})
+
+	w.times = w.times[i:]
+	if len(w.times) == 0 {
+		w.users = nil
+	}
+}
+
+// Account for a failure from addr at now, returning an event if it
+// crosses threshold failures within window.  Failures from new
+// addresses are ignored while too many others have recent failures.
+func (t *authFailureTracker) observe(addr, user string, now time.Time,
+	threshold int, window time.Duration) *event {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	since := now.Add(-window)
+
+	w, ok := t.byAddr[addr]
+	if !ok {
+		if len(t.byAddr) >= maxAuthFailureAddrs {
+			for a, other := range t.byAddr {
+				if other.expire(since); len(other.times) == 0 {
+					delete(t.byAddr, a)
+				}
+			}
+		}
+
+		if len(t.byAddr) >= maxAuthFailureAddrs {
+			return nil
+		}
+
+		w = &authFailureWindow{}
+		t.byAddr[addr] = w
+	}
+
+	w.expire(since)
+
+	// Only so many failures are needed to tell whether there
+	// are enough of them.
+	w.times = append(w.times, now)
+	if len(w.times) > threshold {
+		w.times = w.times[len(w.times)-threshold:]
+	}
+
+	if user != "" && len(w.users) < maxAuthFailureUsers {
+		known := false
+		for _, u := range w.users {
+			known = known || u == user
+		}
+
+		if !known {
+			w.users = append(w.users, user)
+		}
+	}
+
+	if len(w.times) < threshold {
+		w.alerted = false
+		return nil
+	}
+
+	if w.alerted {
+		return nil
+	}
+
+	w.alerted = true
+	return newEvent("brute_force_suspected").
+		add("client_addr", addr).
+		add("failures", len(w.times)).
+		add("window_s", window.Seconds()).
+		add("users", strings.Join(w.users, ","))
+}
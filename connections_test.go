@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionEvents(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "ident"}}
+
+	for _, tc := range []struct {
+		msg, state, detail string
+		want               string
+	}{
+		{msg: "connection received: host=10.0.0.1 port=51234",
+			want: "event=connection_received identity=ident " +
+				"pid=1234 client_addr=10.0.0.1 port=51234"},
+		{msg: "connection authorized: user=bob database=db " +
+			"application_name=my app SSL enabled (protocol=TLSv1.3)",
+			want: "event=connection_authorized identity=ident " +
+				"pid=1234 user=bob database=db " +
+				"application_name=\"my app\" client_addr=10.0.0.1"},
+		{msg: "replication connection authorized: user=rep",
+			want: "event=connection_authorized identity=ident " +
+				"pid=1234 user=rep client_addr=10.0.0.1 " +
+				"replication=true"},
+		{msg: "disconnection: session time: 1:02:03.500 user=bob " +
+			"database=db host=10.0.0.1 port=51234",
+			want: "event=disconnection identity=ident pid=1234 " +
+				"user=bob database=db client_addr=10.0.0.1 " +
+				"port=51234 session_time_s=3723.5"},
+		{msg: "password authentication failed for user \"bob\"",
+			state: "28P01",
+			detail: "Connection matched pg_hba.conf line 95: " +
+				"\"host all all 0.0.0.0/0 md5\"",
+			want: "event=auth_failure identity=ident pid=1234 " +
+				"user=bob database=postgres client_addr=10.0.0.1 " +
+				"method=md5 sqlstate=28P01 message=\"password " +
+				"authentication failed for user \\\"bob\\\"\""},
+		{msg: "no pg_hba.conf entry for host \"10.0.0.2\", " +
+			"user \"eve\", database \"db\", SSL off",
+			state: "28000",
+			want: "event=auth_failure identity=ident pid=1234 " +
+				"user=eve database=db client_addr=10.0.0.2 " +
+				"sqlstate=28000 message=\"no pg_hba.conf entry " +
+				"for host \\\"10.0.0.2\\\", user \\\"eve\\\", " +
+				"database \\\"db\\\", SSL off\""},
+	} {
+		lr := sampleRecord
+		lr.ClientAddr = strp("10.0.0.1(51234)")
+		lr.ErrMessage = strp(tc.msg)
+		lr.SQLState = strp(tc.state)
+		lr.ErrDetail = nil
+		if tc.detail != "" {
+			lr.ErrDetail = strp(tc.detail)
+		}
+
+		e, ms := connectionEventOf(&lr)
+		if e == nil {
+			t.Errorf("no event for %q", tc.msg)
+			continue
+		}
+
+		if got := string(e.format(sr)); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+
+		if len(ms) == 0 {
+			t.Errorf("no metrics for %q", tc.msg)
+		}
+	}
+
+	lr := sampleRecord
+	if e, _ := connectionEventOf(&lr); e != nil {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestAuthFailureTracker(t *testing.T) {
+	tr := &authFailureTracker{byAddr: make(map[string]*authFailureWindow)}
+	start := time.Date(2014, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	alerts := 0
+	observe := func(addr string, offset time.Duration) {
+		if tr.observe(addr, "bob", start.Add(offset), 3,
+			time.Minute) != nil {
+			alerts++
+		}
+	}
+
+	// Failures spread wider than the window never add up.
+	for i := 0; i < 5; i++ {
+		observe("10.0.0.1", time.Duration(i)*40*time.Second)
+	}
+
+	if alerts != 0 {
+		t.Fatalf("expected no alerts, got %d", alerts)
+	}
+
+	// Three within the window do, but only once while they keep
+	// coming.
+	for i := 0; i < 6; i++ {
+		observe("10.0.0.2", time.Duration(i)*time.Second)
+	}
+
+	if alerts != 1 {
+		t.Fatalf("expected one alert, got %d", alerts)
+	}
+
+	// Once they die down, more rearm the alert.
+	for i := 0; i < 3; i++ {
+		observe("10.0.0.2", 10*time.Minute+time.Duration(i)*time.Second)
+	}
+
+	if alerts != 2 {
+		t.Fatalf("expected two alerts, got %d", alerts)
+	}
+}
@@ -0,0 +1,412 @@
+// A feed of changes to schemas and privileges, from the statements
+// Postgres logs with log_statement set to "ddl" (or "mod", or "all"):
+//
+//     statement: CREATE TABLE public.t (id int); GRANT SELECT ON t TO app
+//
+// Each CREATE, ALTER, DROP, COMMENT, GRANT, and REVOKE statement is
+// classified by what it does to which object, as far as can be told
+// from its tokens, and made into an event with the session it ran in:
+//
+//     event=ddl identity=... action=grant object_type=table object=t privileges=select roles=app user=bob database=db ...
+//
+// Statements logged as parts of durations are skipped, as they are
+// logged again on their own with log_statement.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Messages of log_statement.
+var loggedStatement = regexp.MustCompile(`^(?:statement|execute [^\s:]+): `)
+
+// Object types, as the words that name them.  Longer names come
+// before those they begin with.
+var ddlObjectTypes = [][]string{
+	{"materialized", "view"},
+	{"foreign", "data", "wrapper"},
+	{"foreign", "table"},
+	{"event", "trigger"},
+	{"text", "search", "configuration"},
+	{"text", "search", "dictionary"},
+	{"text", "search", "parser"},
+	{"text", "search", "template"},
+	{"default", "privileges"},
+	{"access", "method"},
+	{"user", "mapping"},
+	{"operator", "class"},
+	{"operator", "family"},
+	{"large", "object"},
+	{"table"}, {"index"}, {"view"}, {"sequence"}, {"schema"},
+	{"function"}, {"procedure"}, {"routine"}, {"trigger"}, {"role"},
+	{"user"}, {"group"}, {"database"}, {"extension"}, {"type"},
+	{"domain"}, {"policy"}, {"publication"}, {"subscription"},
+	{"tablespace"}, {"aggregate"}, {"collation"}, {"conversion"},
+	{"language"}, {"operator"}, {"rule"}, {"server"}, {"statistics"},
+	{"transform"}, {"cast"}, {"system"}, {"column"}, {"constraint"},
+}
+
+// Words between CREATE and the object type that say how rather than
+// what is created.
+var ddlCreateModifiers = map[string]bool{
+	"or": true, "replace": true, "temp": true, "temporary": true,
+	"unlogged": true, "global": true, "local": true, "unique": true,
+	"trusted": true, "procedural": true, "recursive": true,
+	"constraint": true, "default": true,
+}
+
+// A change made by a statement.
+type ddlChange struct {
+	action     string
+	objectType string
+	objects    []string
+	newName    string
+	privileges []string
+	roles      []string
+	cascade    bool
+	statement  string
+}
+
+// The tokens of a statement, other than whitespace and comments.
+type ddlParser struct {
+	q    string
+	toks []sqlToken
+	pos  int
+}
+
+func (p *ddlParser) done() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *ddlParser) text(i int) string {
+	return p.q[p.toks[i].start:p.toks[i].end]
+}
+
+// The word at offset i from the current token, folded to lower case,
+// or "" if it is not an unquoted identifier.
+func (p *ddlParser) word(i int) string {
+	if p.pos+i >= len(p.toks) || p.toks[p.pos+i].kind != sqlIdent {
+		return ""
+	}
+
+	return strings.ToLower(p.text(p.pos + i))
+}
+
+func (p *ddlParser) is(op string) bool {
+	return !p.done() && p.toks[p.pos].kind == sqlOperator &&
+		p.text(p.pos) == op
+}
+
+// Consume words if they come next, returning whether they did.
+func (p *ddlParser) accept(words ...string) bool {
+	for i, w := range words {
+		if p.word(i) != w {
+			return false
+		}
+	}
+
+	p.pos += len(words)
+	return true
+}
+
+func (p *ddlParser) objectType() string {
+	for _, words := range ddlObjectTypes {
+		if p.accept(words...) {
+			return strings.Join(words, " ")
+		}
+	}
+
+	return ""
+}
+
+// Parse a possibly qualified name, with unquoted parts folded to
+// lower case and quoted ones unquoted, as Postgres would.
+func (p *ddlParser) name() string {
+	var parts []string
+
+	for !p.done() {
+		tok := p.toks[p.pos]
+
+		switch tok.kind {
+		case sqlIdent:
+			parts = append(parts, strings.ToLower(p.text(p.pos)))
+		case sqlQuotedIdent:
+			t := p.text(p.pos)
+			t = strings.TrimPrefix(strings.TrimSuffix(t, `"`), `"`)
+			parts = append(parts, strings.Replace(t, `""`, `"`, -1))
+		default:
+			return strings.Join(parts, ".")
+		}
+
+		p.pos++
+		if !p.is(".") {
+			break
+		}
+
+		p.pos++
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// Parse a comma-separated list of names.
+func (p *ddlParser) names() []string {
+	var names []string
+
+	for !p.done() {
+		if name := p.name(); name != "" {
+			names = append(names, name)
+		}
+
+		// Skip argument lists, as of functions.
+		p.skipParens()
+
+		if !p.is(",") {
+			break
+		}
+
+		p.pos++
+	}
+
+	return names
+}
+
+// Skip a parenthesized list, if one comes next.
+func (p *ddlParser) skipParens() {
+	if !p.is("(") {
+		return
+	}
+
+	depth := 0
+	for ; !p.done(); p.pos++ {
+		if p.is("(") {
+			depth++
+		} else if p.is(")") {
+			depth--
+			if depth == 0 {
+				p.pos++
+				return
+			}
+		}
+	}
+}
+
+// Find the next occurrence of words, consuming everything up to and
+// including them, and returning whether there was one.
+func (p *ddlParser) seek(words ...string) bool {
+	for ; !p.done(); p.pos++ {
+		if p.accept(words...) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Split the SQL of a message into statements, and classify those
+// that change schemas or privileges.
+func parseDDL(q string) []*ddlChange {
+	var changes []*ddlChange
+
+	p := &ddlParser{q: q}
+	start := 0
+
+	finish := func(end int) {
+		if c := p.classify(); c != nil {
+			c.statement = strings.TrimSpace(q[start:end])
+			changes = append(changes, c)
+		}
+
+		p.toks = p.toks[:0]
+		p.pos = 0
+		start = end
+	}
+
+	lexSQL(q, func(tok sqlToken) {
+		switch {
+		case tok.kind == sqlSpace || tok.kind == sqlComment:
+		case tok.kind == sqlOperator && q[tok.start] == ';':
+			finish(tok.start)
+			start = tok.end
+		default:
+			p.toks = append(p.toks, tok)
+		}
+	})
+
+	finish(len(q))
+	return changes
+}
+
+func (p *ddlParser) classify() *ddlChange {
+	action := p.word(0)
+	switch action {
+	case "create", "alter", "drop":
+		p.pos++
+		return p.definition(action)
+	case "comment":
+		p.pos++
+		if !p.accept("on") {
+			return nil
+		}
+
+		return p.definition(action)
+	case "grant", "revoke":
+		p.pos++
+		return p.privileges(action)
+	}
+
+	return nil
+}
+
+// Classify what follows CREATE, ALTER, DROP, or COMMENT ON.
+func (p *ddlParser) definition(action string) *ddlChange {
+	if action == "create" {
+		for ddlCreateModifiers[p.word(0)] {
+			p.pos++
+		}
+	}
+
+	c := &ddlChange{action: action, objectType: p.objectType()}
+
+	p.accept("concurrently")
+	p.accept("if", "not", "exists")
+	p.accept("if", "exists")
+	p.accept("only")
+
+	if action == "drop" {
+		c.objects = p.names()
+		for ; !p.done(); p.pos++ {
+			c.cascade = c.cascade || p.word(0) == "cascade"
+		}
+
+		return c
+	}
+
+	// An index or statistics object may go unnamed.
+	if p.word(0) != "on" {
+		if name := p.name(); name != "" {
+			c.objects = []string{name}
+		}
+	}
+
+	if action == "alter" {
+		rest := p.pos
+		if p.seek("owner", "to") {
+			c.roles = p.names()
+		}
+
+		p.pos = rest
+		if p.seek("rename", "to") {
+			c.newName = p.name()
+		}
+	}
+
+	return c
+}
+
+// Classify what follows GRANT or REVOKE.
+func (p *ddlParser) privileges(action string) *ddlChange {
+	c := &ddlChange{action: action}
+
+	if action == "revoke" {
+		if !p.accept("grant", "option", "for") {
+			p.accept("admin", "option", "for")
+		}
+	}
+
+	// Privileges, or for grants of membership, roles, run up to ON
+	// or the grantees.
+	var words []string
+	for !p.done() {
+		w := p.word(0)
+		if w == "on" || w == "to" || w == "from" {
+			break
+		}
+
+		switch {
+		case p.is(","):
+			c.privileges = append(c.privileges,
+				strings.Join(words, " "))
+			words = nil
+			p.pos++
+		case p.is("("):
+			p.skipParens()
+		default:
+			if name := p.name(); name != "" {
+				words = append(words, name)
+			} else {
+				p.pos++
+			}
+		}
+	}
+
+	if len(words) > 0 {
+		c.privileges = append(c.privileges, strings.Join(words, " "))
+	}
+
+	if p.accept("on") {
+		if p.accept("all") {
+			c.objectType = "all " + p.word(0) + " in schema"
+			p.pos++
+			p.accept("in", "schema")
+		} else if c.objectType = p.objectType(); c.objectType == "" {
+			c.objectType = "table"
+		}
+
+		c.objects = p.names()
+	} else {
+		c.objectType = "role"
+		c.objects, c.privileges = c.privileges, nil
+	}
+
+	if p.accept("to") || p.accept("from") {
+		c.roles = p.names()
+	}
+
+	return c
+}
+
+// Make events of a record about statements that change schemas or
+// privileges, with the metrics to count them by.
+func ddlEventsOf(lr *logRecord) ([]*event, []metric) {
+	if lr.ErrMessage == nil {
+		return nil, nil
+	}
+
+	loc := loggedStatement.FindStringIndex(*lr.ErrMessage)
+	if loc == nil {
+		return nil, nil
+	}
+
+	var events []*event
+	var metrics []metric
+
+	for _, c := range parseDDL((*lr.ErrMessage)[loc[1]:]) {
+		e := newEvent("ddl").
+			add("action", c.action).
+			add("object_type", c.objectType).
+			add("object", strings.Join(c.objects, ",")).
+			add("new_name", c.newName).
+			add("privileges", strings.Join(c.privileges, ",")).
+			add("roles", strings.Join(c.roles, ","))
+		if c.cascade {
+			e.add("cascade", true)
+		}
+
+		e.add("user", nullString(lr.UserName)).
+			add("database", nullString(lr.DatabaseName)).
+			add("session_id", lr.SessionID).
+			add("pid", lr.Pid).
+			add("client_addr", recordClientAddr(lr)).
+			add("application_name", nullString(lr.ApplicationName)).
+			add("statement", c.statement)
+
+		events = append(events, e)
+		metrics = append(metrics, metric{kind: "count",
+			name: "postgres.ddl." + c.action, value: 1})
+	}
+
+	return events, metrics
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDDL(t *testing.T) {
+	for _, tc := range []struct {
+		q    string
+		want []ddlChange
+	}{
+		{`CREATE TABLE IF NOT EXISTS public."Orders" (id int); ` +
+			`select 1; GRANT SELECT, UPDATE (a, b) ON t, u TO app, "Web"`,
+			[]ddlChange{
+				{action: "create", objectType: "table",
+					objects:   []string{"public.Orders"},
+					statement: `CREATE TABLE IF NOT EXISTS public."Orders" (id int)`},
+				{action: "grant", objectType: "table",
+					objects:    []string{"t", "u"},
+					privileges: []string{"select", "update"},
+					roles:      []string{"app", "Web"},
+					statement:  `GRANT SELECT, UPDATE (a, b) ON t, u TO app, "Web"`},
+			}},
+		{"create or replace materialized view s.v as select 1",
+			[]ddlChange{{action: "create",
+				objectType: "materialized view",
+				objects:    []string{"s.v"},
+				statement:  "create or replace materialized view s.v as select 1"}}},
+		{"CREATE UNIQUE INDEX CONCURRENTLY ON t (a)",
+			[]ddlChange{{action: "create", objectType: "index",
+				statement: "CREATE UNIQUE INDEX CONCURRENTLY ON t (a)"}}},
+		{"DROP FUNCTION IF EXISTS f(int), g() CASCADE",
+			[]ddlChange{{action: "drop", objectType: "function",
+				objects: []string{"f", "g"}, cascade: true,
+				statement: "DROP FUNCTION IF EXISTS f(int), g() CASCADE"}}},
+		{"ALTER TABLE t OWNER TO bob",
+			[]ddlChange{{action: "alter", objectType: "table",
+				objects: []string{"t"}, roles: []string{"bob"},
+				statement: "ALTER TABLE t OWNER TO bob"}}},
+		{"ALTER SCHEMA a RENAME TO b",
+			[]ddlChange{{action: "alter", objectType: "schema",
+				objects: []string{"a"}, newName: "b",
+				statement: "ALTER SCHEMA a RENAME TO b"}}},
+		{"REVOKE GRANT OPTION FOR ALL PRIVILEGES ON ALL TABLES IN SCHEMA public FROM PUBLIC",
+			[]ddlChange{{action: "revoke",
+				objectType: "all tables in schema",
+				objects:    []string{"public"},
+				privileges: []string{"all privileges"},
+				roles:      []string{"public"},
+				statement:  "REVOKE GRANT OPTION FOR ALL PRIVILEGES ON ALL TABLES IN SCHEMA public FROM PUBLIC"}}},
+		{"GRANT admin TO bob",
+			[]ddlChange{{action: "grant", objectType: "role",
+				objects: []string{"admin"}, roles: []string{"bob"},
+				statement: "GRANT admin TO bob"}}},
+		{"COMMENT ON COLUMN t.a IS 'x'; SELECT 'DROP TABLE t'",
+			[]ddlChange{{action: "comment", objectType: "column",
+				objects:   []string{"t.a"},
+				statement: "COMMENT ON COLUMN t.a IS 'x'"}}},
+		{"SELECT 'DROP TABLE t'; UPDATE t SET v = 1", nil},
+	} {
+		var got []ddlChange
+		for _, c := range parseDDL(tc.q) {
+			got = append(got, *c)
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseDDL(%q) = %+v, want %+v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestDDLEvents(t *testing.T) {
+	lr := sampleRecord
+	lr.ErrMessage = strp("statement: DROP TABLE t")
+
+	events, metrics := ddlEventsOf(&lr)
+	if len(events) != 1 || len(metrics) != 1 {
+		t.Fatalf("expected one event and metric, got %v and %v",
+			events, metrics)
+	}
+
+	sr := &serveRecord{sKey: sKey{I: "ident"}}
+	got := string(events[0].format(sr))
+	want := "event=ddl identity=ident action=drop object_type=table " +
+		"object=t user=postgres database=postgres " +
+		"session_id=5362197c.4d2 pid=1234 application_name=psql " +
+		"statement=\"DROP TABLE t\""
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	lr.ErrMessage = strp("duration: 1.000 ms  statement: DROP TABLE t")
+	if events, _ := ddlEventsOf(&lr); events != nil {
+		t.Errorf("unexpected events %v", events)
+	}
+}
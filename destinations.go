@@ -0,0 +1,136 @@
+// Destinations that serve records may send some of what they produce
+// to, such as events of interest, rather than to "url".  Each is
+// named either "primary", for "url", "audit", for "audit", or by a URL
+// of its own.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/logplex/logplexc"
+)
+
+const (
+	destPrimary = "primary"
+	destAudit   = "audit"
+)
+
+// Check a destination given for key in a serve record.
+func parseDestination(key string, dest string, audit *url.URL) error {
+	switch dest {
+	case destPrimary:
+		return nil
+	case destAudit:
+		if audit == nil {
+			return fmt.Errorf("\"%s\" in serve record is \"audit\", "+
+				"but there is no \"audit\" URL", key)
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil || !u.IsAbs() {
+		return fmt.Errorf("\"%s\" in serve record must be "+
+			"\"primary\", \"audit\", or a URL, got %q", key, dest)
+	}
+
+	return nil
+}
+
+// All the destinations a serve sends to other than its primary and
+// audit URLs.
+func (sr *serveRecord) otherDestinations() []string {
+	var dests []string
+
+	for _, dest := range []string{sr.lockEvents, sr.connectionEvents,
+		sr.ddlEvents, sr.sessionSummaries, sr.lifecycleEvents} {
+		if dest != "" && dest != destPrimary && dest != destAudit {
+			dests = append(dests, dest)
+		}
+	}
+
+	return dests
+}
+
+// The clients a worker sends the records of a serve with.
+type serveClients struct {
+	primary *logplexc.Client
+
+	// nil if the serve has no audit URL.
+	audit *logplexc.Client
+
+	others map[string]*logplexc.Client
+}
+
+// Acquire clients for every destination of sr.  The clients must be
+// released when no longer needed.
+func acquireServeClients(sr *serveRecord,
+	cfg logplexc.Config) (*serveClients, error) {
+	c := &serveClients{others: make(map[string]*logplexc.Client)}
+
+	var err error
+	if c.primary, err = acquireClient(sr, cfg, &sr.u); err != nil {
+		return nil, err
+	}
+
+	if sr.audit != nil {
+		if c.audit, err = acquireClient(sr, cfg, sr.audit); err != nil {
+			c.release()
+			return nil, err
+		}
+	}
+
+	for _, dest := range sr.otherDestinations() {
+		if _, ok := c.others[dest]; ok {
+			continue
+		}
+
+		u, err := url.Parse(dest)
+		if err != nil {
+			c.release()
+			return nil, err
+		}
+
+		client, err := acquireClient(sr, cfg, u)
+		if err != nil {
+			c.release()
+			return nil, err
+		}
+
+		c.others[dest] = client
+	}
+
+	return c, nil
+}
+
+func (c *serveClients) release() {
+	if c.primary != nil {
+		releaseClient(c.primary)
+	}
+
+	if c.audit != nil {
+		releaseClient(c.audit)
+	}
+
+	for _, client := range c.others {
+		releaseClient(client)
+	}
+}
+
+// Find the client for a destination, or nil if there is none, as
+// for the empty destination.
+func (c *serveClients) resolve(dest string) *logplexc.Client {
+	switch dest {
+	case "":
+		return nil
+	case destPrimary:
+		return c.primary
+	case destAudit:
+		return c.audit
+	}
+
+	return c.others[dest]
+}
@@ -0,0 +1,293 @@
+// Transcoding of records from the encoding of the server to UTF-8.
+// Postgres logs in its server_encoding, so records of clusters in
+// LATIN1, WIN1252, EUC_JP, and the like are not UTF-8, which JSON
+// drains refuse.  Serves with an "encoding" have every string of their
+// records transcoded, with sequences invalid in the encoding handled
+// by "encoding_errors":
+//
+//     "replace", the default, puts U+FFFD in their place.
+//
+//     "escape" writes their bytes as \xNN.
+//
+//     "drop" leaves them out.
+//
+// UTF8 and SQL_ASCII serves are checked for invalid UTF-8 the same
+// way.  Invalid sequences are counted as "encoding_errors" in the stats
+// file, and every minute, as the metric postgres.encoding.errors.
+// Serves without an encoding may have records with invalid UTF-8
+// counted as "invalid_utf8" and postgres.encoding.invalid_utf8, to find
+// out which need one, while their records are left as they are.
+//
+// Records are transcoded before any of their fields are truncated, so
+// that truncation only ever cuts UTF-8.  The tables of the encodings
+// are in charsets.go, which gen_charsets.py generates.
+
+package main
+
+//go:generate python3 gen_charsets.py
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/logplex/logplexc"
+)
+
+const (
+	encodingErrorsReplace = "replace"
+	encodingErrorsEscape  = "escape"
+	encodingErrorsDrop    = "drop"
+
+	// How often the counts of encoding errors are sent as metrics.
+	encodingMetricsInterval = time.Minute
+)
+
+func validEncodingErrors(policy string) bool {
+	switch policy {
+	case encodingErrorsReplace, encodingErrorsEscape, encodingErrorsDrop:
+		return true
+	}
+
+	return false
+}
+
+// An encoding that records are transcoded from.  decode returns the
+// character at the start of s, which is never ASCII, and its length in
+// bytes, or a negative character for a sequence that is invalid.
+type charset struct {
+	name   string
+	decode func(s string) (rune, int)
+}
+
+// Find the encoding of the given name, as Postgres names it, in any
+// case.
+func lookupCharset(name string) (*charset, error) {
+	name = strings.ToUpper(name)
+
+	switch name {
+	case "UTF8", "SQL_ASCII":
+		return &charset{name: name, decode: decodeUTF8}, nil
+	case "EUC_JP":
+		return &charset{name: name, decode: decodeEUCJP}, nil
+	}
+
+	if table, ok := singleByteCharsets[name]; ok {
+		return &charset{name: name, decode: func(s string) (rune, int) {
+			if r := table[s[0]-0x80]; r != 0 {
+				return r, 1
+			}
+
+			return -1, 1
+		}}, nil
+	}
+
+	names := []string{"UTF8", "SQL_ASCII", "EUC_JP"}
+	for name := range singleByteCharsets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return nil, fmt.Errorf("unsupported \"encoding\" %q in serve record, "+
+		"expected one of %s", name, strings.Join(names, ", "))
+}
+
+func decodeUTF8(s string) (rune, int) {
+	r, n := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError && n <= 1 {
+		return -1, 1
+	}
+
+	return r, n
+}
+
+func decodeEUCJP(s string) (rune, int) {
+	trail := func(i int) (int, bool) {
+		if i >= len(s) || s[i] < 0xA1 || s[i] == 0xFF {
+			return 0, false
+		}
+
+		return int(s[i] - 0xA1), true
+	}
+
+	switch b := s[0]; {
+	case b == 0x8E:
+		// Half-width katakana.
+		if len(s) > 1 && s[1] >= 0xA1 && s[1] <= 0xDF {
+			return 0xFF61 + rune(s[1]-0xA1), 2
+		}
+	case b == 0x8F:
+		row, ok1 := trail(1)
+		cell, ok2 := trail(2)
+		if ok1 && ok2 {
+			if r := jis0212[row*94+cell]; r != 0 {
+				return rune(r), 3
+			}
+		}
+	case b >= 0xA1 && b != 0xFF:
+		cell, ok := trail(1)
+		if ok {
+			if r := jis0208[int(b-0xA1)*94+cell]; r != 0 {
+				return rune(r), 2
+			}
+		}
+	}
+
+	return -1, 1
+}
+
+// Transcode s to UTF-8, returning the result and how many invalid
+// sequences there were.  Strings of ASCII are returned as they are.
+func (c *charset) transcode(s string, policy string) (string, int) {
+	i := 0
+	for i < len(s) && s[i] < utf8.RuneSelf {
+		i++
+	}
+
+	if i == len(s) {
+		return s, 0
+	}
+
+	var b bytes.Buffer
+	b.Grow(len(s) + len(s)/2)
+	b.WriteString(s[:i])
+
+	invalid := 0
+	for i < len(s) {
+		if s[i] < utf8.RuneSelf {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		r, n := c.decode(s[i:])
+		if r >= 0 {
+			b.WriteRune(r)
+			i += n
+			continue
+		}
+
+		invalid++
+		switch policy {
+		case encodingErrorsEscape:
+			for _, x := range []byte(s[i : i+n]) {
+				fmt.Fprintf(&b, `\x%02X`, x)
+			}
+		case encodingErrorsDrop:
+		default:
+			b.WriteRune(utf8.RuneError)
+		}
+
+		i += n
+	}
+
+	return b.String(), invalid
+}
+
+// Apply f to every string of a record, keeping what it returns.
+func (lr *logRecord) mapStrings(f func(s string) string) {
+	lr.LogTime = f(lr.LogTime)
+	lr.SessionID = f(lr.SessionID)
+	lr.SessionStart = f(lr.SessionStart)
+
+	for _, p := range []**string{&lr.UserName, &lr.DatabaseName,
+		&lr.ClientAddr, &lr.PsDisplay, &lr.Vxid, &lr.SQLState,
+		&lr.ErrMessage, &lr.ErrDetail, &lr.ErrHint, &lr.InternalQuery,
+		&lr.ErrContext, &lr.UserQuery, &lr.FileErrPos,
+		&lr.ApplicationName} {
+		if *p == nil {
+			continue
+		}
+
+		// Strings of the record may be shared with the decoder,
+		// so changed ones are stored anew.
+		if s := f(**p); s != **p {
+			*p = &s
+		}
+	}
+}
+
+// Transcode a record to UTF-8 if the serve has an encoding, or check
+// it for invalid UTF-8 if the serve asks, counting what is found.
+func checkEncoding(lr *logRecord, sr *serveRecord) {
+	switch {
+	case sr.encoding != nil:
+		invalid := 0
+		lr.mapStrings(func(s string) string {
+			s, n := sr.encoding.transcode(s, sr.encodingErrors)
+			invalid += n
+			return s
+		})
+
+		if invalid > 0 {
+			sr.stats().add("encoding_errors", uint64(invalid))
+		}
+	case sr.detectInvalidUTF8:
+		valid := true
+		lr.mapStrings(func(s string) string {
+			valid = valid && utf8.ValidString(s)
+			return s
+		})
+
+		if !valid {
+			sr.stats().incr("invalid_utf8")
+		}
+	}
+}
+
+// Metrics of the encoding errors and records with invalid UTF-8 of a
+// serve counted since the counts in last, which are brought up to
+// date.
+func encodingMetrics(sr *serveRecord, last map[string]uint64) []metric {
+	var metrics []metric
+
+	for _, c := range []struct{ counter, name string }{
+		{"encoding_errors", "postgres.encoding.errors"},
+		{"invalid_utf8", "postgres.encoding.invalid_utf8"},
+	} {
+		n := sr.stats().get(c.counter)
+		if n > last[c.counter] {
+			metrics = append(metrics, metric{kind: "count",
+				name: c.name, value: float64(n - last[c.counter])})
+		}
+
+		last[c.counter] = n
+	}
+
+	return metrics
+}
+
+// Periodically send the counts of encoding errors of a serve as
+// metrics, rather than a metric for every record with any.
+func encodingMetricsWorker(die dieCh, cfg logplexc.Config,
+	sr *serveRecord) {
+	target, err := acquireClient(sr, cfg, &sr.u)
+	if err != nil {
+		log.Fatalf("could not create encoding metrics client: %v",
+			err)
+	}
+	defer releaseClient(target)
+
+	// Counts from before this generation of the serve were sent
+	// by the last.
+	last := make(map[string]uint64)
+	encodingMetrics(sr, last)
+
+	ticker := time.NewTicker(encodingMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-die:
+			emitMetrics(sr, target, time.Now(),
+				encodingMetrics(sr, last))
+			return
+		case now := <-ticker.C:
+			emitMetrics(sr, target, now, encodingMetrics(sr, last))
+		}
+	}
+}
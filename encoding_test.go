@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTranscode(t *testing.T) {
+	for _, tc := range []struct {
+		encoding string
+		policy   string
+		in       string
+		out      string
+		invalid  int
+	}{
+		{"LATIN1", "replace", "caf\xe9", "café", 0},
+		{"latin9", "replace", "\xa4 5", "€ 5", 0},
+		{"WIN1252", "replace", "\x80 \x93q\x94", "€ “q”", 0},
+		{"WIN1252", "replace", "a\x81b", "a�b", 1},
+		{"WIN1252", "escape", "a\x81b", `a\x81b`, 1},
+		{"WIN1252", "drop", "a\x81b", "ab", 1},
+		{"KOI8R", "replace", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет", 0},
+		{"EUC_JP", "replace", "\xc6\xfc\xcb\xdc\xb8\xec", "日本語", 0},
+		{"EUC_JP", "replace", "\x8e\xb1 \x8f\xa2\xaf", "ｱ ˘", 0},
+		{"EUC_JP", "escape", "\xc6\xfc\xc6", `日\xC6`, 1},
+		{"EUC_JP", "replace", "\xc6A", "�A", 1},
+		{"UTF8", "replace", "ok \xff\xfe ✓", "ok �� ✓", 2},
+		{"UTF8", "replace", "plain", "plain", 0},
+	} {
+		c, err := lookupCharset(tc.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out, invalid := c.transcode(tc.in, tc.policy)
+		if out != tc.out || invalid != tc.invalid {
+			t.Errorf("%s %s %q: expected %q with %d invalid, "+
+				"got %q with %d", tc.encoding, tc.policy, tc.in,
+				tc.out, tc.invalid, out, invalid)
+		}
+	}
+
+	if _, err := lookupCharset("MULE_INTERNAL"); err == nil {
+		t.Error("expected an unsupported encoding to be rejected")
+	}
+}
+
+func TestCheckEncoding(t *testing.T) {
+	latin1, _ := lookupCharset("LATIN1")
+	sr := &serveRecord{sKey: sKey{I: "encoding-latin1"}, encoding: latin1,
+		encodingErrors: encodingErrorsReplace}
+
+	// Nullable strings may be shared with the decoder, and must be
+	// left alone.
+	msg := "relation \xabm\xfcll\xbb does not exist"
+	lr := sampleRecord
+	lr.ErrMessage = &msg
+	lr.UserName = strp("j\xfcrgen")
+
+	checkEncoding(&lr, sr)
+	if *lr.ErrMessage != "relation «müll» does not exist" ||
+		*lr.UserName != "jürgen" {
+		t.Fatalf("unexpected record %q %q", *lr.ErrMessage, *lr.UserName)
+	}
+
+	if msg != "relation \xabm\xfcll\xbb does not exist" {
+		t.Fatal("the original string should not be modified")
+	}
+
+	unicode, _ := lookupCharset("UTF8")
+	sr = &serveRecord{sKey: sKey{I: "encoding-utf8"}, encoding: unicode,
+		encodingErrors: encodingErrorsReplace}
+	lr = sampleRecord
+	lr.ErrMessage = strp("bad \xc3")
+	lr.ErrDetail = strp("worse \xff\xff")
+	checkEncoding(&lr, sr)
+	if got := sr.stats().snapshot()["encoding_errors"]; got != uint64(3) {
+		t.Fatalf("expected 3 encoding errors counted, got %v", got)
+	}
+
+	// Detection counts records, and changes nothing.
+	sr = &serveRecord{sKey: sKey{I: "encoding-detect"},
+		detectInvalidUTF8: true}
+	lr = sampleRecord
+	lr.ErrMessage = strp("bad \xc3")
+	checkEncoding(&lr, sr)
+	if *lr.ErrMessage != "bad \xc3" {
+		t.Fatalf("detection should not change records, got %q",
+			*lr.ErrMessage)
+	}
+
+	lr = sampleRecord
+	checkEncoding(&lr, sr)
+	if got := sr.stats().snapshot()["invalid_utf8"]; got != uint64(1) {
+		t.Fatalf("expected 1 invalid record counted, got %v", got)
+	}
+}
+
+func TestEncodingMetrics(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "encoding-metrics"}}
+	sr.stats().add("encoding_errors", 5)
+
+	// Counts from before the worker starts are not sent again.
+	last := make(map[string]uint64)
+	encodingMetrics(sr, last)
+
+	sr.stats().add("encoding_errors", 3)
+	sr.stats().incr("invalid_utf8")
+	metrics := encodingMetrics(sr, last)
+	if len(metrics) != 2 || metrics[0].value != 3 ||
+		metrics[1].value != 1 {
+		t.Fatalf("unexpected metrics %v", metrics)
+	}
+
+	if metrics = encodingMetrics(sr, last); len(metrics) != 0 {
+		t.Fatalf("expected no metrics without new errors, got %v",
+			metrics)
+	}
+}
+
+func TestEncodingConfig(t *testing.T) {
+	project := func(extra string) (*serveRecord, error) {
+		var v interface{}
+		err := json.Unmarshal([]byte(`{"i": "x", "p": "/p", `+
+			`"url": "https://token:t@localhost"`+extra+`}`), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return projectFromJSON(v)
+	}
+
+	rec, err := project(``)
+	if err != nil || rec.encoding != nil ||
+		rec.encodingErrors != encodingErrorsReplace {
+		t.Fatalf("unexpected defaults %v, %v", rec, err)
+	}
+
+	rec, err = project(`, "encoding": "euc_jp", "encoding_errors": "drop"`)
+	if err != nil || rec.encoding == nil || rec.encoding.name != "EUC_JP" ||
+		rec.encodingErrors != encodingErrorsDrop {
+		t.Fatalf("unexpected result %v, %v", rec, err)
+	}
+
+	for _, extra := range []string{
+		`, "encoding": "EBCDIC"`,
+		`, "encoding_errors": "ignore"`,
+		`, "detect_invalid_utf8": 1`,
+	} {
+		if _, err := project(extra); err == nil {
+			t.Errorf("expected %s to be rejected", extra)
+		}
+	}
+}
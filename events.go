@@ -0,0 +1,188 @@
+// Structured events derived from records, such as lock waits, which
+// say in fields what the records say in prose.  Events are rendered
+// in the format of the serve: as JSON objects, or in the text format,
+// as logfmt lines, where nested fields are flattened into dotted keys:
+//
+//     event=deadlock identity=cluster1 pid=123 processes.0.pid=123 ...
+//
+// Either way, every event has the identity of its serve, and its name
+// and labels if it has them, as events may go to destinations shared
+// by serves.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+type eventField struct {
+	key   string
+	value interface{}
+}
+
+// An event, and its fields in order.  Values may be strings, booleans,
+// numbers, slices of int32, or *event or slices of them for nested
+// objects, whose names are ignored.
+type event struct {
+	name   string
+	fields []eventField
+}
+
+func newEvent(name string) *event {
+	return &event{name: name}
+}
+
+// Add a field, unless value is the empty string or a nil or empty
+// slice, so that absent information is left out.
+func (e *event) add(key string, value interface{}) *event {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return e
+		}
+	case []int32:
+		if len(v) == 0 {
+			return e
+		}
+	case []*event:
+		if len(v) == 0 {
+			return e
+		}
+	case *event:
+		if len(v.fields) == 0 {
+			return e
+		}
+	}
+
+	e.fields = append(e.fields, eventField{key, value})
+	return e
+}
+
+// The value of the field with the given key, or nil if there is
+// none.
+func (e *event) value(key string) interface{} {
+	for _, f := range e.fields {
+		if f.key == key {
+			return f.value
+		}
+	}
+
+	return nil
+}
+
+func (e *event) jsonObject() map[string]interface{} {
+	obj := make(map[string]interface{}, len(e.fields))
+	for _, f := range e.fields {
+		if nested, ok := f.value.(*event); ok {
+			obj[f.key] = nested.jsonObject()
+			continue
+		}
+
+		if nested, ok := f.value.([]*event); ok {
+			objs := make([]map[string]interface{}, len(nested))
+			for i, n := range nested {
+				objs[i] = n.jsonObject()
+			}
+
+			obj[f.key] = objs
+			continue
+		}
+
+		obj[f.key] = f.value
+	}
+
+	return obj
+}
+
+func (e *event) writeLogfmt(b *bytes.Buffer, prefix string) {
+	for _, f := range e.fields {
+		if nested, ok := f.value.(*event); ok {
+			nested.writeLogfmt(b, prefix+f.key+".")
+			continue
+		}
+
+		if nested, ok := f.value.([]*event); ok {
+			for i, n := range nested {
+				n.writeLogfmt(b, prefix+f.key+"."+strconv.Itoa(i)+".")
+			}
+
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(prefix)
+		b.WriteString(f.key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(f.value))
+	}
+}
+
+func logfmtValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=\\") {
+			return strconv.Quote(v)
+		}
+
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int32:
+		return strconv.Itoa(int(v))
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []int32:
+		parts := make([]string, len(v))
+		for i, n := range v {
+			parts[i] = strconv.Itoa(int(n))
+		}
+
+		return strings.Join(parts, ",")
+	}
+
+	return strconv.Quote(fmt.Sprint(value))
+}
+
+// Render the event as the serve would have it.
+func (e *event) format(sr *serveRecord) []byte {
+	head := newEvent(e.name).add("event", e.name).add("identity", sr.I).
+		add("name", sr.Name).add("labels", sr.labelEvent())
+	head.fields = append(head.fields, e.fields...)
+
+	if sr.format == formatJSON {
+		// Marshaling maps of JSON-friendly values does not
+		// fail.
+		b, _ := json.Marshal(head.jsonObject())
+		return b
+	}
+
+	var b bytes.Buffer
+	head.writeLogfmt(&b, "")
+	return b.Bytes()
+}
+
+// Send an event to target, if there is one.
+func emitEvent(sr *serveRecord, target *logplexc.Client, when time.Time,
+	e *event) {
+	if target == nil {
+		return
+	}
+
+	app := sr.appName()
+
+	target.BufferMessage(134, when, app, app+".events", e.format(sr))
+}
@@ -0,0 +1,179 @@
+// Extraction of numbers from records that are prose to Postgres but
+// hold measurements worth tracking: those of log_autovacuum_min_duration
+// and log_checkpoints, which look like so:
+//
+//     automatic vacuum of table "db.public.t": index scans: 1
+//     	pages: 0 removed, 45 remain
+//     	tuples: 100 removed, 1000 remain
+//     	buffer usage: 123 hits, 4 misses, 5 dirtied
+//     	avg read rate: 0.123 MB/s, avg write rate: 0.456 MB/s
+//     	system usage: CPU 0.00s/0.01u sec elapsed 0.05 sec
+//
+//     checkpoint complete: wrote 123 buffers (0.8%); 0 transaction log
+//     file(s) added, 0 removed, 1 recycled; write=0.123 s, sync=0.004
+//     s, total=0.130 s; sync files=5, longest=0.001 s, average=0.000 s
+//
+// Later versions of Postgres add to and reword these slightly, which
+// the patterns here allow for.
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// A number extracted from a record, along with how it is reported as
+// a metric: "count" for amounts that are summed, "measure" for
+// durations and other distributions, and "sample" for levels.
+type extractedValue struct {
+	name   string
+	value  float64
+	metric string
+	unit   string
+}
+
+type extraction struct {
+	// What the record is about: "autovacuum", "autoanalyze",
+	// "checkpoint", or "restartpoint".
+	kind string
+
+	// For autovacuum and autoanalyze, the qualified name of the
+	// table.
+	table string
+
+	values []extractedValue
+}
+
+// Render the extraction as JSON-friendly fields.
+func (ex *extraction) fields() map[string]interface{} {
+	f := make(map[string]interface{}, len(ex.values)+1)
+	if ex.table != "" {
+		f["table"] = ex.table
+	}
+
+	for _, v := range ex.values {
+		f[v.name] = v.value
+	}
+
+	return f
+}
+
+// Render the extraction as metrics named after the kind.
+func (ex *extraction) metrics() []metric {
+	ms := make([]metric, len(ex.values))
+	for i, v := range ex.values {
+		ms[i] = metric{kind: v.metric,
+			name:  "postgres." + ex.kind + "." + v.name,
+			value: v.value, unit: v.unit}
+	}
+
+	return ms
+}
+
+// A pattern for part of a message, and what its submatches are.
+type extractor struct {
+	re     *regexp.Regexp
+	values []extractedValue
+}
+
+var (
+	autovacuumHead = regexp.MustCompile(`^automatic (?:aggressive )?` +
+		`(vacuum|analyze)(?: to prevent wraparound)? of table "([^"]+)"`)
+
+	autovacuumExtractors = []extractor{
+		{regexp.MustCompile(`index scans: (\d+)`), []extractedValue{
+			{name: "index_scans", metric: "sample"}}},
+		{regexp.MustCompile(`pages: (\d+) removed, (\d+) remain`),
+			[]extractedValue{
+				{name: "pages_removed", metric: "count"},
+				{name: "pages_remain", metric: "sample"}}},
+		{regexp.MustCompile(`tuples: (\d+) removed, (\d+) remain`),
+			[]extractedValue{
+				{name: "tuples_removed", metric: "count"},
+				{name: "tuples_remain", metric: "sample"}}},
+		{regexp.MustCompile(
+			`buffer usage: (\d+) hits, (\d+) misses, (\d+) dirtied`),
+			[]extractedValue{
+				{name: "buffer_hits", metric: "count"},
+				{name: "buffer_misses", metric: "count"},
+				{name: "buffer_dirtied", metric: "count"}}},
+		{regexp.MustCompile(`avg read rate: ([\d.]+) Mi?B/s, ` +
+			`avg write rate: ([\d.]+) Mi?B/s`),
+			[]extractedValue{
+				{name: "read_rate", metric: "sample", unit: "MB/s"},
+				{name: "write_rate", metric: "sample", unit: "MB/s"}}},
+		{regexp.MustCompile(`elapsed:? ([\d.]+) s`), []extractedValue{
+			{name: "elapsed", metric: "measure", unit: "s"}}},
+	}
+
+	checkpointHead = regexp.MustCompile(
+		`^(checkpoint|restartpoint) complete: `)
+
+	checkpointExtractors = []extractor{
+		{regexp.MustCompile(`wrote (\d+) buffers \(([\d.]+)%\)`),
+			[]extractedValue{
+				{name: "buffers_written", metric: "count"},
+				{name: "buffers_written_pct", metric: "sample",
+					unit: "%"}}},
+		{regexp.MustCompile(`(\d+) (?:transaction log|WAL) file\(s\) ` +
+			`added, (\d+) removed, (\d+) recycled`),
+			[]extractedValue{
+				{name: "wal_added", metric: "count"},
+				{name: "wal_removed", metric: "count"},
+				{name: "wal_recycled", metric: "count"}}},
+		{regexp.MustCompile(
+			`write=([\d.]+) s, sync=([\d.]+) s, total=([\d.]+) s`),
+			[]extractedValue{
+				{name: "write", metric: "measure", unit: "s"},
+				{name: "sync", metric: "measure", unit: "s"},
+				{name: "total", metric: "measure", unit: "s"}}},
+		{regexp.MustCompile(`sync files=(\d+)`), []extractedValue{
+			{name: "sync_files", metric: "sample"}}},
+	}
+)
+
+// Extract what can be found of the values of extractors in msg.
+func extractValues(msg string, extractors []extractor) []extractedValue {
+	var values []extractedValue
+
+	for _, ex := range extractors {
+		m := ex.re.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+
+		for i, v := range ex.values {
+			f, err := strconv.ParseFloat(m[i+1], 64)
+			if err != nil {
+				continue
+			}
+
+			v.value = f
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// Extract measurements from a record, or return nil if it has none.
+func extractRecord(lr *logRecord) *extraction {
+	if lr.ErrMessage == nil {
+		return nil
+	}
+
+	msg := *lr.ErrMessage
+
+	if m := autovacuumHead.FindStringSubmatch(msg); m != nil {
+		return &extraction{kind: "auto" + m[1], table: m[2],
+			values: extractValues(msg, autovacuumExtractors)}
+	}
+
+	if m := checkpointHead.FindStringSubmatch(msg); m != nil {
+		return &extraction{kind: m[1],
+			values: extractValues(msg, checkpointExtractors)}
+	}
+
+	return nil
+}
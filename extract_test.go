@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractAutovacuum(t *testing.T) {
+	for _, msg := range []string{
+		// 9.4
+		"automatic vacuum of table \"db.public.t\": index scans: 1\n" +
+			"\tpages: 0 removed, 45 remain\n" +
+			"\ttuples: 100 removed, 1000 remain, 0 are dead but not yet removable\n" +
+			"\tbuffer usage: 123 hits, 4 misses, 5 dirtied\n" +
+			"\tavg read rate: 0.125 MB/s, avg write rate: 0.5 MB/s\n" +
+			"\tsystem usage: CPU 0.00s/0.01u sec elapsed 0.05 sec",
+		// 14
+		"automatic aggressive vacuum to prevent wraparound of table " +
+			"\"db.public.t\": index scans: 1\n" +
+			"\tpages: 0 removed, 45 remain, 0 skipped due to pins\n" +
+			"\ttuples: 100 removed, 1000 remain\n" +
+			"\tbuffer usage: 123 hits, 4 misses, 5 dirtied\n" +
+			"\tavg read rate: 0.125 MiB/s, avg write rate: 0.5 MiB/s\n" +
+			"\tsystem usage: CPU: user: 0.00 s, system: 0.01 s, elapsed: 0.05 s",
+	} {
+		lr := sampleRecord
+		lr.ErrMessage = &msg
+
+		ex := extractRecord(&lr)
+		if ex == nil {
+			t.Fatalf("nothing extracted from %q", msg)
+		}
+
+		want := map[string]interface{}{
+			"table":          "db.public.t",
+			"index_scans":    1.0,
+			"pages_removed":  0.0,
+			"pages_remain":   45.0,
+			"tuples_removed": 100.0,
+			"tuples_remain":  1000.0,
+			"buffer_hits":    123.0,
+			"buffer_misses":  4.0,
+			"buffer_dirtied": 5.0,
+			"read_rate":      0.125,
+			"write_rate":     0.5,
+			"elapsed":        0.05,
+		}
+
+		if ex.kind != "autovacuum" || !reflect.DeepEqual(ex.fields(), want) {
+			t.Errorf("unexpected extraction %s %v", ex.kind, ex.fields())
+		}
+	}
+}
+
+func TestExtractCheckpoint(t *testing.T) {
+	msg := "checkpoint complete: wrote 123 buffers (0.8%); " +
+		"0 WAL file(s) added, 2 removed, 1 recycled; " +
+		"write=0.123 s, sync=0.004 s, total=0.130 s; " +
+		"sync files=5, longest=0.001 s, average=0.000 s"
+
+	lr := sampleRecord
+	lr.ErrMessage = &msg
+
+	ex := extractRecord(&lr)
+	if ex == nil || ex.kind != "checkpoint" {
+		t.Fatalf("unexpected extraction %+v", ex)
+	}
+
+	sr := &serveRecord{sKey: sKey{I: "ident"}, Name: "cluster1"}
+	got := string(formatMetrics(sr, ex.metrics()))
+	want := "source=cluster1 " +
+		"count#postgres.checkpoint.buffers_written=123 " +
+		"sample#postgres.checkpoint.buffers_written_pct=0.8% " +
+		"count#postgres.checkpoint.wal_added=0 " +
+		"count#postgres.checkpoint.wal_removed=2 " +
+		"count#postgres.checkpoint.wal_recycled=1 " +
+		"measure#postgres.checkpoint.write=0.123s " +
+		"measure#postgres.checkpoint.sync=0.004s " +
+		"measure#postgres.checkpoint.total=0.13s " +
+		"sample#postgres.checkpoint.sync_files=5"
+	if got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	lr.ErrMessage = strp("checkpoint starting: time")
+	if ex := extractRecord(&lr); ex != nil {
+		t.Errorf("unexpected extraction from checkpoint start: %+v", ex)
+	}
+}
+
+func TestFormatJSONRecord(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "ident"}, Name: "cluster1"}
+	extra := map[string]interface{}{
+		"checkpoint": map[string]interface{}{"sync_files": 5.0}}
+
+	var got map[string]interface{}
+	b := formatJSONRecord(&sampleRecord, sr, true, extra)
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("could not parse %s: %v", b, err)
+	}
+
+	want := map[string]interface{}{
+		"name":             "cluster1",
+		"instance_type":    "shogun",
+		"identity":         "ident",
+		"timestamp":        "2014-05-01 10:00:00.000 UTC",
+		"user":             "postgres",
+		"dbname":           "postgres",
+		"pid":              1234.0,
+		"session_id":       "5362197c.4d2",
+		"line_num":         7.0,
+		"ps":               "SELECT",
+		"session_start":    "2014-05-01 09:59:58 UTC",
+		"vxid":             "2/14",
+		"error_severity":   "ERROR",
+		"state_code":       "42P01",
+		"condition":        "undefined_table",
+		"class":            "syntax_error_or_access_rule_violation",
+		"message":          `relation "nope" does not exist`,
+		"statement":        "SELECT * FROM nope;",
+		"cursor_position":  15.0,
+		"application_name": "psql",
+		"checkpoint":       map[string]interface{}{"sync_files": 5.0},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if strings.Contains(string(b), "detail") {
+		t.Errorf("absent fields should be left out: %s", b)
+	}
+}
@@ -0,0 +1,199 @@
+// Policies for records with many lines, or too many bytes, for drains
+// that take every frame as one line.  Serves choose a "line_policy":
+//
+//     "keep", the default, sends each record as one frame, newlines
+//     and all.
+//
+//     "escape" sends each record as one line, with newlines and
+//     carriage returns written as \n and \r, and backslashes as \\.
+//
+//     "split" sends each line of a record as a frame of its own, and
+//     splits lines longer than the maximum frame size, marking every
+//     frame of a record with an id they share and their place among
+//     them: "[name] [5c3a9e01 2/3] ...".  Every frame begins as the
+//     record does, with the name of the serve, the audit header, and
+//     the labels.
+//
+//     "truncate" sends each record as one frame, cut off with an
+//     ellipsis at the maximum frame size.
+//
+// Records longer than "max_frame_size" are truncated in the "keep" and
+// "escape" policies too, if one is given.  These policies apply to the
+// text format; JSON records are always on one line, and are never cut
+// short.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	linePolicyKeep     = "keep"
+	linePolicyEscape   = "escape"
+	linePolicySplit    = "split"
+	linePolicyTruncate = "truncate"
+
+	// For "split" and "truncate", unless a serve says otherwise.
+	defaultMaxFrameSize = 8 * KB
+
+	// Enough for a split frame's marker and something after it.
+	minMaxFrameSize = 64
+
+	// The fewest bytes of a record a split frame carries, however
+	// long the head each repeats, though that makes for frames
+	// over the maximum size.
+	minSplitRoom = 16
+
+	ellipsis = "..."
+)
+
+func validLinePolicy(policy string) bool {
+	switch policy {
+	case linePolicyKeep, linePolicyEscape, linePolicySplit,
+		linePolicyTruncate:
+		return true
+	}
+
+	return false
+}
+
+// Ids shared by the frames split from a record.
+var frameIDs = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+func newFrameID() string {
+	frameIDs.Lock()
+	defer frameIDs.Unlock()
+
+	return fmt.Sprintf("%08x", frameIDs.Uint32())
+}
+
+// Cut msg short to at most max bytes, ending in an ellipsis, without
+// splitting any UTF-8 sequence.  It is returned as-is if it fits.
+func truncateFrame(msg []byte, max int) ([]byte, bool) {
+	if max <= 0 || len(msg) <= max {
+		return msg, false
+	}
+
+	cut := max - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(msg[cut]) {
+		cut--
+	}
+
+	out := make([]byte, 0, cut+len(ellipsis))
+	out = append(out, msg[:cut]...)
+	return append(out, ellipsis...), true
+}
+
+func escapeNewlines(msg []byte) []byte {
+	var b bytes.Buffer
+	b.Grow(len(msg))
+
+	for _, c := range msg {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.Bytes()
+}
+
+// Split msg into pieces of at most max bytes, without splitting any
+// UTF-8 sequence.
+func chunkLine(line []byte, max int) [][]byte {
+	var chunks [][]byte
+
+	for len(line) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+
+		if cut == 0 {
+			cut = max
+		}
+
+		chunks = append(chunks, line[:cut])
+		line = line[cut:]
+	}
+
+	return append(chunks, line)
+}
+
+// Render a formatted record, the head it begins with and the rest, as
+// the frames to send it in, by the serve's policy.
+func frameRecord(sr *serveRecord, head string, msg []byte) [][]byte {
+	if sr.format == formatJSON {
+		return [][]byte{msg}
+	}
+
+	if sr.linePolicy == linePolicySplit {
+		return splitRecord(sr, head, msg)
+	}
+
+	msg = append([]byte(head), msg...)
+
+	var truncated bool
+
+	switch sr.linePolicy {
+	case linePolicyEscape:
+		msg = escapeNewlines(bytes.TrimRight(msg, "\n"))
+		msg, truncated = truncateFrame(msg, sr.maxFrameSize)
+	default:
+		msg, truncated = truncateFrame(msg, sr.maxFrameSize)
+	}
+
+	if truncated {
+		sr.stats().incr("truncated_frames")
+	}
+
+	return [][]byte{msg}
+}
+
+func splitRecord(sr *serveRecord, head string, msg []byte) [][]byte {
+	lines := bytes.Split(bytes.TrimRight(msg, "\n"), []byte("\n"))
+
+	// The marker is "[id i/n] ", which is at most this long for
+	// any number of frames likely to come of a record, and comes
+	// after the head.
+	id := newFrameID()
+	room := sr.maxFrameSize - len(head) - len(id) -
+		len(" 9999/9999[] ")
+	if room < minSplitRoom {
+		room = minSplitRoom
+	}
+
+	var pieces [][]byte
+	for _, line := range lines {
+		pieces = append(pieces, chunkLine(line, room)...)
+	}
+
+	if len(pieces) == 1 {
+		return [][]byte{append([]byte(head), pieces[0]...)}
+	}
+
+	sr.stats().add("split_frames", uint64(len(pieces)))
+
+	frames := make([][]byte, len(pieces))
+	for i, piece := range pieces {
+		frames[i] = append([]byte(fmt.Sprintf("%s[%s %d/%d] ", head,
+			id, i+1, len(pieces))), piece...)
+	}
+
+	return frames
+}
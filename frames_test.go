@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFrameRecord(t *testing.T) {
+	msg := []byte("relation \"t\" does not exist\nSELECT *\n  FROM t\n")
+
+	sr := &serveRecord{sKey: sKey{I: "frames-keep"},
+		linePolicy: linePolicyKeep}
+	if frames := frameRecord(sr, "", msg); len(frames) != 1 ||
+		string(frames[0]) != string(msg) {
+		t.Fatalf("keep should send records as-is, got %q", frames)
+	}
+
+	sr = &serveRecord{sKey: sKey{I: "frames-escape"},
+		linePolicy: linePolicyEscape}
+	frames := frameRecord(sr, "", []byte("a\\b\nc\r\n"))
+	if len(frames) != 1 || string(frames[0]) != `a\\b\nc\r` {
+		t.Fatalf("unexpected escaped frames %q", frames)
+	}
+
+	sr = &serveRecord{sKey: sKey{I: "frames-split"},
+		linePolicy: linePolicySplit, maxFrameSize: 64}
+	frames = frameRecord(sr, "", msg)
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got %q", frames)
+	}
+
+	marker := regexp.MustCompile(`^\[([0-9a-f]{8}) (\d)/3\] (.*)$`)
+	lines := strings.Split(strings.TrimSpace(string(msg)), "\n")
+	var id string
+	for i, f := range frames {
+		m := marker.FindStringSubmatch(string(f))
+		if m == nil || m[2] != string('1'+rune(i)) || m[3] != lines[i] {
+			t.Fatalf("unexpected frame %d: %q", i, f)
+		}
+
+		if id != "" && m[1] != id {
+			t.Fatalf("frames of a record should share an id: %q",
+				frames)
+		}
+
+		id = m[1]
+	}
+
+	if got := sr.stats().snapshot()["split_frames"]; got != uint64(3) {
+		t.Fatalf("expected 3 split frames counted, got %v", got)
+	}
+
+	// Long lines are split too, and never within a character.
+	long := strings.Repeat("é", 100)
+	frames = frameRecord(sr, "", []byte(long))
+	anyMarker := regexp.MustCompile(`^\[[0-9a-f]{8} \d+/\d+\] `)
+	var joined string
+	for _, f := range frames {
+		if len(f) > 64 {
+			t.Fatalf("frame longer than the maximum: %q", f)
+		}
+
+		joined += anyMarker.ReplaceAllString(string(f), "")
+	}
+
+	if joined != long {
+		t.Fatalf("split frames do not make up the line: %q", frames)
+	}
+
+	// Records on one line go unmarked.
+	if frames = frameRecord(sr, "", []byte("short\n")); len(frames) != 1 ||
+		string(frames[0]) != "short" {
+		t.Fatalf("unexpected frames %q", frames)
+	}
+
+	sr = &serveRecord{sKey: sKey{I: "frames-truncate"},
+		linePolicy: linePolicyTruncate, maxFrameSize: 64}
+	frames = frameRecord(sr, "", []byte(long))
+	if len(frames) != 1 || len(frames[0]) > 64 ||
+		!strings.HasSuffix(string(frames[0]), ellipsis) ||
+		!strings.HasPrefix(long, strings.TrimSuffix(string(frames[0]),
+			ellipsis)) {
+		t.Fatalf("unexpected truncated frames %q", frames)
+	}
+
+	if got := sr.stats().snapshot()["truncated_frames"]; got != uint64(1) {
+		t.Fatalf("expected 1 truncation counted, got %v", got)
+	}
+}
+
+func TestSplitAuditRecord(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "frames-audit"}, Name: "cluster1",
+		linePolicy: linePolicySplit, maxFrameSize: 128}
+	sr.setLabels(map[string]string{"region": "us-east-1"})
+
+	lr := sampleRecord
+	lr.UserQuery = strp(strings.Repeat("SELECT 1;", 20))
+	head := textRecordHead(sr, true)
+	frames := frameRecord(sr, head, formatTextMessage(&lr))
+	if len(frames) < 3 {
+		t.Fatalf("expected the record to be split, got %q", frames)
+	}
+
+	// Every frame says where it comes from, not only the first.
+	want := "[cluster1] instance_type=shogun identity=frames-audit " +
+		"labels.region=us-east-1 "
+	marker := regexp.MustCompile(`^\[[0-9a-f]{8} \d+/\d+\] `)
+	var joined []string
+	for _, f := range frames {
+		if len(f) > sr.maxFrameSize {
+			t.Fatalf("frame longer than the maximum: %q", f)
+		}
+
+		if !strings.HasPrefix(string(f), want) {
+			t.Fatalf("expected frame to begin %q, got %q", want, f)
+		}
+
+		rest := strings.TrimPrefix(string(f), want)
+		if !marker.MatchString(rest) {
+			t.Fatalf("expected a marker after the head, got %q", f)
+		}
+
+		joined = append(joined, marker.ReplaceAllString(rest, ""))
+	}
+
+	if !strings.Contains(strings.Join(joined, ""), *lr.UserQuery) {
+		t.Fatalf("split frames do not make up the record: %q", frames)
+	}
+}
+
+func TestLinePolicyConfig(t *testing.T) {
+	project := func(extra string) (*serveRecord, error) {
+		var v interface{}
+		err := json.Unmarshal([]byte(`{"i": "x", "p": "/p", `+
+			`"url": "https://token:t@localhost"`+extra+`}`), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return projectFromJSON(v)
+	}
+
+	rec, err := project(``)
+	if err != nil || rec.linePolicy != linePolicyKeep ||
+		rec.maxFrameSize != 0 {
+		t.Fatalf("unexpected defaults %v, %v", rec, err)
+	}
+
+	rec, err = project(`, "line_policy": "split"`)
+	if err != nil || rec.maxFrameSize != defaultMaxFrameSize {
+		t.Fatalf("unexpected result %v, %v", rec, err)
+	}
+
+	for _, extra := range []string{
+		`, "line_policy": "fold"`,
+		`, "line_policy": "split", "max_frame_size": 10`,
+		`, "line_policy": "split", "max_frame_size": 0`,
+		`, "format": "json", "line_policy": "escape"`,
+	} {
+		if _, err := project(extra); err == nil {
+			t.Errorf("expected %s to be rejected", extra)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+#!/usr/bin/env python3
+#
+# Generate charsets.go, the tables encoding.go transcodes the server
+# encodings of Postgres that are not UTF-8 by, from Python's codecs.
+# Run by "go generate" in this directory.
+
+single = [
+    ("LATIN1", "latin_1"), ("LATIN2", "iso8859_2"), ("LATIN3", "iso8859_3"),
+    ("LATIN4", "iso8859_4"), ("LATIN5", "iso8859_9"), ("LATIN6", "iso8859_10"),
+    ("LATIN7", "iso8859_13"), ("LATIN8", "iso8859_14"), ("LATIN9", "iso8859_15"),
+    ("LATIN10", "iso8859_16"), ("ISO_8859_5", "iso8859_5"),
+    ("ISO_8859_6", "iso8859_6"), ("ISO_8859_7", "iso8859_7"),
+    ("ISO_8859_8", "iso8859_8"), ("KOI8R", "koi8_r"), ("KOI8U", "koi8_u"),
+    ("WIN866", "cp866"), ("WIN874", "cp874"),
+] + [("WIN%d" % n, "cp%d" % n) for n in range(1250, 1259)]
+
+def dec(b, codec):
+    try:
+        s = b.decode(codec)
+    except UnicodeDecodeError:
+        return 0
+    if len(s) != 1:
+        return 0
+    return ord(s)
+
+def table(vals, per, width):
+    out = []
+    for i in range(0, len(vals), per):
+        out.append("\t" + " ".join(("0x%0*X," % (width, v)) for v in vals[i:i+per]))
+    return "\n".join(out)
+
+w = open("charsets.go", "w")
+w.write("""// Code generated by gen_charsets.py; DO NOT EDIT.
+
+// Mappings to Unicode of the server encodings of Postgres that are
+// not UTF-8, as Python's codecs decode them, from which these tables
+// were generated.  Bytes and sequences mapping to nothing are 0.
+
+package main
+
+// Characters of the single-byte encodings for the bytes 0x80 to 0xFF,
+// the rest being ASCII.
+var singleByteCharsets = map[string]*[128]rune{
+""")
+for name, codec in single:
+    vals = [dec(bytes([b]), codec) for b in range(0x80, 0x100)]
+    w.write('\t"%s": {\n' % name)
+    w.write("\n".join("\t" + l for l in table(vals, 8, 4).split("\n")))
+    w.write("\n\t},\n")
+w.write("}\n")
+
+def jis(prefix):
+    vals = []
+    for r in range(94):
+        for c in range(94):
+            vals.append(dec(prefix + bytes([0xA1 + r, 0xA1 + c]), "euc_jp"))
+    return vals
+
+w.write("""
+// Characters of JIS X 0208 by row and cell, as EUC_JP encodes them in
+// two bytes from 0xA1.
+var jis0208 = [94 * 94]uint16{
+""")
+w.write(table(jis(b""), 8, 4) + "\n}\n")
+w.write("""
+// Characters of JIS X 0212 by row and cell, as EUC_JP encodes them in
+// the same two bytes after 0x8F.
+var jis0212 = [94 * 94]uint16{
+""")
+w.write(table(jis(b"\x8f"), 8, 4) + "\n}\n")
+w.close()
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -14,6 +19,12 @@ import (
 type LogplexPrint struct{}
 
 func (*LogplexPrint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := decodeBody(r); err != nil {
+		log.Printf("Could not decode request: %v", err)
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
 	dump, err := httputil.DumpRequest(r, true)
 	if err != nil {
 		log.Printf("Could not dump request: %#v", err)
@@ -25,6 +36,42 @@ func (*LogplexPrint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Replace a compressed request body with its decoded contents, so
+// that the dump shows what was logged.
+func decodeBody(r *http.Request) error {
+	var zr io.Reader
+	var err error
+
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "":
+		return nil
+	case "gzip":
+		zr, err = gzip.NewReader(r.Body)
+	case "deflate":
+		zr, err = zlib.NewReader(r.Body)
+	default:
+		return fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("decoded %s body of %d bytes into %d bytes",
+		r.Header.Get("Content-Encoding"), r.ContentLength, len(body))
+
+	r.Header.Del("Content-Encoding")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	return nil
+}
+
 func main() {
 	s := httptest.NewTLSServer(&LogplexPrint{})
 	u, err := url.Parse(s.URL)
@@ -37,7 +84,7 @@ func main() {
 	fmt.Println(u)
 
 	// Signal handling:
-	sigch := make(chan os.Signal)
+	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, os.Interrupt, os.Kill)
 	for sig := range sigch {
 		log.Printf("got signal %v", sig)
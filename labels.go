@@ -0,0 +1,214 @@
+// Labels saying where records come from, for searches across many
+// serves: the static "labels" of a serve record, such as its cluster,
+// region, plan, or role, and when the serve asks to be enriched, the
+// host and instance of the collector and the version of Postgres.
+// Labels go with records and events in every format:
+//
+//     text:     [name] labels.cluster=main labels.region=us-east-1 labels.host=c1 ... message
+//     JSON:     {"labels": {"cluster": "main", "region": "us-east-1", "host": "c1", ...}, ...}
+//     RFC 5424: [labels@32473 cluster="main" region="us-east-1" host="c1" ...]
+//
+// The last is for syslog messages, which keep structured data of
+// their own.  The collector's instance id is given by COLLECTOR_ID,
+// or made up when it starts.  The version of Postgres is the one sent
+// on connection, or logged on startup, last seen for the serve.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The SD-ID of labels in RFC 5424 structured data, under the
+// enterprise number reserved for documentation, as labels are not
+// registered with IANA.
+const labelsSDID = "labels@32473"
+
+// Keys of labels, which must do as logfmt keys and as SD-PARAM names,
+// which are at most 32 characters.
+var labelKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,31}$`)
+
+// Names of labels added by enrichment.
+var enrichmentLabels = map[string]bool{
+	"host": true, "collector_id": true, "pg_version": true,
+}
+
+// What the collector says of itself in enriched records.
+type collectorInfo struct {
+	host string
+	id   string
+}
+
+var collector collectorInfo
+
+// Find out the host of the collector and its instance id.
+func initCollector() {
+	collector.host, _ = os.Hostname()
+
+	collector.id = os.Getenv("COLLECTOR_ID")
+	if collector.id == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err == nil {
+			collector.id = hex.EncodeToString(b)
+		}
+	}
+}
+
+// Check the labels of a serve record, as decoded from JSON.
+func parseLabels(v interface{}) (map[string]string, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("\"labels\" in serve record must be " +
+			"an object")
+	}
+
+	labels := make(map[string]string, len(m))
+	for k, v := range m {
+		if !labelKey.MatchString(k) {
+			return nil, fmt.Errorf("invalid label %q in serve "+
+				"record", k)
+		}
+
+		if enrichmentLabels[k] {
+			return nil, fmt.Errorf("label %q in serve record is "+
+				"reserved for enrichment", k)
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("label %q in serve record "+
+				"must be a string", k)
+		}
+
+		labels[k] = s
+	}
+
+	return labels, nil
+}
+
+// The static labels of a serve, rendered once in each of the ways
+// records carry them, as they go with every record.
+type labelSet struct {
+	// In order of their keys.
+	fields []eventField
+
+	// As logfmt pairs and as SD-PARAMs, each after a space but
+	// for the first pair.
+	text string
+	sd   string
+}
+
+// Set the static labels of a serve.
+func (sr *serveRecord) setLabels(labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	e := newEvent("")
+	for _, k := range keys {
+		e.add(k, labels[k])
+	}
+
+	var text bytes.Buffer
+	e.writeLogfmt(&text, "labels.")
+
+	sr.labels = labels
+	sr.labelSet = labelSet{fields: e.fields, text: text.String(),
+		sd: sdParams(e)}
+}
+
+// The labels of the collector and server, for serves that ask for
+// them.
+func (sr *serveRecord) enrichment() *event {
+	e := newEvent("")
+	if sr.enrich {
+		e.add("host", collector.host).
+			add("collector_id", collector.id).
+			add("pg_version", sr.stats().pgVersion())
+	}
+
+	return e
+}
+
+// The labels of a serve, static ones in order of their keys and then
+// those of enrichment, as a nested event to add to others.
+func (sr *serveRecord) labelEvent() *event {
+	static := sr.labelSet.fields
+
+	// Enrichment is appended to a copy, leaving the static labels
+	// be for the next record.
+	e := &event{fields: static[:len(static):len(static)]}
+	e.fields = append(e.fields, sr.enrichment().fields...)
+	return e
+}
+
+// The labels of a serve as a prefix for text records, or "" if it
+// has none.
+func (sr *serveRecord) labelPrefix() string {
+	enrichment := sr.enrichment()
+	if len(enrichment.fields) == 0 {
+		if sr.labelSet.text == "" {
+			return ""
+		}
+
+		return sr.labelSet.text + " "
+	}
+
+	var b bytes.Buffer
+	b.WriteString(sr.labelSet.text)
+	enrichment.writeLogfmt(&b, "labels.")
+	b.WriteByte(' ')
+	return b.String()
+}
+
+// The labels of a serve as an RFC 5424 SD-ELEMENT, or "" if it has
+// none.
+func (sr *serveRecord) labelSDElement() string {
+	sd := sr.labelSet.sd + sdParams(sr.enrichment())
+	if sd == "" {
+		return ""
+	}
+
+	return "[" + labelsSDID + sd + "]"
+}
+
+// The fields of an event as RFC 5424 SD-PARAMs, each after a space.
+func sdParams(e *event) string {
+	var b bytes.Buffer
+	for _, f := range e.fields {
+		b.WriteString(" " + f.key + `="`)
+		b.WriteString(sdParamEscaper.Replace(fmt.Sprint(f.value)))
+		b.WriteByte('"')
+	}
+
+	return b.String()
+}
+
+// Escapes of PARAM-VALUE in RFC 5424.
+var sdParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// Record the version of Postgres last seen for a serve, such as
+// "9.4.1".
+func (s *serveStats) setPgVersion(version string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.version = version
+}
+
+func (s *serveStats) pgVersion() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.version
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	defer func(saved collectorInfo) { collector = saved }(collector)
+	collector = collectorInfo{host: "c1", id: "abc123"}
+
+	sr := &serveRecord{sKey: sKey{I: "labels-ident"}, Name: "cluster1"}
+	sr.setLabels(map[string]string{"region": "us-east-1",
+		"cluster": "main", "plan": "standard 2"})
+
+	lr := sampleRecord
+	want := `[cluster1] labels.cluster=main labels.plan="standard 2" ` +
+		`labels.region=us-east-1 `
+	if head := textRecordHead(sr, false); head != want {
+		t.Fatalf("expected text record to begin %q, got %q", want, head)
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(formatJSONRecord(&lr, sr, false, nil),
+		&obj); err != nil {
+		t.Fatal(err)
+	}
+
+	labels, _ := obj["labels"].(map[string]interface{})
+	if labels["cluster"] != "main" || labels["region"] != "us-east-1" ||
+		len(labels) != 3 {
+		t.Fatalf("unexpected labels in JSON record %v", obj)
+	}
+
+	event := string(newEvent("x").add("a", 1).format(sr))
+	if !strings.Contains(event, " labels.cluster=main ") ||
+		!strings.HasSuffix(event, " a=1") {
+		t.Fatalf("unexpected event %q", event)
+	}
+
+	// Enrichment follows the static labels.
+	sr.enrich = true
+	sr.sKey.I = "labels-enriched"
+	sr.stats().setPgVersion("9.4.1")
+
+	sd := sr.labelSDElement()
+	want = `[labels@32473 cluster="main" plan="standard 2" ` +
+		`region="us-east-1" host="c1" collector_id="abc123" ` +
+		`pg_version="9.4.1"]`
+	if sd != want {
+		t.Fatalf("expected structured data %q, got %q", want, sd)
+	}
+
+	want = `labels.cluster=main labels.plan="standard 2" ` +
+		`labels.region=us-east-1 labels.host=c1 ` +
+		`labels.collector_id=abc123 labels.pg_version=9.4.1 `
+	if prefix := sr.labelPrefix(); prefix != want {
+		t.Fatalf("expected text prefix %q, got %q", want, prefix)
+	}
+
+	// Enrichment leaves the static labels as they were.
+	if e := sr.labelEvent(); len(e.fields) != 6 ||
+		len(sr.labelSet.fields) != 3 {
+		t.Fatalf("unexpected labels %v", e.fields)
+	}
+
+	sr.setLabels(map[string]string{"role": `a"b]c\`})
+	if sd := sr.labelSDElement(); !strings.HasPrefix(sd,
+		`[labels@32473 role="a\"b\]c\\" `) {
+		t.Fatalf("unexpected escaping in structured data %q", sd)
+	}
+
+	// Serves without labels are left as they were.
+	bare := &serveRecord{sKey: sKey{I: "labels-none"}}
+	if bare.labelPrefix() != "" || bare.labelSDElement() != "" {
+		t.Fatal("expected no labels")
+	}
+}
+
+func TestLabelsConfig(t *testing.T) {
+	project := func(extra string) (*serveRecord, error) {
+		var v interface{}
+		err := json.Unmarshal([]byte(`{"i": "x", "p": "/p", `+
+			`"url": "https://token:t@localhost"`+extra+`}`), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return projectFromJSON(v)
+	}
+
+	rec, err := project(`, "labels": {"cluster": "main", ` +
+		`"role": "replica"}, "enrich": true`)
+	if err != nil || rec.labels["role"] != "replica" || !rec.enrich {
+		t.Fatalf("unexpected result %v, %v", rec, err)
+	}
+
+	for _, extra := range []string{
+		`, "labels": ["main"]`,
+		`, "labels": {"bad key": "x"}`,
+		`, "labels": {"host": "x"}`,
+		`, "labels": {"size": 3}`,
+		`, "enrich": "yes"`,
+	} {
+		if _, err := project(extra); err == nil {
+			t.Errorf("expected %s to be rejected", extra)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Events for the lifecycle of a server: starting up, accepting
+// connections, shutting down, crashing, recovering, and being
+// promoted, as Postgres logs them, such as:
+//
+//     database system was interrupted; last known up at 2014-05-01 09:00:00 UTC
+//     redo starts at 0/1234568
+//     database system is ready to accept connections
+//     server process (PID 123) was terminated by signal 9: Killed
+//     terminating any other active server processes
+//     received promote request
+//
+// Each is made into an event with the state the server is in after
+// it, and the last state known for every serve is kept, to be written
+// to the stats file along with its counters.
+//
+// A process exiting is not taken for a crash of the server by itself:
+// background workers exit with code 1 to be restarted, and on every
+// shutdown since Postgres 10, the logical replication launcher does.
+// A crash is known once the postmaster terminates the other processes.
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	stateStarting       = "starting"
+	stateRecovering     = "recovering"
+	stateRunning        = "running"
+	stateStandby        = "standby"
+	statePromoting      = "promoting"
+	stateShuttingDown   = "shutting_down"
+	stateStopped        = "stopped"
+	stateCrashed        = "crashed"
+	stateReinitializing = "reinitializing"
+)
+
+// A message about the lifecycle of the server, the event it makes,
+// and the state it leaves the server in, or "" to leave it as it was.
+// Submatches of the pattern become fields of the event by the names
+// in fields.  A message with no event is not about the lifecycle,
+// though it looks like one.
+type lifecycleMessage struct {
+	re     *regexp.Regexp
+	event  string
+	state  string
+	fields []string
+}
+
+var lifecycleMessages = []lifecycleMessage{
+	{regexp.MustCompile(`^starting (PostgreSQL \S+)`),
+		"startup", stateStarting, []string{"version"}},
+	{regexp.MustCompile(
+		`^database system was shut down(?: in recovery)? at (.*)$`),
+		"startup", stateStarting, []string{"last_up"}},
+	{regexp.MustCompile(`^database system was interrupted` +
+		`(?: while in recovery)?(?: at (?:log time )?(.*?))?` +
+		`(?:; last known up at (.*))?$`),
+		"crash_recovery", stateRecovering,
+		[]string{"interrupted_at", "last_up"}},
+	{regexp.MustCompile(`^database system was not properly shut ` +
+		`down; automatic recovery in progress`),
+		"crash_recovery", stateRecovering, nil},
+	{regexp.MustCompile(`^redo starts at (\S+)`),
+		"redo_start", stateRecovering, []string{"lsn"}},
+	{regexp.MustCompile(`^redo done at (\S+)`),
+		"redo_done", stateRecovering, []string{"lsn"}},
+	{regexp.MustCompile(
+		`^database system is ready to accept connections`),
+		"ready", stateRunning, nil},
+	{regexp.MustCompile(
+		`^database system is ready to accept read[- ]only connections`),
+		"ready", stateStandby, nil},
+	{regexp.MustCompile(`^received promote request`),
+		"promote", statePromoting, nil},
+	{regexp.MustCompile(`^selected new timeline ID: (\d+)`),
+		"timeline_switch", statePromoting, []string{"timeline"}},
+	{regexp.MustCompile(
+		`^received (smart|fast|immediate) shutdown request`),
+		"shutdown_request", stateShuttingDown, []string{"mode"}},
+	{regexp.MustCompile(`^database system is shutting down`),
+		"shutdown", stateShuttingDown, nil},
+	{regexp.MustCompile(`^database system is shut down`),
+		"stopped", stateStopped, nil},
+	{regexp.MustCompile(`^background worker ".*" \(PID \d+\) ` +
+		`exited with exit code [01]$`),
+		"", "", nil},
+	{regexp.MustCompile(`^(.+?) \(PID (\d+)\) was terminated by ` +
+		`signal (\d+)(?:: (.*))?$`),
+		"process_crash", "",
+		[]string{"process", "process_pid", "signal", "signal_name"}},
+	{regexp.MustCompile(`^(.+?) \(PID (\d+)\) exited with exit code (\d+)`),
+		"process_crash", "",
+		[]string{"process", "process_pid", "exit_code"}},
+	{regexp.MustCompile(`^terminating any other active server processes`),
+		"crash", stateCrashed, nil},
+	{regexp.MustCompile(`^all server processes terminated; reinitializing`),
+		"reinitialize", stateReinitializing, nil},
+}
+
+// Make an event of a record about the lifecycle of the server, or
+// return nil if it is about none.
+func lifecycleEventOf(lr *logRecord) *event {
+	if lr.ErrMessage == nil {
+		return nil
+	}
+
+	for _, lm := range lifecycleMessages {
+		m := lm.re.FindStringSubmatch(*lr.ErrMessage)
+		if m == nil {
+			continue
+		}
+
+		if lm.event == "" {
+			return nil
+		}
+
+		e := newEvent("lifecycle").add("transition", lm.event).
+			add("state", lm.state)
+		for i, f := range lm.fields {
+			if n, err := strconv.Atoi(m[i+1]); err == nil {
+				e.add(f, n)
+			} else {
+				e.add(f, m[i+1])
+			}
+		}
+
+		return e.add("pid", lr.Pid).add("message", *lr.ErrMessage)
+	}
+
+	return nil
+}
+
+// The last known lifecycle state of a serve.
+type lifecycleState struct {
+	state string
+	event string
+	since time.Time
+}
+
+// Record the state a serve is in after an event, or that it stays in
+// the state it was for "", returning the state it was in before.
+func (s *serveStats) setLifecycle(state, event string, when time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	previous := s.lifecycle.state
+	if state == "" {
+		state = previous
+	}
+
+	if state != previous {
+		s.lifecycle.since = when
+	}
+
+	s.lifecycle.state = state
+	s.lifecycle.event = event
+
+	return previous
+}
+
+// Metrics for a state: a count of the event that led to it, and
+// whether the server is up, that is, accepting connections.
+func lifecycleMetrics(state, event string) []metric {
+	up := 0.0
+	if state == stateRunning || state == stateStandby {
+		up = 1
+	}
+
+	return []metric{
+		{kind: "count", name: "postgres.lifecycle." + event, value: 1},
+		{kind: "sample", name: "postgres.lifecycle.up", value: up},
+	}
+}
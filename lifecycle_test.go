@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "ident"}}
+
+	for _, tc := range []struct {
+		msg, want string
+	}{
+		{"database system was interrupted; last known up at " +
+			"2014-05-01 09:00:00 UTC",
+			"event=lifecycle identity=ident transition=crash_recovery " +
+				"state=recovering last_up=\"2014-05-01 09:00:00 UTC\" " +
+				"pid=1234"},
+		{"redo starts at 0/1234568",
+			"event=lifecycle identity=ident transition=redo_start " +
+				"state=recovering lsn=0/1234568 pid=1234"},
+		{"database system is ready to accept read only connections",
+			"event=lifecycle identity=ident transition=ready " +
+				"state=standby pid=1234"},
+		{"selected new timeline ID: 2",
+			"event=lifecycle identity=ident transition=timeline_switch " +
+				"state=promoting timeline=2 pid=1234"},
+		{"server process (PID 123) was terminated by signal 9: Killed",
+			"event=lifecycle identity=ident transition=process_crash " +
+				"process=\"server process\" " +
+				"process_pid=123 signal=9 signal_name=Killed pid=1234"},
+		{"received fast shutdown request",
+			"event=lifecycle identity=ident transition=shutdown_request " +
+				"state=shutting_down mode=fast pid=1234"},
+	} {
+		lr := sampleRecord
+		lr.ErrMessage = strp(tc.msg)
+
+		e := lifecycleEventOf(&lr)
+		if e == nil {
+			t.Errorf("no event for %q", tc.msg)
+			continue
+		}
+
+		// Leave out the message, which is the same every time.
+		e.fields = e.fields[:len(e.fields)-1]
+		if got := string(e.format(sr)); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+
+	if e := lifecycleEventOf(&sampleRecord); e != nil {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestLifecycleState(t *testing.T) {
+	s := &serveStats{sKey: sKey{I: "ident"},
+		counters: make(map[string]uint64)}
+	start := time.Date(2014, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	if prev := s.setLifecycle(stateRecovering, "redo_start",
+		start); prev != "" {
+		t.Errorf("unexpected previous state %q", prev)
+	}
+
+	s.setLifecycle(stateRecovering, "redo_done", start.Add(time.Second))
+	if prev := s.setLifecycle(stateRunning, "ready",
+		start.Add(time.Minute)); prev != stateRecovering {
+		t.Errorf("unexpected previous state %q", prev)
+	}
+
+	got := s.snapshot()["lifecycle"].(map[string]interface{})
+	if got["state"] != stateRunning || got["event"] != "ready" ||
+		got["since"] != "2014-05-01T10:01:00Z" {
+		t.Errorf("unexpected lifecycle %v", got)
+	}
+}
+
+func TestLifecycleShutdownAndCrash(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "lifecycle-sequence"}}
+
+	state := func(msg string) string {
+		lr := sampleRecord
+		lr.ErrMessage = strp(msg)
+		if e := lifecycleEventOf(&lr); e != nil {
+			emitLifecycleEvent(e, &serveClients{}, sr)
+		}
+
+		got, _ := sr.stats().snapshot()["lifecycle"].(map[string]interface{})
+		s, _ := got["state"].(string)
+		return s
+	}
+
+	for _, tc := range []struct{ msg, state string }{
+		{"database system is ready to accept connections", stateRunning},
+		{"background worker \"logical replication launcher\" " +
+			"(PID 4243) exited with exit code 1", stateRunning},
+		{"received fast shutdown request", stateShuttingDown},
+		{"aborting any active transactions", stateShuttingDown},
+		{"background worker \"logical replication launcher\" " +
+			"(PID 4243) exited with exit code 1", stateShuttingDown},
+		{"shutting down", stateShuttingDown},
+		{"database system is shut down", stateStopped},
+		{"database system is ready to accept connections", stateRunning},
+		{"server process (PID 123) was terminated by signal 9: Killed",
+			stateRunning},
+		{"terminating any other active server processes", stateCrashed},
+		{"all server processes terminated; reinitializing",
+			stateReinitializing},
+	} {
+		if got := state(tc.msg); got != tc.state {
+			t.Errorf("after %q: got state %q, want %q", tc.msg, got,
+				tc.state)
+		}
+	}
+}
+
+func TestLifecycleEventsConfig(t *testing.T) {
+	project := func(extra string) (*serveRecord, error) {
+		var v interface{}
+		err := json.Unmarshal([]byte(`{"i": "x", "p": "/p", `+
+			`"url": "https://token:t@localhost"`+extra+`}`), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return projectFromJSON(v)
+	}
+
+	// Events go to "audit" or "url" unless told otherwise.
+	rec, err := project(``)
+	if err != nil || rec.lifecycleEvents != "" {
+		t.Fatalf("unexpected defaults %v, %v", rec, err)
+	}
+
+	rec, err = project(`, "lifecycle_events": ` +
+		`"https://events.example.com/logs"`)
+	if err != nil || len(rec.otherDestinations()) != 1 {
+		t.Fatalf("unexpected result %v, %v", rec, err)
+	}
+
+	if _, err := project(`, "lifecycle_events": "audit"`); err == nil {
+		t.Error("expected \"audit\" without an audit URL to be rejected")
+	}
+}
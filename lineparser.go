@@ -0,0 +1,462 @@
+// Parsing of plain-text log lines, for the "logfile" protocol, into
+// logRecords.
+//
+// A parser is either a regular expression with named capture groups,
+// or is compiled from a Postgres log_line_prefix.  The recognized
+// group names are:
+//
+//     message      the text of the record (required)
+//     timestamp    stored in LogTime
+//     severity     e.g. LOG, ERROR, or WARNING, translated to ELevel
+//     pid          the process id
+//     user, database, client, application, session, line, sqlstate,
+//     vxid, txid, command
+//                  stored in the like-named logRecord fields
+//
+// Records can span several lines, such as a Postgres statement
+// continued over several lines or a Python traceback from Patroni.  A
+// continuation rule decides which lines not matching the parser
+// belong to the record before them:
+//
+//     "unmatched"  every line not matching the parser (the default)
+//     "indent"     only lines starting with a space or tab
+//     "none"       no lines: each line stands alone
+//
+// Lines that belong to no record are sent with only a message.  A
+// record that grows past maxAssembledRecord, as from a stream of lines
+// none of which match, is given up on, and lines are skipped until one
+// does.
+//
+// Postgres's stderr output gives DETAIL, HINT, STATEMENT, CONTEXT and
+// QUERY lines the same prefix as the line they elaborate upon; these
+// are folded into the record before them, too.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	continueUnmatched = "unmatched"
+	continueIndent    = "indent"
+	continueNone      = "none"
+)
+
+type lineParser struct {
+	re           *regexp.Regexp
+	continuation string
+
+	// Indexes of the subexpressions of re with each name.
+	groups map[string][]int
+}
+
+var lineParserGroups = []string{"message", "timestamp", "severity",
+	"pid", "user", "database", "client", "application", "session",
+	"line", "sqlstate", "vxid", "txid", "command"}
+
+func newLineParser(expr string, continuation string) (*lineParser, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch continuation {
+	case "":
+		continuation = continueUnmatched
+	case continueUnmatched, continueIndent, continueNone:
+	default:
+		return nil, fmt.Errorf("unknown continuation rule %q, "+
+			"expected one of %q, %q, or %q", continuation,
+			continueUnmatched, continueIndent, continueNone)
+	}
+
+	p := &lineParser{
+		re:           re,
+		continuation: continuation,
+		groups:       make(map[string][]int),
+	}
+
+	for i, name := range re.SubexpNames() {
+		p.groups[name] = append(p.groups[name], i)
+	}
+
+	if len(p.groups["message"]) == 0 {
+		return nil, fmt.Errorf("line parser %q lacks a "+
+			"\"message\" group", expr)
+	}
+
+	for name := range p.groups {
+		if name == "" {
+			continue
+		}
+
+		known := false
+		for _, g := range lineParserGroups {
+			known = known || g == name
+		}
+
+		if !known {
+			return nil, fmt.Errorf("line parser %q has unknown "+
+				"group %q", expr, name)
+		}
+	}
+
+	return p, nil
+}
+
+// Build a parser for Postgres's stderr log format, given the
+// log_line_prefix it was written with.
+func newPrefixLineParser(prefix string, continuation string) (*lineParser, error) {
+	expr, err := compileLogLinePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLineParser(
+		"^"+expr+`(?P<severity>[A-Z][A-Z0-9]*):  (?P<message>.*)$`,
+		continuation)
+}
+
+// Patterns for the timestamps log_line_prefix can contain.
+const (
+	prefixTimePattern   = `\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}`
+	prefixZonePattern   = `(?: [A-Za-z0-9:+-]+)?`
+	prefixMillisPattern = `\.\d+`
+)
+
+// Translate a log_line_prefix into a regular expression that matches
+// it, capturing what it can.
+func compileLogLinePrefix(prefix string) (string, error) {
+	var re []byte
+	optional := false
+
+	literal := func(c byte) {
+		re = append(re, regexp.QuoteMeta(string(c))...)
+	}
+
+	pattern := func(p string) {
+		re = append(re, p...)
+	}
+
+	for i := 0; i < len(prefix); i++ {
+		c := prefix[i]
+		if c != '%' {
+			literal(c)
+			continue
+		}
+
+		// Skip any padding, e.g. %-10u.
+		i++
+		for i < len(prefix) &&
+			(prefix[i] == '-' || (prefix[i] >= '0' && prefix[i] <= '9')) {
+			i++
+		}
+
+		if i >= len(prefix) {
+			return "", fmt.Errorf("log_line_prefix %q ends "+
+				"in an incomplete escape", prefix)
+		}
+
+		switch prefix[i] {
+		case 'a':
+			pattern(`(?P<application>.*?)`)
+		case 'u':
+			pattern(`(?P<user>.*?)`)
+		case 'd':
+			pattern(`(?P<database>.*?)`)
+		case 'r':
+			pattern(`(?P<client>.*?)(?:\(\d*\))?`)
+		case 'h':
+			pattern(`(?P<client>.*?)`)
+		case 'b':
+			pattern(`.*?`)
+		case 'p':
+			pattern(`(?P<pid>\d+)`)
+		case 'P':
+			pattern(`\d*`)
+		case 't':
+			pattern(`(?P<timestamp>` + prefixTimePattern +
+				prefixZonePattern + `)`)
+		case 'm':
+			pattern(`(?P<timestamp>` + prefixTimePattern +
+				prefixMillisPattern + prefixZonePattern + `)`)
+		case 'n':
+			pattern(`(?P<timestamp>\d+\.\d+)`)
+		case 'i':
+			pattern(`(?P<command>.*?)`)
+		case 'e':
+			pattern(`(?P<sqlstate>[0-9A-Z]{5})`)
+		case 'c':
+			pattern(`(?P<session>[0-9a-f]+\.[0-9a-f]+)`)
+		case 'l':
+			pattern(`(?P<line>\d+)`)
+		case 's':
+			pattern(prefixTimePattern + prefixZonePattern)
+		case 'v':
+			pattern(`(?P<vxid>\S*?)`)
+		case 'x':
+			pattern(`(?P<txid>\d+)`)
+		case 'Q':
+			pattern(`-?\d+`)
+		case '%':
+			literal('%')
+		case 'q':
+			// Processes that are not sessions stop
+			// printing the prefix here, so make the rest
+			// of it optional.
+			if !optional {
+				pattern(`(?:`)
+				optional = true
+			}
+		default:
+			return "", fmt.Errorf("log_line_prefix %q has "+
+				"unknown escape %%%c", prefix, prefix[i])
+		}
+	}
+
+	if optional {
+		pattern(`)?`)
+	}
+
+	return string(re), nil
+}
+
+// Fill dst from line, returning its severity as written, or false
+// if the line does not match the parser.
+func (p *lineParser) parse(dst *logRecord, line string) (string, bool) {
+	m := p.re.FindStringSubmatchIndex(line)
+	if m == nil {
+		return "", false
+	}
+
+	// The first non-empty match of the named group.
+	group := func(name string) string {
+		for _, i := range p.groups[name] {
+			if m[2*i] >= 0 && m[2*i+1] > m[2*i] {
+				return line[m[2*i]:m[2*i+1]]
+			}
+		}
+
+		return ""
+	}
+
+	num := func(name string) int64 {
+		n, _ := strconv.ParseInt(group(name), 10, 64)
+		return n
+	}
+
+	severity := group("severity")
+
+	message := group("message")
+	dst.ErrMessage = &message
+	dst.LogTime = group("timestamp")
+	dst.ELevel = lineElevel(severity)
+	dst.Pid = int32(num("pid"))
+	dst.UserName = nullIfEmpty(group("user"))
+	dst.DatabaseName = nullIfEmpty(group("database"))
+	dst.ClientAddr = nullIfEmpty(group("client"))
+	dst.ApplicationName = nullIfEmpty(group("application"))
+	dst.SessionID = group("session")
+	dst.SeqNum = num("line")
+	dst.SQLState = nullIfEmpty(group("sqlstate"))
+	dst.Vxid = nullIfEmpty(group("vxid"))
+	dst.Txid = uint64(num("txid"))
+	dst.PsDisplay = nullIfEmpty(group("command"))
+
+	return severity, true
+}
+
+// Like elevelOf, but also understands severities used by the other
+// programs one may want to tail, such as pgbouncer and Patroni.
+func lineElevel(severity string) int32 {
+	severity = strings.ToUpper(severity)
+
+	switch severity {
+	case "NOISE":
+		return elevelDebug1
+	case "CRITICAL":
+		return elevelFatal
+	case "WARN":
+		return elevelWarning
+	}
+
+	return elevelOf(severity)
+}
+
+// Assembles lines into logRecords using a lineParser.
+type lineAssembler struct {
+	p *lineParser
+
+	// The record being assembled, the field of it continuation
+	// lines are appended to, and whether it has grown since the
+	// last call to idle.
+	pending *logRecord
+	tail    **string
+	grew    bool
+
+	// The text of the tail field, which is stored in the record
+	// as it is emitted, and the lines of the pending record.
+	text bytes.Buffer
+	raw  bytes.Buffer
+
+	// Whether lines are being skipped after a record was given
+	// up on.
+	resync bool
+}
+
+func (a *lineAssembler) addLine(line []byte, emit func(lr *logRecord)) error {
+	text := strings.TrimRight(string(line), "\r\n")
+
+	var lr logRecord
+	if severity, ok := a.p.parse(&lr, text); ok {
+		a.resync = false
+
+		if a.pending != nil && a.elaborate(severity, &lr) {
+			return a.grow(line)
+		}
+
+		a.flush(emit)
+		a.pending = &lr
+		a.setTail(&lr.ErrMessage)
+		return a.grow(line)
+	}
+
+	if a.resync {
+		return fmt.Errorf("line skipped after a record longer "+
+			"than %d bytes", maxAssembledRecord)
+	}
+
+	if a.pending != nil && a.continues(text) {
+		a.text.WriteByte('\n')
+		a.text.WriteString(text)
+		return a.grow(line)
+	}
+
+	// A line belonging to no record at all.
+	a.flush(emit)
+	if text != "" {
+		emit(&logRecord{ErrMessage: &text})
+	}
+
+	return nil
+}
+
+// Emit the pending record if no lines have been added to it since the
+// last call, on the theory that it is complete.
+func (a *lineAssembler) idle(emit func(lr *logRecord)) {
+	if !a.grew {
+		a.flush(emit)
+	}
+
+	a.grew = false
+}
+
+func (a *lineAssembler) flush(emit func(lr *logRecord)) {
+	if a.pending != nil {
+		a.storeTail()
+		emit(a.pending)
+		a.discard()
+	}
+}
+
+func (a *lineAssembler) held() int {
+	return a.raw.Len()
+}
+
+// Account for a line added to the pending record, giving the record
+// up should it grow too long.
+func (a *lineAssembler) grow(line []byte) error {
+	a.grew = true
+	a.raw.Write(line)
+	if a.raw.Len() <= maxAssembledRecord {
+		return nil
+	}
+
+	data := append([]byte(nil), a.raw.Bytes()...)
+	a.discard()
+	a.resync = true
+
+	return &malformedRecord{fmt.Sprintf("log record longer than %d "+
+		"bytes", maxAssembledRecord), data}
+}
+
+func (a *lineAssembler) discard() {
+	a.pending = nil
+	a.tail = nil
+	a.text.Reset()
+	a.raw.Reset()
+}
+
+// Make dst the field continuation lines are appended to, once the
+// text of the last has been stored.
+func (a *lineAssembler) setTail(dst **string) {
+	a.tail = dst
+	a.text.Reset()
+	if *dst != nil {
+		a.text.WriteString(**dst)
+	}
+}
+
+// Store the text of the tail field in the record, if lines have been
+// appended to it.
+func (a *lineAssembler) storeTail() {
+	if a.tail == nil ||
+		*a.tail != nil && a.text.Len() == len(**a.tail) {
+		return
+	}
+
+	s := a.text.String()
+	*a.tail = &s
+}
+
+func (a *lineAssembler) continues(text string) bool {
+	switch a.p.continuation {
+	case continueUnmatched:
+		return true
+	case continueIndent:
+		return strings.HasPrefix(text, " ") ||
+			strings.HasPrefix(text, "\t")
+	}
+
+	return false
+}
+
+// Fold Postgres's DETAIL, HINT and similar lines into the pending
+// record they belong to, returning false if lr is not such a line.
+func (a *lineAssembler) elaborate(severity string, lr *logRecord) bool {
+	if lr.Pid != a.pending.Pid {
+		return false
+	}
+
+	var dst **string
+	switch severity {
+	case "DETAIL":
+		dst = &a.pending.ErrDetail
+	case "HINT":
+		dst = &a.pending.ErrHint
+	case "STATEMENT":
+		dst = &a.pending.UserQuery
+	case "CONTEXT":
+		dst = &a.pending.ErrContext
+	case "QUERY":
+		dst = &a.pending.InternalQuery
+	default:
+		return false
+	}
+
+	a.storeTail()
+	*dst = lr.ErrMessage
+	a.setTail(dst)
+
+	// Postgres numbers every line of a session, these too.
+	if lr.SeqNum != 0 {
+		a.pending.lastSeqNum = lr.SeqNum
+	}
+
+	return true
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrefixLineParser(t *testing.T) {
+	p, err := newPrefixLineParser("%m [%p] %q%u@%d ", "")
+	if err != nil {
+		t.Fatalf("could not compile prefix: %v", err)
+	}
+
+	text := "2014-05-01 10:00:00.123 UTC [4242] alice@app ERROR:  relation \"nope\" does not exist at character 15\n" +
+		"2014-05-01 10:00:00.123 UTC [4242] alice@app STATEMENT:  SELECT *\n" +
+		"\t  FROM nope;\n" +
+		"2014-05-01 10:00:01.000 UTC [4100] LOG:  checkpoint starting: time\n"
+
+	got := assemble(t, &lineAssembler{p: p}, text)
+
+	// The last record is only emitted once the assembler is told
+	// nothing else is coming.
+	if len(got) != 1 {
+		t.Fatalf("expected one record before idling, got %d", len(got))
+	}
+
+	lr := got[0]
+	if lr.Pid != 4242 || lr.ELevel != elevelError ||
+		*lr.UserName != "alice" || *lr.DatabaseName != "app" ||
+		lr.LogTime != "2014-05-01 10:00:00.123 UTC" {
+		t.Errorf("prefix fields not parsed: %s", lr.oneLine())
+	}
+
+	// Continuation lines belong with the line before them.
+	if lr.UserQuery == nil || *lr.UserQuery != "SELECT *\n\t  FROM nope;" {
+		t.Errorf("STATEMENT line not folded into record: %s",
+			lr.oneLine())
+	}
+}
+
+func TestPrefixLineParserNonSession(t *testing.T) {
+	p, err := newPrefixLineParser("%m [%p] %q%u@%d ", "")
+	if err != nil {
+		t.Fatalf("could not compile prefix: %v", err)
+	}
+
+	asm := &lineAssembler{p: p}
+	got := assemble(t, asm,
+		"2014-05-01 10:00:01.000 UTC [4100] LOG:  checkpoint starting: time\n")
+
+	asm.idle(func(lr *logRecord) { got = append(got, *lr) })
+	asm.idle(func(lr *logRecord) { got = append(got, *lr) })
+
+	if len(got) != 1 {
+		t.Fatalf("expected one record after idling, got %d", len(got))
+	}
+
+	if got[0].Pid != 4100 || got[0].UserName != nil ||
+		*got[0].ErrMessage != "checkpoint starting: time" {
+		t.Errorf("unexpected record: %s", got[0].oneLine())
+	}
+}
+
+func TestRegexLineParser(t *testing.T) {
+	// pgbouncer's log format.
+	p, err := newLineParser(`^(?P<timestamp>\S+ \S+ \S+) \[(?P<pid>\d+)\] `+
+		`(?P<severity>\w+) (?P<message>.*)$`, continueIndent)
+	if err != nil {
+		t.Fatalf("could not compile regex: %v", err)
+	}
+
+	got := assemble(t, &lineAssembler{p: p},
+		"2014-05-01 10:00:00.123 UTC [99] LOG stats: 0 xacts/s\n"+
+			"stray line\n")
+
+	if len(got) != 2 {
+		t.Fatalf("expected two records, got %d", len(got))
+	}
+
+	if got[0].Pid != 99 || got[0].ELevel != elevelLog {
+		t.Errorf("fields not parsed: %s", got[0].oneLine())
+	}
+
+	if *got[1].ErrMessage != "stray line" {
+		t.Errorf("unexpected bare record: %s", got[1].oneLine())
+	}
+}
+
+func TestLineAssemblerLimit(t *testing.T) {
+	p, err := newPrefixLineParser("%m [%p] ", "")
+	if err != nil {
+		t.Fatalf("could not compile prefix: %v", err)
+	}
+
+	a := &lineAssembler{p: p}
+	var got []logRecord
+	emit := func(lr *logRecord) { got = append(got, *lr) }
+
+	first := "2014-05-01 10:00:00.123 UTC [4242] LOG:  stuck\n"
+	if err := a.addLine([]byte(first), emit); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines with no prefix continue the record until it is too
+	// long, when the whole of it is given up on.
+	junk := []byte(strings.Repeat("x", 1023) + "\n")
+	var m *malformedRecord
+	for i := 0; m == nil; i++ {
+		if i > maxAssembledRecord/len(junk)+1 {
+			t.Fatal("expected the record to be given up on")
+		}
+
+		if err := a.addLine(junk, emit); err != nil {
+			m = err.(*malformedRecord)
+		}
+	}
+
+	if !strings.HasPrefix(string(m.data), first) ||
+		len(m.data) <= maxAssembledRecord || a.held() != 0 {
+		t.Fatalf("unexpected malformed record of %d bytes",
+			len(m.data))
+	}
+
+	// Lines are skipped until a record begins.
+	if err := a.addLine(junk, emit); err == nil {
+		t.Fatal("expected a line to be skipped")
+	}
+
+	text := "2014-05-01 10:00:01.000 UTC [4242] LOG:  unstuck\n" +
+		"  more\n" +
+		"2014-05-01 10:00:01.000 UTC [4242] DETAIL:  one\n" +
+		"2014-05-01 10:00:01.000 UTC [4242] DETAIL:  two\n" +
+		"  three\n"
+	got = assemble(t, a, text)
+	a.flush(emit)
+
+	if len(got) != 1 {
+		t.Fatalf("expected one record, got %d", len(got))
+	}
+
+	if *got[0].ErrMessage != "unstuck\n  more" ||
+		*got[0].ErrDetail != "two\n  three" {
+		t.Fatalf("unexpected record %s", got[0].oneLine())
+	}
+}
+
+func TestLineParserValidation(t *testing.T) {
+	for _, bad := range []struct{ regex, prefix, continuation string }{
+		{regex: `(?P<timestamp>\S+)`},
+		{regex: `(?P<message>.*`},
+		{regex: `(?P<mesage>.*)`},
+		{regex: `(?P<message>.*)`, continuation: "sometimes"},
+		{prefix: "%m %y "},
+		{prefix: "%m %"},
+	} {
+		var err error
+		if bad.prefix != "" {
+			_, err = newPrefixLineParser(bad.prefix, bad.continuation)
+		} else {
+			_, err = newLineParser(bad.regex, bad.continuation)
+		}
+
+		if err == nil {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Events for lock waits and deadlocks, from what Postgres logs about
+// them.  With log_lock_waits, a process that waits on a lock for
+// longer than deadlock_timeout logs:
+//
+//     process 123 still waiting for ShareLock on transaction 456 after 1000.123 ms
+//     DETAIL:  Processes holding the lock: 789, 790. Wait queue: 123.
+//     CONTEXT:  while updating tuple (0,1) in relation "t"
+//
+// and once it gets the lock, "process 123 acquired ShareLock on
+// transaction 456 after 2000.456 ms".  A deadlock, which has SQLSTATE
+// 40P01, is logged as:
+//
+//     deadlock detected
+//     DETAIL:  Process 123 waits for ShareLock on transaction 456; blocked by process 789.
+//              Process 789 waits for ShareLock on transaction 455; blocked by process 123.
+//              Process 123: UPDATE t SET v = 1 WHERE id = 1;
+//              Process 789: UPDATE t SET v = 2 WHERE id = 2;
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	lockWaitMessage = regexp.MustCompile(`^process (\d+) ` +
+		`(still waiting for|acquired) (\S+) on (.+?) after ([\d.]+) ms`)
+	lockHolders = regexp.MustCompile(`Process(?:es)? holding the lock: ` +
+		`([\d, ]+)\. Wait queue: ([\d, ]*)\.`)
+	deadlockWait = regexp.MustCompile(`^Process (\d+) waits for (\S+) ` +
+		`on (.+?); blocked by process (\d+)\.$`)
+	deadlockQuery = regexp.MustCompile(`^Process (\d+): (.*)$`)
+	lockRelation  = regexp.MustCompile(`relation "([^"]+)"`)
+)
+
+// Parse a comma-separated list of process ids.
+func parsePids(s string) []int32 {
+	var pids []int32
+	for _, part := range strings.Split(s, ",") {
+		if pid, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			pids = append(pids, int32(pid))
+		}
+	}
+
+	return pids
+}
+
+func atoi32(s string) int32 {
+	n, _ := strconv.Atoi(s)
+	return int32(n)
+}
+
+// The relation a lock is on, when the context names it.
+func lockedRelation(lr *logRecord) string {
+	if lr.ErrContext != nil {
+		if m := lockRelation.FindStringSubmatch(*lr.ErrContext); m != nil {
+			return m[1]
+		}
+	}
+
+	return ""
+}
+
+// Make an event of a record about a lock wait or deadlock, with the
+// metrics to count it by, or return nil if it is about neither.
+func lockEventOf(lr *logRecord) (*event, []metric) {
+	if lr.ErrMessage == nil {
+		return nil, nil
+	}
+
+	if m := lockWaitMessage.FindStringSubmatch(*lr.ErrMessage); m != nil {
+		return lockWaitEvent(lr, m)
+	}
+
+	if (lr.SQLState != nil && *lr.SQLState == "40P01") ||
+		*lr.ErrMessage == "deadlock detected" {
+		return deadlockEvent(lr)
+	}
+
+	return nil, nil
+}
+
+func lockWaitEvent(lr *logRecord, m []string) (*event, []metric) {
+	name, counter := "lock_wait", "waits"
+	if m[2] == "acquired" {
+		name, counter = "lock_acquired", "acquired_after_wait"
+	}
+
+	waitMs, _ := strconv.ParseFloat(m[5], 64)
+
+	e := newEvent(name).
+		add("pid", atoi32(m[1])).
+		add("lock_type", m[3]).
+		add("object", m[4]).
+		add("relation", lockedRelation(lr)).
+		add("wait_ms", waitMs)
+
+	if lr.ErrDetail != nil {
+		if h := lockHolders.FindStringSubmatch(*lr.ErrDetail); h != nil {
+			e.add("blocking_pids", parsePids(h[1]))
+			e.add("wait_queue", parsePids(h[2]))
+		}
+	}
+
+	if lr.UserQuery != nil {
+		e.add("query", *lr.UserQuery)
+	}
+
+	return e, []metric{
+		{kind: "count", name: "postgres.locks." + counter, value: 1},
+		{kind: "measure", name: "postgres.locks.wait_time",
+			value: waitMs, unit: "ms"},
+	}
+}
+
+func deadlockEvent(lr *logRecord) (*event, []metric) {
+	var pids []int32
+	byPid := make(map[int32]*event)
+	queries := make(map[int32]string)
+
+	process := func(pid int32) *event {
+		p, ok := byPid[pid]
+		if !ok {
+			p = newEvent("").add("pid", pid)
+			byPid[pid] = p
+			pids = append(pids, pid)
+		}
+
+		return p
+	}
+
+	if lr.ErrDetail != nil {
+		// Queries may run over several lines, which belong to
+		// the process of the last "Process n:" line.
+		queryPid := int32(-1)
+		for _, line := range strings.Split(*lr.ErrDetail, "\n") {
+			if m := deadlockWait.FindStringSubmatch(line); m != nil {
+				process(atoi32(m[1])).
+					add("lock_type", m[2]).
+					add("object", m[3]).
+					add("blocking_pids", []int32{atoi32(m[4])})
+				queryPid = -1
+			} else if m := deadlockQuery.FindStringSubmatch(line); m != nil {
+				queryPid = atoi32(m[1])
+				process(queryPid)
+				queries[queryPid] = m[2]
+			} else if queryPid >= 0 {
+				queries[queryPid] += "\n" + line
+			}
+		}
+	}
+
+	processes := make([]*event, len(pids))
+	for i, pid := range pids {
+		processes[i] = byPid[pid].add("query", queries[pid])
+	}
+
+	e := newEvent("deadlock").
+		add("pid", lr.Pid).
+		add("relation", lockedRelation(lr)).
+		add("pids", pids).
+		add("processes", processes)
+
+	return e, []metric{
+		{kind: "count", name: "postgres.locks.deadlocks", value: 1},
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLockWaitEvent(t *testing.T) {
+	msg := "process 123 still waiting for ShareLock on transaction 456 " +
+		"after 1000.123 ms"
+	detail := "Processes holding the lock: 789, 790. Wait queue: 123."
+	context := "while updating tuple (0,1) in relation \"t\""
+	query := "UPDATE t SET v = 1 WHERE id = 1"
+
+	lr := sampleRecord
+	lr.ErrMessage = &msg
+	lr.ErrDetail = &detail
+	lr.ErrContext = &context
+	lr.UserQuery = &query
+
+	e, ms := lockEventOf(&lr)
+	if e == nil || e.name != "lock_wait" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	sr := &serveRecord{sKey: sKey{I: "ident"}, Name: "cluster1"}
+	got := string(e.format(sr))
+	want := "event=lock_wait identity=ident name=cluster1 pid=123 " +
+		"lock_type=ShareLock object=\"transaction 456\" relation=t " +
+		"wait_ms=1000.123 blocking_pids=789,790 wait_queue=123 " +
+		"query=\"UPDATE t SET v = 1 WHERE id = 1\""
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if string(formatMetrics(sr, ms)) != "source=cluster1 "+
+		"count#postgres.locks.waits=1 "+
+		"measure#postgres.locks.wait_time=1000.123ms" {
+		t.Errorf("unexpected metrics %s", formatMetrics(sr, ms))
+	}
+
+	msg = "process 123 acquired ShareLock on transaction 456 " +
+		"after 2000.5 ms"
+	if e, _ := lockEventOf(&lr); e == nil || e.name != "lock_acquired" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	msg = "duration: 1.000 ms  statement: SELECT 1"
+	if e, _ := lockEventOf(&lr); e != nil {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestDeadlockEvent(t *testing.T) {
+	msg := "deadlock detected"
+	state := "40P01"
+	detail := "Process 123 waits for ShareLock on transaction 456; " +
+		"blocked by process 789.\n" +
+		"Process 789 waits for ShareLock on transaction 455; " +
+		"blocked by process 123.\n" +
+		"Process 123: UPDATE t SET v = 1 WHERE id = 1;\n" +
+		"Process 789: UPDATE t\n  SET v = 2 WHERE id = 2;"
+
+	lr := sampleRecord
+	lr.Pid = 123
+	lr.ErrMessage = &msg
+	lr.SQLState = &state
+	lr.ErrDetail = &detail
+
+	e, _ := lockEventOf(&lr)
+	if e == nil || e.name != "deadlock" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	sr := &serveRecord{sKey: sKey{I: "ident"}, format: formatJSON}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(e.format(sr), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"event":    "deadlock",
+		"identity": "ident",
+		"pid":      123.0,
+		"pids":     []interface{}{123.0, 789.0},
+		"processes": []interface{}{
+			map[string]interface{}{
+				"pid":           123.0,
+				"lock_type":     "ShareLock",
+				"object":        "transaction 456",
+				"blocking_pids": []interface{}{789.0},
+				"query":         "UPDATE t SET v = 1 WHERE id = 1;",
+			},
+			map[string]interface{}{
+				"pid":           789.0,
+				"lock_type":     "ShareLock",
+				"object":        "transaction 455",
+				"blocking_pids": []interface{}{123.0},
+				"query":         "UPDATE t\n  SET v = 2 WHERE id = 2;",
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseDestination(t *testing.T) {
+	audit := mustParseURL("https://audit.example.com/logs")
+
+	for _, tc := range []struct {
+		dest  string
+		audit bool
+		ok    bool
+	}{
+		{"primary", false, true},
+		{"audit", true, true},
+		{"audit", false, false},
+		{"https://events.example.com/logs", false, true},
+		{"events", false, false},
+	} {
+		a := &audit
+		if !tc.audit {
+			a = nil
+		}
+
+		err := parseDestination("lock_events", tc.dest, a)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseDestination(%q) with audit %v: %v",
+				tc.dest, tc.audit, err)
+		}
+	}
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -29,30 +27,42 @@ import (
 // goroutine after logging the cause of the exit.
 type exitFn func(args ...interface{})
 
+// Run f with an exitFn that abandons only f, rather than a whole
+// goroutine, returning the reason given to exit, or the empty string
+// if f completes normally.
+func catchExit(f func(exit exitFn)) (reason string) {
+	var skip exitFn
+	skip = func(args ...interface{}) {
+		if len(args) == 0 {
+			reason = "exit without a reason"
+		} else if s, ok := args[0].(string); ok && len(args) > 1 {
+			reason = fmt.Sprintf(s, args[1:]...)
+		} else {
+			reason = fmt.Sprint(args...)
+		}
+
+		panic(&skip)
+	}
+
+	// &skip is used as a sentinel value, as with exit in
+	// logWorker.
+	defer func() {
+		if r := recover(); r != nil && r != &skip {
+			panic(r)
+		}
+	}()
+
+	f(skip)
+	return ""
+}
+
 // Fills a message on behalf of the caller.  Often the closure will
 // close over a core.MessageStream to provide a source of data for the
 // filled message.
 type msgInit func(dst *core.Message, exit exitFn)
 
 func logWorker(die dieCh, l net.Listener, cfg logplexc.Config, sr *serveRecord) {
-	// Make world-writable so anything can connect and send logs.
-	// This may be be worth locking down more, but as-is unless
-	// pg_logplexcollector and the Postgres server share the same
-	// running user common umasks will be useless.
-	fi, err := os.Stat(sr.P)
-	if err != nil {
-		log.Fatalf(
-			"exiting, cannot stat just created socket %q: %v",
-			sr.P, err)
-	}
-
-	err = os.Chmod(sr.P, fi.Mode().Perm()|0222)
-	if err != nil {
-		log.Fatalf(
-			"exiting, cannot make just created socket "+
-				"world-writable %q: %v",
-			sr.P, err)
-	}
+	makeWorldWritable(sr.P)
 
 	for {
 		select {
@@ -116,7 +126,7 @@ func logWorker(die dieCh, l net.Listener, cfg logplexc.Config, sr *serveRecord)
 			}
 
 			// Protocol start-up; packets that are only received once.
-			processVerMsg(msgInit, exit)
+			version := processVerMsg(msgInit, exit)
 			ident := processIdentMsg(msgInit, exit)
 			log.Printf("client connects with identifier %q", ident)
 
@@ -126,43 +136,39 @@ func logWorker(die dieCh, l net.Listener, cfg logplexc.Config, sr *serveRecord)
 					"path %s, expected %s, got %s", sr.P, sr.I, ident)
 			}
 
-			// Set up client with serve
-			client := func(cfg logplexc.Config, url *url.URL) *logplexc.Client {
-				cfg.Logplex = *url
-				client, err := logplexc.NewClient(&cfg)
-				if err != nil {
-					exit(err)
-				}
-
-				return client
-			}
-
-			primary := client(cfg, &sr.u)
-
-			var audit *logplexc.Client
+			sr.stats().setPgVersion(version)
 
-			if sr.audit != nil {
-				audit = client(cfg, sr.audit)
+			// Set up clients with serve
+			clients, err := acquireServeClients(sr, cfg)
+			if err != nil {
+				exit(err)
 			}
+			defer clients.release()
 
-			defer func() {
-				primary.Close()
-
-				if audit != nil {
-					audit.Close()
-				}
-			}()
-
-			processLogMsg(die, primary, audit, msgInit, sr, exit)
+			processLogMsg(die, clients, msgInit, sr, exit)
 		}()
 	}
 }
 
 // Process a log message, sending it to the client.
-func processLogMsg(die dieCh, primary *logplexc.Client, audit *logplexc.Client,
-	msgInit msgInit, sr *serveRecord, exit exitFn) {
+func processLogMsg(die dieCh, clients *serveClients, msgInit msgInit,
+	sr *serveRecord, exit exitFn) {
 	var m core.Message
 
+	d := getLogRecordDecoder()
+	defer putLogRecordDecoder(d)
+
+	seq := newSeqTracker()
+
+	sessions := trackSessions(clients, sr)
+	if sessions != nil {
+		defer sessions.flush("connection_closed")
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go sessionExpiryWorker(stop, sessions)
+	}
+
 	for {
 		// Poll request to exit
 		select {
@@ -175,32 +181,96 @@ func processLogMsg(die dieCh, primary *logplexc.Client, audit *logplexc.Client,
 		msgInit(&m, exit)
 
 		// Refuse to handle any log message above an arbitrary
-		// size.  Furthermore, exit the worker, closing the0
+		// size.  Furthermore, exit the worker, closing the
 		// connection, so that the client doesn't even bother
 		// to wait for this process to drain the oversized
 		// item and anything following it; these will be
 		// dropped.  It's on the client to gracefully handle
 		// the error and re-connect after this happens.
-		if m.Size() > 1*MB {
-			exit("client %q sent oversized log record")
+		//
+		// Tolerant serves instead take the time to read the
+		// record, and truncate it.
+		oversized := m.Size() > 1*MB
+		if oversized && !sr.tolerant {
+			exit("client %q sent oversized log record", sr.I)
 		}
 
-		payload, err := m.Force()
+		payload, err := d.payload(&m)
 		if err != nil {
 			exit("could not retrieve payload of message: %v",
 				err)
 		}
 
-		var lr logRecord
-		parseLogRecord(&lr, payload, exit)
-		routeLogRecord(&lr, primary, audit, sr, exit)
+		lr, err := d.decode(payload)
+		if err != nil {
+			if !sr.tolerant {
+				exit(err)
+			}
+
+			quarantineRecord(sr, err.Error(), payload)
+			sr.stats().incr("skipped")
+			continue
+		}
+
+		// Transcode first, so that truncation cuts UTF-8 between
+		// characters.
+		checkEncoding(lr, sr)
+
+		if oversized {
+			quarantineRecord(sr, fmt.Sprintf(
+				"oversized log record of %d bytes", m.Size()),
+				payload)
+			truncateLogRecord(lr, maxTolerantField)
+			sr.stats().incr("truncated")
+		}
+
+		checkSeq(seq, lr, clients, sr, exit)
+		if sessions != nil {
+			sessions.observe(lr, time.Now())
+		}
+
+		routeLogRecord(lr, clients, sr, exit)
 	}
 }
 
 // Process a single logRecord value, buffering it in the logplex
 // client.
-func routeLogRecord(lr *logRecord, primary *logplexc.Client,
-	audit *logplexc.Client, sr *serveRecord, exit exitFn) {
+func routeLogRecord(lr *logRecord, clients *serveClients, sr *serveRecord,
+	exit exitFn) {
+	primary, audit := clients.primary, clients.audit
+
+	if sr.redactor != nil && sr.redactor.redactRecord(lr) {
+		sr.stats().incr("redacted")
+	}
+
+	if sr.statementStats {
+		sr.statements().observe(lr)
+	}
+
+	// pgaudit records go to the audit target *only*, as JSON.
+	if audit != nil {
+		if a := parsePgaudit(lr); a != nil {
+			if sr.redactor != nil {
+				sr.redactor.redactPgaudit(a)
+			}
+
+			now := time.Now()
+			sr.stats().incr("pgaudit")
+			emitMetrics(sr, primary, now, []metric{{kind: "count",
+				name:  "postgres.pgaudit." + strings.ToLower(a.class),
+				value: 1}})
+			emitPgaudit(lr, sr, audit, now, a)
+			return
+		}
+	}
+
+	// Connection events, when asked for, replace the text records
+	// about connections that would go to the audit target.
+	connEvent := false
+	if sr.connectionEvents != "" {
+		connEvent = emitConnectionEvent(lr, clients, sr)
+	}
+
 	var targets []*logplexc.Client
 	hasAudit := false
 
@@ -213,7 +283,9 @@ func routeLogRecord(lr *logRecord, primary *logplexc.Client,
 		case strings.HasPrefix(*lr.ErrMessage, "connection authorized: "):
 			fallthrough
 		case strings.HasPrefix(*lr.ErrMessage, "replication connection authorized: "):
-			targets = []*logplexc.Client{audit}
+			if !connEvent {
+				targets = []*logplexc.Client{audit}
+			}
 			hasAudit = true
 		default:
 			targets = []*logplexc.Client{primary}
@@ -224,74 +296,153 @@ func routeLogRecord(lr *logRecord, primary *logplexc.Client,
 
 	// For interesting SQLState errors, *also* send them to the
 	// audit endpoint.
-	if audit != nil && lr.SQLState != nil {
-		switch {
-		case strings.HasPrefix(*lr.SQLState, "58"):
-			fallthrough
-		case strings.HasPrefix(*lr.SQLState, "F0"):
-			fallthrough
-		case strings.HasPrefix(*lr.SQLState, "XX"):
-			if !hasAudit {
-				targets = append(targets, audit)
-				hasAudit = true
+	if audit != nil && lr.SQLState != nil &&
+		sqlstateMatches(*lr.SQLState, sr.auditSQLStates) {
+		if !hasAudit {
+			targets = append(targets, audit)
+			hasAudit = true
+		}
+	}
+
+	// Measurements found in the record are sent as metrics, and
+	// as fields of their own in JSON.
+	var extra map[string]interface{}
+	if ex := extractRecord(lr); ex != nil {
+		var table []string
+		if ex.table != "" {
+			table = []string{"table", ex.table}
+		}
+
+		emitMetrics(sr, primary, time.Now(), ex.metrics(), table...)
+		extra = map[string]interface{}{ex.kind: ex.fields()}
+	}
+
+	if e, metrics := lockEventOf(lr); e != nil {
+		now := time.Now()
+		sr.stats().incr(e.name)
+		emitMetrics(sr, primary, now, metrics)
+		emitEvent(sr, clients.resolve(sr.lockEvents), now, e)
+	}
+
+	if e := lifecycleEventOf(lr); e != nil {
+		emitLifecycleEvent(e, clients, sr)
+	}
+
+	if sr.ddlEvents != "" {
+		if events, metrics := ddlEventsOf(lr); len(events) > 0 {
+			now := time.Now()
+			target := clients.resolve(sr.ddlEvents)
+			sr.stats().add("ddl", uint64(len(events)))
+			emitMetrics(sr, primary, now, metrics)
+			for _, e := range events {
+				emitEvent(sr, target, now, e)
 			}
 		}
 	}
 
 	for _, tgt := range targets {
-		emitLogRecord(lr, sr, tgt, tgt == audit, exit)
+		emitLogRecord(lr, sr, tgt, tgt == audit, extra, exit)
 	}
 }
 
-func emitLogRecord(lr *logRecord, sr *serveRecord, target *logplexc.Client,
-	isAudit bool, exit exitFn) {
-	// Buffer to format the complete log message in.
-	msgFmtBuf := bytes.Buffer{}
-
-	// Helps with formatting a series of nullable strings.
-	catOptionalField := func(prefix string, maybePresent *string) {
-		if maybePresent != nil {
-			if prefix != "" {
-				msgFmtBuf.WriteString(prefix)
-				msgFmtBuf.WriteString(": ")
-			}
+// Send an event about the connection a record is about, if it is
+// about one, returning whether it was.
+func emitConnectionEvent(lr *logRecord, clients *serveClients,
+	sr *serveRecord) bool {
+	e, metrics := connectionEventOf(lr)
+	if e == nil {
+		return false
+	}
 
-			msgFmtBuf.WriteString(*maybePresent)
-			msgFmtBuf.WriteByte('\n')
-		}
+	now := time.Now()
+	target := clients.resolve(sr.connectionEvents)
+
+	sr.stats().incr(e.name)
+	emitMetrics(sr, clients.primary, now, metrics)
+	emitEvent(sr, target, now, e)
+
+	if e.name != authFailureEvent || sr.authFailureThreshold == 0 {
+		return true
 	}
 
-	if sr.Name != "" {
-		// If available, identify what agent is doing the
-		// logging to aid human readers in determining where a
-		// log message came from.
-		msgFmtBuf.WriteString("[" + sr.Name + "] ")
+	addr, _ := e.value("client_addr").(string)
+	user, _ := e.value("user").(string)
+	if alert := sr.authFailures().observe(addr, user, now,
+		sr.authFailureThreshold, sr.authFailureWindow); alert != nil {
+		sr.stats().incr(alert.name)
+		emitMetrics(sr, clients.primary, now, []metric{{kind: "count",
+			name: "postgres.connections.brute_force_alerts", value: 1}})
+		emitEvent(sr, target, now, alert)
 	}
 
-	if isAudit {
-		// The audit endpoint may be multiplexed, so add the
-		// identity to help tell log records apart.
-		msgFmtBuf.WriteString("instance_type=shogun identity=" +
-			sr.I + " ")
+	return true
+}
+
+// Record the state a lifecycle event leaves the server in, and send
+// the event to the destination the serve gives for them, or else to
+// the audit target, or the primary one if there is none.
+func emitLifecycleEvent(e *event, clients *serveClients, sr *serveRecord) {
+	now := time.Now()
+	state, _ := e.value("state").(string)
+	transition, _ := e.value("transition").(string)
+
+	previous := sr.stats().setLifecycle(state, transition, now)
+	if state == "" {
+		state = previous
+		e.add("state", state)
 	}
 
-	catOptionalField("", lr.ErrMessage)
-	catOptionalField("Detail", lr.ErrDetail)
-	catOptionalField("Hint", lr.ErrHint)
-	catOptionalField("Query", lr.UserQuery)
+	if version, ok := e.value("version").(string); ok {
+		sr.stats().setPgVersion(strings.TrimPrefix(version,
+			"PostgreSQL "))
+	}
 
-	err := target.BufferMessage(134, time.Now(),
-		"postgres",
-		"postgres."+strconv.Itoa(int(lr.Pid)),
-		msgFmtBuf.Bytes())
-	if err != nil {
-		exit(err)
+	e.add("previous_state", previous)
+
+	sr.stats().incr("lifecycle")
+	emitMetrics(sr, clients.primary, now,
+		lifecycleMetrics(state, transition), "state", state)
+	target := clients.audit
+	if sr.lifecycleEvents != "" {
+		target = clients.resolve(sr.lifecycleEvents)
+	} else if target == nil {
+		target = clients.primary
+	}
+
+	emitEvent(sr, target, now, e)
+}
+
+func emitLogRecord(lr *logRecord, sr *serveRecord, target *logplexc.Client,
+	isAudit bool, extra map[string]interface{}, exit exitFn) {
+	// Text records begin with a head saying where they come from,
+	// which every frame of a split record repeats.
+	var head string
+	var msg []byte
+	switch {
+	case sr.format == formatJSON:
+		msg = formatJSONRecord(lr, sr, isAudit, extra)
+	case sr.template != nil:
+		head, msg = formatTemplateParts(lr, sr, isAudit)
+	default:
+		head, msg = textRecordHead(sr, isAudit), formatTextMessage(lr)
+	}
+
+	app := sr.appName()
+
+	for _, frame := range frameRecord(sr, head, msg) {
+		err := target.BufferMessage(134, time.Now(),
+			app,
+			app+"."+strconv.Itoa(int(lr.Pid)),
+			frame)
+		if err != nil {
+			exit(err)
+		}
 	}
 }
 
 // Read the version message, calling exit if this is not a supported
-// version.
-func processVerMsg(msgInit msgInit, exit exitFn) {
+// version, and returning the version of Postgres it gives.
+func processVerMsg(msgInit msgInit, exit exitFn) string {
 	var m core.Message
 
 	msgInit(&m, exit)
@@ -320,6 +471,8 @@ func processVerMsg(msgInit msgInit, exit exitFn) {
 		!strings.HasSuffix(s, "/logfebe-1") {
 		exit("protocol version not supported: %s", s)
 	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(s, "PG-"), "/logfebe-1")
 }
 
 // Process the identity ('I') message, reporting the identity therein.
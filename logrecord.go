@@ -3,10 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"sync"
+	"unicode/utf8"
 
-	"github.com/deafbybeheading/femebe/buf"
+	"github.com/deafbybeheading/femebe/core"
 )
 
 type logRecord struct {
@@ -33,6 +37,85 @@ type logRecord struct {
 	UserQueryPos     int32
 	FileErrPos       *string
 	ApplicationName  *string
+
+	// The number of the last line of a record assembled from
+	// several lines of a log file, each numbered in turn, or 0.
+	// See lineparser.go and seqgap.go.
+	lastSeqNum int64
+}
+
+// Postgres's numbering of error levels, as used by the 9.x releases
+// pg_logfebe supports.
+const (
+	elevelDebug5  int32 = 10
+	elevelDebug1  int32 = 14
+	elevelLog     int32 = 15
+	elevelInfo    int32 = 17
+	elevelNotice  int32 = 18
+	elevelWarning int32 = 19
+	elevelError   int32 = 20
+	elevelFatal   int32 = 21
+	elevelPanic   int32 = 22
+)
+
+// Translate a severity as Postgres writes it in its own logs into an
+// error level, or zero if it is not recognized.
+func elevelOf(severity string) int32 {
+	switch severity {
+	case "DEBUG", "DEBUG1":
+		return elevelDebug1
+	case "DEBUG2":
+		return elevelDebug1 - 1
+	case "DEBUG3":
+		return elevelDebug1 - 2
+	case "DEBUG4":
+		return elevelDebug1 - 3
+	case "DEBUG5":
+		return elevelDebug5
+	case "LOG":
+		return elevelLog
+	case "INFO":
+		return elevelInfo
+	case "NOTICE":
+		return elevelNotice
+	case "WARNING":
+		return elevelWarning
+	case "ERROR":
+		return elevelError
+	case "FATAL":
+		return elevelFatal
+	case "PANIC":
+		return elevelPanic
+	}
+
+	return 0
+}
+
+// The severity Postgres writes for an error level, or the empty string
+// if it is not one.
+func elevelName(elevel int32) string {
+	switch {
+	case elevel == elevelDebug1:
+		return "DEBUG1"
+	case elevel >= elevelDebug5 && elevel < elevelDebug1:
+		return "DEBUG" + strconv.Itoa(int(elevelDebug1-elevel+1))
+	case elevel == elevelLog:
+		return "LOG"
+	case elevel == elevelInfo:
+		return "INFO"
+	case elevel == elevelNotice:
+		return "NOTICE"
+	case elevel == elevelWarning:
+		return "WARNING"
+	case elevel == elevelError:
+		return "ERROR"
+	case elevel == elevelFatal:
+		return "FATAL"
+	case elevel == elevelPanic:
+		return "PANIC"
+	}
+
+	return ""
 }
 
 func (lr *logRecord) oneLine() []byte {
@@ -113,135 +196,287 @@ func (lr *logRecord) oneLine() []byte {
 	return buf.Bytes()
 }
 
-func readInt64(r io.Reader) (ret int64, err error) {
-	var be [8]byte
+// The longest any one field may be after truncateLogRecord, which
+// keeps a record with all its fields filled near the size limit
+// otherwise imposed on records.
+const maxTolerantField = 64 * KB
+
+// Shorten every text field of the record that exceeds limit bytes,
+// marking where text was removed.  Fields are cut before any UTF-8
+// sequence that would be split.
+func truncateLogRecord(lr *logRecord, limit int) {
+	const marker = "...(truncated)"
+
+	for _, f := range []**string{&lr.UserName, &lr.DatabaseName,
+		&lr.ClientAddr, &lr.PsDisplay, &lr.Vxid, &lr.SQLState,
+		&lr.ErrMessage, &lr.ErrDetail, &lr.ErrHint,
+		&lr.InternalQuery, &lr.ErrContext, &lr.UserQuery,
+		&lr.FileErrPos, &lr.ApplicationName} {
+		if *f != nil && len(**f) > limit {
+			cut := limit
+			for cut > 0 && !utf8.RuneStart((**f)[cut]) {
+				cut--
+			}
 
-	valBytes := be[0:8]
-	if _, err = io.ReadFull(r, valBytes); err != nil {
-		return 0, err
+			s := (**f)[:cut] + marker
+			*f = &s
+		}
 	}
+}
 
-	return int64(binary.BigEndian.Uint64(valBytes)), nil
+// Decodes the log records pg_logfebe sends while allocating as little
+// as possible, as busy servers send tens of thousands a second.
+//
+// Text fields that tend to repeat from record to record, like user
+// and database names, are interned; the rest are cut out of one string
+// made per record.  The record returned by decode, and the nullable
+// fields it points to, belong to the decoder and are overwritten by
+// the next call, though the strings themselves may be kept.
+type logRecordDecoder struct {
+	lr logRecord
+
+	// Backing for the nullable fields of lr.
+	nullable [numNullableFields]string
+	nNull    int
+
+	// Payloads of messages that were not entirely buffered by
+	// their stream are read into this.
+	buf []byte
+
+	// Canonical copies of repeating values.
+	interned map[string]string
+
+	// The message being decoded, and the position in it.
+	data []byte
+	text string
+	pos  int
 }
 
-func readUint64(r io.Reader) (ret uint64, err error) {
-	var be [8]byte
+const (
+	numNullableFields = 14
 
-	valBytes := be[0:8]
-	if _, err = io.ReadFull(r, valBytes); err != nil {
-		return 0, err
-	}
+	// Limits on what is interned, to bound memory: values of
+	// fields that are usually short, but need not be, are only
+	// interned if they are shorter than maxInternedLen, and the
+	// table is emptied once it holds maxInterned values.
+	maxInternedLen = 64
+	maxInterned    = 4096
+
+	// Decoders are not kept in the pool with buffers grown past
+	// this, lest one oversized record pin a lot of memory.
+	maxPooledBuf = 1 * MB
+)
+
+var errShortLogRecord = errors.New("LogRecord message is truncated")
 
-	return binary.BigEndian.Uint64(valBytes), nil
+var logRecordDecoderPool = sync.Pool{
+	New: func() interface{} {
+		return &logRecordDecoder{interned: make(map[string]string)}
+	},
 }
 
-func parseLogRecord(
-	dst *logRecord, data []byte, exit exitFn) {
+func getLogRecordDecoder() *logRecordDecoder {
+	return logRecordDecoderPool.Get().(*logRecordDecoder)
+}
 
-	b := bytes.NewBuffer(data)
+func putLogRecordDecoder(d *logRecordDecoder) {
+	if cap(d.buf) > maxPooledBuf {
+		d.buf = nil
+	}
 
-	// Read the next nullable string from b, returning a 'nil'
-	// *string should it be null.
-	nextNullableString := func() *string {
-		np, err := buf.ReadByte(b)
-		if err != nil {
-			exit(err)
-		}
+	// Don't pin the last record's text.
+	d.lr = logRecord{}
+	d.nullable = [numNullableFields]string{}
+	d.data = nil
+	d.text = ""
 
-		switch np {
-		case 'P':
-			s, err := buf.ReadCString(b)
-			if err != nil {
-				exit(err)
-			}
+	logRecordDecoderPool.Put(d)
+}
 
-			return &s
+// Get the payload of m.  Messages wholly buffered by their stream are
+// used in place, and others are read into storage that is reused.
+// Either way, the payload is only good until the next message is
+// read.
+func (d *logRecordDecoder) payload(m *core.Message) ([]byte, error) {
+	if m.IsBuffered() {
+		return m.Force()
+	}
 
-		case 'N':
-			// 'N' is still followed by a NUL byte that
-			// must be consumed.
-			_, err := buf.ReadCString(b)
-			if err != nil {
-				exit(err)
-			}
+	n := int(m.Size() - 4)
+	if cap(d.buf) < n {
+		d.buf = make([]byte, n)
+	}
 
-			return nil
+	b := d.buf[:n]
+	if _, err := io.ReadFull(m.Payload(), b); err != nil {
+		return nil, err
+	}
 
-		default:
-			exit("Expected nullable string "+
-				"control character, got %c", np)
+	return b, nil
+}
 
-		}
+func (d *logRecordDecoder) decode(data []byte) (*logRecord, error) {
+	d.data = data
+	d.pos = 0
+	d.nNull = 0
 
-		exit("Prior switch should always return")
-		panic("exit should panic/return, " +
-			"but the compiler doesn't know that")
-	}
+	// One string for all the text that is not interned, which is
+	// made lazily so records whose fields are all interned or null
+	// go without.
+	d.text = ""
 
-	// Read a non-nullable string from b
-	nextString := func() string {
-		s, err := buf.ReadCString(b)
+	lr := &d.lr
+	var err error
+
+	// Decoding continues past errors, which are sticky, to keep
+	// this readable.
+	str := func(intern bool) string {
 		if err != nil {
-			exit(err)
+			return ""
 		}
 
+		var s string
+		s, err = d.nextString(intern)
 		return s
 	}
 
-	nextInt32 := func() int32 {
-		i32, err := buf.ReadInt32(b)
+	nstr := func(intern bool) *string {
 		if err != nil {
-			exit(err)
+			return nil
 		}
 
-		return i32
+		var s *string
+		s, err = d.nextNullableString(intern)
+		return s
 	}
 
-	nextInt64 := func() int64 {
-		i64, err := readInt64(b)
-		if err != nil {
-			exit(err)
+	i32 := func() int32 {
+		return int32(d.nextUint(4, &err))
+	}
+
+	lr.LogTime = str(false)
+	lr.UserName = nstr(true)
+	lr.DatabaseName = nstr(true)
+	lr.Pid = i32()
+	lr.ClientAddr = nstr(true)
+	lr.SessionID = str(true)
+	lr.SeqNum = int64(d.nextUint(8, &err))
+	lr.PsDisplay = nstr(true)
+	lr.SessionStart = str(true)
+	lr.Vxid = nstr(false)
+	lr.Txid = d.nextUint(8, &err)
+	lr.ELevel = i32()
+	lr.SQLState = nstr(true)
+	lr.ErrMessage = nstr(false)
+	lr.ErrDetail = nstr(false)
+	lr.ErrHint = nstr(false)
+	lr.InternalQuery = nstr(false)
+	lr.InternalQueryPos = i32()
+	lr.ErrContext = nstr(false)
+	lr.UserQuery = nstr(false)
+	lr.UserQueryPos = i32()
+	lr.FileErrPos = nstr(true)
+	lr.ApplicationName = nstr(true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if rest := len(data) - d.pos; rest != 0 {
+		return nil, fmt.Errorf("LogRecord message has mismatched "+
+			"length header and cString contents: remaining %d",
+			rest)
+	}
+
+	return lr, nil
+}
+
+// Read a big-endian unsigned integer of n bytes, unless *err is
+// already set.
+func (d *logRecordDecoder) nextUint(n int, err *error) uint64 {
+	if *err != nil {
+		return 0
+	}
+
+	if len(d.data)-d.pos < n {
+		*err = errShortLogRecord
+		return 0
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+
+	if n == 4 {
+		return uint64(binary.BigEndian.Uint32(b))
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *logRecordDecoder) nextString(intern bool) (string, error) {
+	end := bytes.IndexByte(d.data[d.pos:], 0)
+	if end < 0 {
+		return "", errShortLogRecord
+	}
+
+	start := d.pos
+	end += start
+	d.pos = end + 1
+
+	if start == end {
+		return "", nil
+	}
+
+	b := d.data[start:end]
+	if intern && len(b) < maxInternedLen {
+		// The conversion in the lookup does not allocate.
+		if s, ok := d.interned[string(b)]; ok {
+			return s, nil
 		}
 
-		return i64
+		if len(d.interned) >= maxInterned {
+			d.interned = make(map[string]string)
+		}
+
+		s := string(b)
+		d.interned[s] = s
+		return s, nil
+	}
+
+	if d.text == "" {
+		d.text = string(d.data)
 	}
 
-	nextUint64 := func() uint64 {
-		ui64, err := readUint64(b)
+	return d.text[start:end], nil
+}
+
+func (d *logRecordDecoder) nextNullableString(intern bool) (*string, error) {
+	if d.pos >= len(d.data) {
+		return nil, errShortLogRecord
+	}
+
+	np := d.data[d.pos]
+	d.pos++
+
+	switch np {
+	case 'P':
+		s, err := d.nextString(intern)
 		if err != nil {
-			exit(err)
+			return nil, err
 		}
 
-		return ui64
-	}
-
-	dst.LogTime = nextString()
-	dst.UserName = nextNullableString()
-	dst.DatabaseName = nextNullableString()
-	dst.Pid = nextInt32()
-	dst.ClientAddr = nextNullableString()
-	dst.SessionID = nextString()
-	dst.SeqNum = nextInt64()
-	dst.PsDisplay = nextNullableString()
-	dst.SessionStart = nextString()
-	dst.Vxid = nextNullableString()
-	dst.Txid = nextUint64()
-	dst.ELevel = nextInt32()
-	dst.SQLState = nextNullableString()
-	dst.ErrMessage = nextNullableString()
-	dst.ErrDetail = nextNullableString()
-	dst.ErrHint = nextNullableString()
-	dst.InternalQuery = nextNullableString()
-	dst.InternalQueryPos = nextInt32()
-	dst.ErrContext = nextNullableString()
-	dst.UserQuery = nextNullableString()
-	dst.UserQueryPos = nextInt32()
-	dst.FileErrPos = nextNullableString()
-	dst.ApplicationName = nextNullableString()
-
-	if b.Len() != 0 {
-		exit("LogRecord message has mismatched "+
-			"length header and cString contents: remaining %d",
-			b.Len())
+		p := &d.nullable[d.nNull]
+		d.nNull++
+		*p = s
+		return p, nil
+
+	case 'N':
+		// 'N' is still followed by a NUL byte that must be
+		// consumed.
+		_, err := d.nextString(false)
+		return nil, err
 	}
+
+	return nil, fmt.Errorf("Expected nullable string "+
+		"control character, got %c", np)
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/deafbybeheading/femebe/buf"
+	"github.com/deafbybeheading/femebe/core"
+)
+
+// Render a logRecord in the format pg_logfebe sends it.
+func encodeLogRecord(lr *logRecord) []byte {
+	b := bytes.Buffer{}
+
+	ns := func(s *string) {
+		if s == nil {
+			b.WriteByte('N')
+			buf.WriteCString(&b, "")
+		} else {
+			b.WriteByte('P')
+			buf.WriteCString(&b, *s)
+		}
+	}
+
+	num := func(n interface{}) {
+		binary.Write(&b, binary.BigEndian, n)
+	}
+
+	buf.WriteCString(&b, lr.LogTime)
+	ns(lr.UserName)
+	ns(lr.DatabaseName)
+	num(lr.Pid)
+	ns(lr.ClientAddr)
+	buf.WriteCString(&b, lr.SessionID)
+	num(lr.SeqNum)
+	ns(lr.PsDisplay)
+	buf.WriteCString(&b, lr.SessionStart)
+	ns(lr.Vxid)
+	num(lr.Txid)
+	num(lr.ELevel)
+	ns(lr.SQLState)
+	ns(lr.ErrMessage)
+	ns(lr.ErrDetail)
+	ns(lr.ErrHint)
+	ns(lr.InternalQuery)
+	num(lr.InternalQueryPos)
+	ns(lr.ErrContext)
+	ns(lr.UserQuery)
+	num(lr.UserQueryPos)
+	ns(lr.FileErrPos)
+	ns(lr.ApplicationName)
+
+	return b.Bytes()
+}
+
+var sampleRecord = logRecord{
+	LogTime:         "2014-05-01 10:00:00.000 UTC",
+	UserName:        strp("postgres"),
+	DatabaseName:    strp("postgres"),
+	Pid:             1234,
+	SessionID:       "5362197c.4d2",
+	SeqNum:          7,
+	PsDisplay:       strp("SELECT"),
+	SessionStart:    "2014-05-01 09:59:58 UTC",
+	Vxid:            strp("2/14"),
+	ELevel:          20,
+	SQLState:        strp("42P01"),
+	ErrMessage:      strp(`relation "nope" does not exist`),
+	UserQuery:       strp("SELECT * FROM nope;"),
+	UserQueryPos:    15,
+	ApplicationName: strp("psql"),
+}
+
+func TestDecodeLogRecord(t *testing.T) {
+	good := encodeLogRecord(&sampleRecord)
+
+	d := getLogRecordDecoder()
+	defer putLogRecordDecoder(d)
+
+	lr, err := d.decode(good)
+	if err != nil {
+		t.Fatalf("well formed record should decode, got %v", err)
+	}
+
+	if !reflect.DeepEqual(*lr, sampleRecord) {
+		t.Fatalf("decoded record differs from original: %s", lr.oneLine())
+	}
+
+	for _, bad := range [][]byte{
+		good[:len(good)/2],
+		append(append([]byte{}, good...), 'x'),
+		{},
+	} {
+		if _, err := d.decode(bad); err == nil {
+			t.Errorf("malformed record %q should not decode", bad)
+		}
+	}
+
+	// Values kept from one record are unaffected by decoding the
+	// next.
+	first, _ := d.decode(good)
+	msg := *first.ErrMessage
+
+	other := sampleRecord
+	other.ErrMessage = strp("something else")
+	d.decode(encodeLogRecord(&other))
+
+	if msg != *sampleRecord.ErrMessage {
+		t.Fatalf("kept string changed to %q", msg)
+	}
+}
+
+func TestDecodeLogRecordPayload(t *testing.T) {
+	payload := encodeLogRecord(&sampleRecord)
+
+	// A message only partly buffered by its stream is read into
+	// the decoder's own storage.
+	var m core.Message
+	m.InitPromise('L', uint32(len(payload))+4, payload[:10],
+		bytes.NewReader(payload[10:]))
+
+	d := getLogRecordDecoder()
+	defer putLogRecordDecoder(d)
+
+	data, err := d.payload(&m)
+	if err != nil {
+		t.Fatalf("could not read payload: %v", err)
+	}
+
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("payload %q differs from %q", data, payload)
+	}
+}
+
+func strp(s string) *string {
+	return &s
+}
+
+func TestTruncateLogRecord(t *testing.T) {
+	lr := sampleRecord
+	lr.UserQuery = strp(strings.Repeat("x", 100))
+
+	truncateLogRecord(&lr, 10)
+
+	if *lr.UserQuery != "xxxxxxxxxx...(truncated)" {
+		t.Fatalf("unexpected truncation: %q", *lr.UserQuery)
+	}
+
+	if *lr.ApplicationName != *sampleRecord.ApplicationName {
+		t.Fatalf("short field should be left alone, got %q",
+			*lr.ApplicationName)
+	}
+
+	// Characters are never split.
+	lr.ErrMessage = strp("xxxxxxxxx" + strings.Repeat("é", 10))
+	truncateLogRecord(&lr, 10)
+
+	if *lr.ErrMessage != "xxxxxxxxx...(truncated)" ||
+		!utf8.ValidString(*lr.ErrMessage) {
+		t.Fatalf("unexpected truncation: %q", *lr.ErrMessage)
+	}
+}
+
+// Report the rate at which records are decoded, as well as the usual
+// time and allocations per record.
+func reportRecordRate(b *testing.B) {
+	if secs := b.Elapsed().Seconds(); secs > 0 {
+		b.ReportMetric(float64(b.N)/secs, "records/s")
+	}
+}
+
+func BenchmarkDecodeLogRecord(b *testing.B) {
+	payload := encodeLogRecord(&sampleRecord)
+
+	d := getLogRecordDecoder()
+	defer putLogRecordDecoder(d)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := d.decode(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	reportRecordRate(b)
+}
+
+func BenchmarkDecodeLogRecordPromise(b *testing.B) {
+	payload := encodeLogRecord(&sampleRecord)
+	r := bytes.NewReader(nil)
+
+	d := getLogRecordDecoder()
+	defer putLogRecordDecoder(d)
+
+	var m core.Message
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r.Reset(payload)
+		m.InitPromise('L', uint32(len(payload))+4, nil, r)
+
+		data, err := d.payload(&m)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := d.decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	reportRecordRate(b)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"container/list"
+	"time"
+)
+
+// A map of bounded size that evicts its least recently used entries
+// to make room for new ones, and can expire those that have not been
+// used for a while.  It is not safe for concurrent use.
+type lruCache struct {
+	max   int
+	ll    *list.List
+	items map[string]*list.Element
+
+	// Called with every entry that is evicted or expired, if not
+	// nil.
+	onEvict func(key string, value interface{})
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	touched time.Time
+}
+
+func newLRUCache(max int, onEvict func(key string,
+	value interface{})) *lruCache {
+	return &lruCache{max: max, ll: list.New(),
+		items: make(map[string]*list.Element), onEvict: onEvict}
+}
+
+func (c *lruCache) len() int {
+	return c.ll.Len()
+}
+
+// Look up the value of key, marking it as used at now.
+func (c *lruCache) get(key string, now time.Time) (interface{}, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(elem)
+	ent := elem.Value.(*lruEntry)
+	ent.touched = now
+	return ent.value, true
+}
+
+// Set the value of key, as used at now, evicting the least recently
+// used entry if there are too many.
+func (c *lruCache) put(key string, value interface{}, now time.Time) {
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		ent := elem.Value.(*lruEntry)
+		ent.value, ent.touched = value, now
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value,
+		touched: now})
+
+	if c.ll.Len() > c.max {
+		c.evict(c.ll.Back())
+	}
+}
+
+// Remove key without calling onEvict, returning its value if it had
+// one.
+func (c *lruCache) remove(key string) (interface{}, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.Remove(elem)
+	delete(c.items, key)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// Evict every entry last used before the given time.
+func (c *lruCache) expire(before time.Time) {
+	for elem := c.ll.Back(); elem != nil; elem = c.ll.Back() {
+		if !elem.Value.(*lruEntry).touched.Before(before) {
+			return
+		}
+
+		c.evict(elem)
+	}
+}
+
+// Evict every entry.
+func (c *lruCache) evictAll() {
+	for elem := c.ll.Back(); elem != nil; elem = c.ll.Back() {
+		c.evict(elem)
+	}
+}
+
+func (c *lruCache) evict(elem *list.Element) {
+	ent := elem.Value.(*lruEntry)
+	c.ll.Remove(elem)
+	delete(c.items, ent.key)
+
+	if c.onEvict != nil {
+		c.onEvict(ent.key, ent.value)
+	}
+}
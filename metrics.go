@@ -0,0 +1,81 @@
+// Metrics derived from records, for serves with "metrics" set, are
+// sent to the primary URL as log lines in the conventions of l2met:
+//
+//     source=cluster1 count#postgres.checkpoint.buffers_written=123 measure#postgres.checkpoint.write=0.123s
+//
+// where count# values are summed, measure# values are summarized as
+// distributions, and sample# values are taken as levels.  The source
+// is the name of the serve if it has one, and its identity otherwise,
+// and the labels of the serve, if any, follow everything else.
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+type metric struct {
+	kind  string // "count", "measure", or "sample"
+	name  string
+	value float64
+	unit  string
+}
+
+func metricSource(sr *serveRecord) string {
+	if sr.Name != "" {
+		return sr.Name
+	}
+
+	return sr.I
+}
+
+// Render metrics as one line, with any extra key-value pairs after
+// them, such as to say what they are about.
+func formatMetrics(sr *serveRecord, metrics []metric, extra ...string) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("source=")
+	b.WriteString(metricSource(sr))
+
+	for _, m := range metrics {
+		b.WriteByte(' ')
+		b.WriteString(m.kind)
+		b.WriteByte('#')
+		b.WriteString(m.name)
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(m.value, 'f', -1, 64))
+		b.WriteString(m.unit)
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(extra[i])
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(extra[i+1]))
+	}
+
+	if labels := sr.labelPrefix(); labels != "" {
+		b.WriteByte(' ')
+		b.WriteString(strings.TrimSuffix(labels, " "))
+	}
+
+	return b.Bytes()
+}
+
+// Send metrics to target, if the serve asks for them.
+func emitMetrics(sr *serveRecord, target *logplexc.Client, when time.Time,
+	metrics []metric, extra ...string) {
+	if !sr.metrics || len(metrics) == 0 {
+		return
+	}
+
+	app := sr.appName()
+
+	target.BufferMessage(134, when, app, app+".metrics",
+		formatMetrics(sr, metrics, extra...))
+}
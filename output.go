@@ -0,0 +1,157 @@
+// Formatting of records for sending.  Serves choose a "format":
+//
+//     "text", the default, which is the message followed by the
+//     detail, hint, and query, if any, a line each, and for records
+//     with a SQLSTATE other than successful completion, a line
+//     naming it, such as "sqlstate=23505 condition=unique_violation
+//     class=integrity_constraint_violation".
+//
+//     "json", an object with the keys of Postgres's own jsonlog, such
+//     as "message" and "error_severity", leaving out those without a
+//     value, along with any fields derived from the record, such as
+//     those of extract.go.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+func validFormat(format string) bool {
+	return format == formatText || format == formatJSON
+}
+
+// What a text record begins with, saying where it comes from: the
+// name of the serve, the audit header, and the labels.
+func textRecordHead(sr *serveRecord, isAudit bool) string {
+	var head string
+
+	if sr.Name != "" {
+		// If available, identify what agent is doing the
+		// logging to aid human readers in determining where a
+		// log message came from.
+		head = "[" + sr.Name + "] "
+	}
+
+	if isAudit {
+		head += sr.auditHeader()
+	}
+
+	return head + sr.labelPrefix()
+}
+
+// The message of a text record, followed by its detail, hint, and
+// query, a line each.
+func formatTextMessage(lr *logRecord) []byte {
+	// Buffer to format the complete log message in.
+	msgFmtBuf := bytes.Buffer{}
+
+	// Helps with formatting a series of nullable strings.
+	catOptionalField := func(prefix string, maybePresent *string) {
+		if maybePresent != nil {
+			if prefix != "" {
+				msgFmtBuf.WriteString(prefix)
+				msgFmtBuf.WriteString(": ")
+			}
+
+			msgFmtBuf.WriteString(*maybePresent)
+			msgFmtBuf.WriteByte('\n')
+		}
+	}
+
+	catOptionalField("", lr.ErrMessage)
+	catOptionalField("Detail", lr.ErrDetail)
+	catOptionalField("Hint", lr.ErrHint)
+	catOptionalField("Query", lr.UserQuery)
+
+	if describeSQLState(lr.SQLState) {
+		msgFmtBuf.WriteString("sqlstate=" + *lr.SQLState)
+		if condition := sqlstateCondition(*lr.SQLState); condition != "" {
+			msgFmtBuf.WriteString(" condition=" + condition)
+		}
+
+		if class := sqlstateClassName(*lr.SQLState); class != "" {
+			msgFmtBuf.WriteString(" class=" + class)
+		}
+
+		msgFmtBuf.WriteByte('\n')
+	}
+
+	return msgFmtBuf.Bytes()
+}
+
+// Render a record as JSON, with extra holding more fields to add.
+func formatJSONRecord(lr *logRecord, sr *serveRecord, isAudit bool,
+	extra map[string]interface{}) []byte {
+	obj := make(map[string]interface{}, 32)
+
+	str := func(key string, s string) {
+		if s != "" {
+			obj[key] = s
+		}
+	}
+
+	nstr := func(key string, s *string) {
+		if s != nil {
+			obj[key] = *s
+		}
+	}
+
+	num := func(key string, n int64) {
+		if n != 0 {
+			obj[key] = n
+		}
+	}
+
+	str("name", sr.Name)
+	if isAudit {
+		obj["instance_type"] = "shogun"
+		obj["identity"] = sr.I
+	}
+
+	if labels := sr.labelEvent(); len(labels.fields) > 0 {
+		obj["labels"] = labels.jsonObject()
+	}
+
+	str("timestamp", lr.LogTime)
+	nstr("user", lr.UserName)
+	nstr("dbname", lr.DatabaseName)
+	num("pid", int64(lr.Pid))
+	nstr("remote_host", lr.ClientAddr)
+	str("session_id", lr.SessionID)
+	num("line_num", lr.SeqNum)
+	nstr("ps", lr.PsDisplay)
+	str("session_start", lr.SessionStart)
+	nstr("vxid", lr.Vxid)
+	num("txid", int64(lr.Txid))
+	str("error_severity", elevelName(lr.ELevel))
+	nstr("state_code", lr.SQLState)
+	if describeSQLState(lr.SQLState) {
+		str("condition", sqlstateCondition(*lr.SQLState))
+		str("class", sqlstateClassName(*lr.SQLState))
+	}
+	nstr("message", lr.ErrMessage)
+	nstr("detail", lr.ErrDetail)
+	nstr("hint", lr.ErrHint)
+	nstr("internal_query", lr.InternalQuery)
+	num("internal_position", int64(lr.InternalQueryPos))
+	nstr("context", lr.ErrContext)
+	nstr("statement", lr.UserQuery)
+	num("cursor_position", int64(lr.UserQueryPos))
+	nstr("location", lr.FileErrPos)
+	nstr("application_name", lr.ApplicationName)
+
+	for k, v := range extra {
+		obj[k] = v
+	}
+
+	// Marshaling maps of JSON-friendly values does not fail.
+	b, _ := json.Marshal(obj)
+	return b
+}
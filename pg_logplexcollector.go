@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/logplex/logplexc"
@@ -20,19 +21,53 @@ const (
 // Used only in the close-to-broadcast style to exit goroutines.
 type dieCh <-chan struct{}
 
+// Locks of paths, and addresses, in use by serves.
+var pathLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+// Wait until no other serve uses a path, returning a function to call
+// once done with it.  On a reload of the serve database, the new
+// generation of a serve is started as the old is told to exit, so it
+// must wait for the old to let go of its socket, or of its tailed
+// file's checkpoint.
+func lockPath(p string) func() {
+	pathLocks.Lock()
+	l, ok := pathLocks.m[p]
+	if !ok {
+		l = new(sync.Mutex)
+		pathLocks.m[p] = l
+	}
+	pathLocks.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
 func listen(die dieCh, sr *serveRecord) {
 	// Begin listening
 	var l net.Listener
 	var pc net.PacketConn
-	var f *os.File
 	var err error
 
+	// Called once the listener of a syslog stream is closed.
+	unlock := func() {}
+
 	switch sr.protocol {
 	case "syslog":
 		os.Remove(sr.P)
 		pc, err = net.ListenPacket("unixgram", sr.P)
-	case "logfile":
-		f, err = os.Open(sr.P)
+	case "syslog-stream":
+		unlock = lockPath(sr.P)
+		os.Remove(sr.P)
+		l, err = listenSyslogStream(sr)
+	case "syslog-tcp", "syslog-tls":
+		unlock = lockPath(sr.P)
+		l, err = listenSyslogStream(sr)
+	case "logfile", "csvlog", "jsonlog":
+		// Files are opened by the tailer, which follows them
+		// as they are rotated.
 	default:
 		os.Remove(sr.P)
 		l, err = net.Listen("unix", sr.P)
@@ -55,11 +90,24 @@ func listen(die dieCh, sr *serveRecord) {
 		},
 	}
 
+	if sr.compression != "" {
+		client.Transport = newCompressingTransport(client.Transport, sr)
+	}
+
 	templateConfig := logplexc.Config{
 		HttpClient:         client,
-		RequestSizeTrigger: 100 * KB,
-		Concurrency:        3,
-		Period:             time.Second / 4,
+		RequestSizeTrigger: sr.requestSizeTrigger,
+		Concurrency:        sr.concurrency,
+		Period:             sr.period,
+		TimeTrigger:        sr.timeTrigger,
+	}
+
+	if sr.statementStats {
+		go statementStatsWorker(die, templateConfig, sr)
+	}
+
+	if sr.metrics && (sr.encoding != nil || sr.detectInvalidUTF8) {
+		go encodingMetricsWorker(die, templateConfig, sr)
 	}
 
 	switch sr.protocol {
@@ -67,8 +115,16 @@ func listen(die dieCh, sr *serveRecord) {
 		logWorker(die, l, templateConfig, sr)
 	case "syslog":
 		go syslogWorker(die, pc, templateConfig, sr)
+	case "syslog-stream", "syslog-tcp", "syslog-tls":
+		syslogStreamWorker(die, l, unlock, templateConfig, sr)
 	case "logfile":
-		lineWorker(die, f, templateConfig, sr)
+		if sr.lineParser == nil {
+			lineWorker(die, templateConfig, sr)
+		} else {
+			recordFileWorker(die, templateConfig, sr)
+		}
+	case "csvlog", "jsonlog":
+		recordFileWorker(die, templateConfig, sr)
 	default:
 		log.Fatalf("cannot comprehend protocol %v specified in "+
 			"servedb.", sr.protocol)
@@ -86,8 +142,11 @@ func main() {
 	// messages.
 	log.SetPrefix("pg_logplexcollector ")
 
+	// What enriched records say of the collector.
+	initCollector()
+
 	// Signal handling: print dying gasp and and exit
-	sigch := make(chan os.Signal)
+	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, os.Interrupt, os.Kill)
 	go func() {
 		for sig := range sigch {
@@ -121,7 +180,7 @@ func main() {
 		nw, err := sdb.Poll()
 		if err != nil {
 			if os.IsNotExist(err) {
-				log.Fatal("SERVE_DB_DIR is set to a non-existant "+
+				log.Fatalf("SERVE_DB_DIR is set to a non-existant "+
 					"directory: %v", err)
 			}
 
@@ -149,6 +208,12 @@ func main() {
 			}
 		}
 
+		// Publish running statistics for other programs to
+		// inspect.
+		if err := sdb.persistStats(); err != nil {
+			log.Printf("could not write serve statistics: %v", err)
+		}
+
 		time.Sleep(10 * time.Second)
 
 		if time.Now().After(deathClock) {
@@ -0,0 +1,146 @@
+// Records of pgaudit, which Postgres logs as messages like:
+//
+//     AUDIT: SESSION,1,1,READ,SELECT,TABLE,public.t,select * from t,<not logged>
+//
+// that is, in CSV, the audit type (SESSION or OBJECT), statement and
+// substatement ids, class, command, object type and name, statement,
+// and parameters.  For serves with an "audit" URL, these are sent
+// there, and there only, as JSON objects whatever the format of the
+// serve, so that they are easy to ingest the same way everywhere:
+//
+//     {"audit_type":"SESSION","class":"READ","command":"SELECT","event":"pgaudit","identity":"...","instance_type":"shogun",...}
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+const pgauditPrefix = "AUDIT: "
+
+type pgauditEntry struct {
+	auditType      string
+	statementID    string
+	substatementID string
+	class          string
+	command        string
+	objectType     string
+	objectName     string
+	statement      string
+	parameter      string
+}
+
+// Parse the pgaudit entry of a record, or return nil if it has none.
+func parsePgaudit(lr *logRecord) *pgauditEntry {
+	if lr.ErrMessage == nil ||
+		!strings.HasPrefix(*lr.ErrMessage, pgauditPrefix) {
+		return nil
+	}
+
+	r := csv.NewReader(strings.NewReader(
+		(*lr.ErrMessage)[len(pgauditPrefix):]))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	fields, err := r.Read()
+	if err != nil || len(fields) < 8 {
+		return nil
+	}
+
+	a := &pgauditEntry{
+		auditType:      fields[0],
+		statementID:    fields[1],
+		substatementID: fields[2],
+		class:          fields[3],
+		command:        fields[4],
+		objectType:     fields[5],
+		objectName:     fields[6],
+		statement:      fields[7],
+	}
+
+	// pgaudit.log_parameter adds the parameters as one more
+	// field, itself in CSV.
+	if len(fields) > 8 {
+		a.parameter = fields[8]
+	}
+
+	return a
+}
+
+// Whether pgaudit logged parameters, rather than saying it did not,
+// or that there were none.
+func (a *pgauditEntry) hasParameters() bool {
+	return a.parameter != "" && a.parameter != "<not logged>" &&
+		a.parameter != "<none>"
+}
+
+// Redact the statement of an entry as if it were a query of the
+// record, and its parameters as if they were logged with it.
+func (r *redactor) redactPgaudit(a *pgauditEntry) {
+	credentials := isCredentialSQL(&a.statement)
+
+	a.statement = r.sql(a.statement)
+	if !a.hasParameters() {
+		return
+	}
+
+	if r.normalize || credentials {
+		a.parameter = "<redacted>"
+	} else {
+		a.parameter = r.scrub(a.parameter)
+	}
+}
+
+// Render an entry along with what the record says of the session it
+// belongs to.
+func formatPgaudit(lr *logRecord, sr *serveRecord, a *pgauditEntry) []byte {
+	id := func(s string) interface{} {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+
+		return s
+	}
+
+	e := newEvent("pgaudit").
+		add("event", "pgaudit").
+		add("instance_type", "shogun").
+		add("identity", sr.I).
+		add("name", sr.Name).
+		add("labels", sr.labelEvent()).
+		add("timestamp", lr.LogTime).
+		add("user", nullString(lr.UserName)).
+		add("dbname", nullString(lr.DatabaseName)).
+		add("pid", lr.Pid).
+		add("remote_host", recordClientAddr(lr)).
+		add("session_id", lr.SessionID).
+		add("application_name", nullString(lr.ApplicationName)).
+		add("audit_type", a.auditType).
+		add("statement_id", id(a.statementID)).
+		add("substatement_id", id(a.substatementID)).
+		add("class", a.class).
+		add("command", a.command).
+		add("object_type", a.objectType).
+		add("object_name", a.objectName).
+		add("statement", a.statement).
+		add("parameter", a.parameter)
+
+	// Marshaling maps of JSON-friendly values does not fail.
+	b, _ := json.Marshal(e.jsonObject())
+	return b
+}
+
+// Send an entry to the audit target.
+func emitPgaudit(lr *logRecord, sr *serveRecord, audit *logplexc.Client,
+	when time.Time, a *pgauditEntry) {
+	app := sr.appName()
+
+	audit.BufferMessage(134, when, app, app+".audit",
+		formatPgaudit(lr, sr, a))
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePgaudit(t *testing.T) {
+	lr := sampleRecord
+	lr.ErrMessage = strp(`AUDIT: OBJECT,3,1,WRITE,INSERT,TABLE,public.t,` +
+		`"insert into t values ('a,b', ""c"")",<not logged>`)
+
+	a := parsePgaudit(&lr)
+	want := &pgauditEntry{auditType: "OBJECT", statementID: "3",
+		substatementID: "1", class: "WRITE", command: "INSERT",
+		objectType: "TABLE", objectName: "public.t",
+		statement: `insert into t values ('a,b', "c")`,
+		parameter: "<not logged>"}
+	if !reflect.DeepEqual(a, want) {
+		t.Fatalf("got %+v, want %+v", a, want)
+	}
+
+	if parsePgaudit(&sampleRecord) != nil {
+		t.Error("expected no entry for an ordinary record")
+	}
+}
+
+func TestFormatPgaudit(t *testing.T) {
+	lr := sampleRecord
+	lr.ErrMessage = strp("AUDIT: SESSION,1,1,ROLE,ALTER ROLE,,," +
+		"ALTER ROLE bob PASSWORD 'hunter2',<none>")
+
+	r, err := newRedactor([]string{redactPasswords}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := parsePgaudit(&lr)
+	r.redactPgaudit(a)
+
+	sr := &serveRecord{sKey: sKey{I: "ident"}}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(formatPgaudit(&lr, sr, a), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"event":            "pgaudit",
+		"instance_type":    "shogun",
+		"identity":         "ident",
+		"timestamp":        "2014-05-01 10:00:00.000 UTC",
+		"user":             "postgres",
+		"dbname":           "postgres",
+		"pid":              1234.0,
+		"session_id":       "5362197c.4d2",
+		"application_name": "psql",
+		"audit_type":       "SESSION",
+		"statement_id":     1.0,
+		"substatement_id":  1.0,
+		"class":            "ROLE",
+		"command":          "ALTER ROLE",
+		"statement":        "ALTER ROLE bob PASSWORD '********'",
+		"parameter":        "<none>",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
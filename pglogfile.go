@@ -0,0 +1,400 @@
+// Ingestion of the log files Postgres itself writes when
+// log_destination includes csvlog or jsonlog, for hosts where
+// pg_logfebe cannot be installed, or of plain text logs with a
+// lineParser.
+//
+// Each file record is mapped into a logRecord, and from there it is
+// handled just like a record received from pg_logfebe.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+// Accumulates lines of a log file into complete records, calling
+// emit with a logRecord for each.
+type recordAssembler interface {
+	// Add a line, including its newline, to the record being
+	// assembled.  A malformed record is reported as an error,
+	// after which assembly starts afresh.  Errors that are a
+	// *malformedRecord carry all the text of the record, and
+	// others are about line alone.
+	addLine(line []byte, emit func(lr *logRecord)) error
+
+	// How many bytes of the lines added are held in a record not
+	// yet emitted.
+	held() int
+}
+
+// A record that could not be assembled, and the text it was
+// assembled from so far.
+type malformedRecord struct {
+	reason string
+	data   []byte
+}
+
+func (m *malformedRecord) Error() string {
+	return m.reason
+}
+
+// Implemented by recordAssemblers that cannot tell a record is
+// complete until the next one starts, and so must be told when no
+// more lines are forthcoming for the time being, and when no more
+// are forthcoming at all.
+type idleAssembler interface {
+	idle(emit func(lr *logRecord))
+	flush(emit func(lr *logRecord))
+}
+
+func newRecordAssembler(sr *serveRecord) recordAssembler {
+	switch sr.protocol {
+	case "csvlog":
+		return &csvAssembler{}
+	case "jsonlog":
+		return &jsonAssembler{}
+	case "logfile":
+		return &lineAssembler{p: sr.lineParser}
+	}
+
+	return nil
+}
+
+func recordFileWorker(die dieCh, cfg logplexc.Config, sr *serveRecord) {
+	clients, err := acquireServeClients(sr, cfg)
+	if err != nil {
+		log.Fatalf("could not create logging client: %v", err)
+	}
+	defer clients.release()
+
+	asm := newRecordAssembler(sr)
+	seq := newSeqTracker()
+
+	sessions := trackSessions(clients, sr)
+	if sessions != nil {
+		defer sessions.flush("stopped")
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go sessionExpiryWorker(stop, sessions)
+	}
+
+	emit := func(lr *logRecord) {
+		if reason := catchExit(func(exit exitFn) {
+			checkEncoding(lr, sr)
+			checkSeq(seq, lr, clients, sr, exit)
+			if sessions != nil {
+				sessions.observe(lr, time.Now())
+			}
+
+			routeLogRecord(lr, clients, sr, exit)
+		}); reason != "" {
+			log.Printf("could not route record from %q: %v",
+				sr.P, reason)
+		}
+	}
+
+	var idle, flush func()
+	if ia, ok := asm.(idleAssembler); ok {
+		idle = func() { ia.idle(emit) }
+		flush = func() { ia.flush(emit) }
+	}
+
+	tailFile(die, sr, func(line []byte) {
+		if err := asm.addLine(line, emit); err != nil {
+			data := line
+			if m, ok := err.(*malformedRecord); ok {
+				data = m.data
+			}
+
+			quarantineRecord(sr, err.Error(), data)
+			sr.stats().incr("skipped")
+		}
+	}, idle, flush, asm.held)
+}
+
+// Return nil for the empty string, which is how both csvlog and
+// jsonlog represent absent values.
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
+
+// Strip the port from a "host:port" remote address, as pg_logfebe
+// only reports the host.
+func clientHost(connectionFrom string) *string {
+	if host, _, err := net.SplitHostPort(connectionFrom); err == nil {
+		return nullIfEmpty(host)
+	}
+
+	return nullIfEmpty(connectionFrom)
+}
+
+// csvlog records are a line each, except that quoted fields may
+// contain newlines.  Because quotes are escaped by doubling them, a
+// record is complete exactly when it contains an even number of
+// quotes and ends with a newline.
+//
+// A quote left unbalanced, as by a write cut short, would have every
+// record after it taken for part of one quoted field.  So a record
+// that grows past maxAssembledRecord is given up on, and lines are
+// skipped until one begins like a csvlog record, with a timestamp.
+type csvAssembler struct {
+	record bytes.Buffer
+	quotes int
+
+	// Whether lines are being skipped after a record was given
+	// up on.
+	resync bool
+}
+
+// The most text assembled into one record, the same limit that
+// applies to records from pg_logfebe.
+const maxAssembledRecord = 1 * MB
+
+// The start of a csvlog record: its log_time.
+var csvRecordStart = regexp.MustCompile(
+	`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)? [^,]*,`)
+
+// The columns of csvlog as of Postgres 9.0, which later versions
+// only append to.
+const (
+	csvLogTime = iota
+	csvUserName
+	csvDatabaseName
+	csvProcessID
+	csvConnectionFrom
+	csvSessionID
+	csvSessionLineNum
+	csvCommandTag
+	csvSessionStartTime
+	csvVirtualTransactionID
+	csvTransactionID
+	csvErrorSeverity
+	csvSQLStateCode
+	csvMessage
+	csvDetail
+	csvHint
+	csvInternalQuery
+	csvInternalQueryPos
+	csvContext
+	csvQuery
+	csvQueryPos
+	csvLocation
+	csvApplicationName
+	csvMinColumns
+)
+
+func (a *csvAssembler) addLine(line []byte, emit func(lr *logRecord)) error {
+	if a.resync {
+		if !csvRecordStart.Match(line) {
+			return fmt.Errorf("csvlog line skipped after a " +
+				"record with an unbalanced quote")
+		}
+
+		a.resync = false
+	}
+
+	a.record.Write(line)
+	a.quotes += bytes.Count(line, []byte{'"'})
+
+	if a.quotes%2 != 0 {
+		if a.record.Len() <= maxAssembledRecord {
+			// Inside a quoted field: the record continues
+			// on the next line.
+			return nil
+		}
+
+		a.resync = true
+		a.quotes = 0
+		data := append([]byte(nil), a.record.Bytes()...)
+		a.record.Reset()
+
+		return &malformedRecord{fmt.Sprintf("csvlog record longer "+
+			"than %d bytes, with an unbalanced quote",
+			maxAssembledRecord), data}
+	}
+
+	defer func() {
+		a.record.Reset()
+		a.quotes = 0
+	}()
+
+	// The whole record goes to the quarantine, should it prove
+	// malformed.
+	malformed := func(format string, args ...interface{}) error {
+		return &malformedRecord{fmt.Sprintf(format, args...),
+			append([]byte(nil), a.record.Bytes()...)}
+	}
+
+	r := csv.NewReader(bytes.NewReader(a.record.Bytes()))
+	r.FieldsPerRecord = -1
+	fields, err := r.Read()
+	if err != nil {
+		return malformed("malformed csvlog record: %v", err)
+	}
+
+	if len(fields) < csvMinColumns {
+		return malformed("csvlog record has %d columns, "+
+			"expected at least %d", len(fields), csvMinColumns)
+	}
+
+	var lr logRecord
+	if err := csvLogRecord(&lr, fields); err != nil {
+		return malformed("%v", err)
+	}
+
+	emit(&lr)
+	return nil
+}
+
+func (a *csvAssembler) held() int {
+	return a.record.Len()
+}
+
+func csvLogRecord(dst *logRecord, fields []string) error {
+	var err error
+
+	// Parse the numeric columns, remembering only the first
+	// error.
+	num := func(col int, bits int) int64 {
+		if fields[col] == "" {
+			return 0
+		}
+
+		n, e := strconv.ParseInt(fields[col], 10, bits)
+		if e != nil && err == nil {
+			err = fmt.Errorf("csvlog column %d: %v", col, e)
+		}
+
+		return n
+	}
+
+	dst.LogTime = fields[csvLogTime]
+	dst.UserName = nullIfEmpty(fields[csvUserName])
+	dst.DatabaseName = nullIfEmpty(fields[csvDatabaseName])
+	dst.Pid = int32(num(csvProcessID, 32))
+	dst.ClientAddr = clientHost(fields[csvConnectionFrom])
+	dst.SessionID = fields[csvSessionID]
+	dst.SeqNum = num(csvSessionLineNum, 64)
+	dst.PsDisplay = nullIfEmpty(fields[csvCommandTag])
+	dst.SessionStart = fields[csvSessionStartTime]
+	dst.Vxid = nullIfEmpty(fields[csvVirtualTransactionID])
+	dst.Txid = uint64(num(csvTransactionID, 64))
+	dst.ELevel = elevelOf(fields[csvErrorSeverity])
+	dst.SQLState = nullIfEmpty(fields[csvSQLStateCode])
+	dst.ErrMessage = nullIfEmpty(fields[csvMessage])
+	dst.ErrDetail = nullIfEmpty(fields[csvDetail])
+	dst.ErrHint = nullIfEmpty(fields[csvHint])
+	dst.InternalQuery = nullIfEmpty(fields[csvInternalQuery])
+	dst.InternalQueryPos = int32(num(csvInternalQueryPos, 32))
+	dst.ErrContext = nullIfEmpty(fields[csvContext])
+	dst.UserQuery = nullIfEmpty(fields[csvQuery])
+	dst.UserQueryPos = int32(num(csvQueryPos, 32))
+	dst.FileErrPos = nullIfEmpty(fields[csvLocation])
+	dst.ApplicationName = nullIfEmpty(fields[csvApplicationName])
+
+	return err
+}
+
+// jsonlog, available since Postgres 15, writes one JSON object per
+// line.
+type jsonAssembler struct{}
+
+// The keys of a jsonlog record.  Keys with empty values are omitted
+// by Postgres altogether.
+type jsonLogLine struct {
+	Timestamp        string `json:"timestamp"`
+	User             string `json:"user"`
+	DBName           string `json:"dbname"`
+	Pid              int32  `json:"pid"`
+	RemoteHost       string `json:"remote_host"`
+	SessionID        string `json:"session_id"`
+	LineNum          int64  `json:"line_num"`
+	Ps               string `json:"ps"`
+	SessionStart     string `json:"session_start"`
+	Vxid             string `json:"vxid"`
+	Txid             uint64 `json:"txid"`
+	ErrorSeverity    string `json:"error_severity"`
+	StateCode        string `json:"state_code"`
+	Message          string `json:"message"`
+	Detail           string `json:"detail"`
+	Hint             string `json:"hint"`
+	InternalQuery    string `json:"internal_query"`
+	InternalPosition int32  `json:"internal_position"`
+	Context          string `json:"context"`
+	Statement        string `json:"statement"`
+	CursorPosition   int32  `json:"cursor_position"`
+	FuncName         string `json:"func_name"`
+	FileName         string `json:"file_name"`
+	FileLineNum      int    `json:"file_line_num"`
+	ApplicationName  string `json:"application_name"`
+}
+
+// jsonlog records are a line each, so none are ever held.
+func (a *jsonAssembler) held() int {
+	return 0
+}
+
+func (a *jsonAssembler) addLine(line []byte, emit func(lr *logRecord)) error {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 {
+		return nil
+	}
+
+	var jl jsonLogLine
+	if err := json.Unmarshal(trimmed, &jl); err != nil {
+		return fmt.Errorf("malformed jsonlog record: %v", err)
+	}
+
+	var lr logRecord
+	jsonLogRecord(&lr, &jl)
+	emit(&lr)
+
+	return nil
+}
+
+func jsonLogRecord(dst *logRecord, jl *jsonLogLine) {
+	dst.LogTime = jl.Timestamp
+	dst.UserName = nullIfEmpty(jl.User)
+	dst.DatabaseName = nullIfEmpty(jl.DBName)
+	dst.Pid = jl.Pid
+	dst.ClientAddr = nullIfEmpty(jl.RemoteHost)
+	dst.SessionID = jl.SessionID
+	dst.SeqNum = jl.LineNum
+	dst.PsDisplay = nullIfEmpty(jl.Ps)
+	dst.SessionStart = jl.SessionStart
+	dst.Vxid = nullIfEmpty(jl.Vxid)
+	dst.Txid = jl.Txid
+	dst.ELevel = elevelOf(jl.ErrorSeverity)
+	dst.SQLState = nullIfEmpty(jl.StateCode)
+	dst.ErrMessage = nullIfEmpty(jl.Message)
+	dst.ErrDetail = nullIfEmpty(jl.Detail)
+	dst.ErrHint = nullIfEmpty(jl.Hint)
+	dst.InternalQuery = nullIfEmpty(jl.InternalQuery)
+	dst.InternalQueryPos = jl.InternalPosition
+	dst.ErrContext = nullIfEmpty(jl.Context)
+	dst.UserQuery = nullIfEmpty(jl.Statement)
+	dst.UserQueryPos = jl.CursorPosition
+	dst.ApplicationName = nullIfEmpty(jl.ApplicationName)
+
+	// Render the location the same way csvlog does.
+	if jl.FuncName != "" || jl.FileName != "" {
+		loc := fmt.Sprintf("%s, %s:%d", jl.FuncName, jl.FileName,
+			jl.FileLineNum)
+		dst.FileErrPos = &loc
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Feed text to an assembler a line at a time, collecting the records
+// it emits.
+func assemble(t *testing.T, asm recordAssembler, text string) []logRecord {
+	var got []logRecord
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+
+		err := asm.addLine([]byte(line), func(lr *logRecord) {
+			got = append(got, *lr)
+		})
+		if err != nil {
+			t.Fatalf("could not assemble %q: %v", line, err)
+		}
+	}
+
+	return got
+}
+
+func TestCSVAssembler(t *testing.T) {
+	text := `2014-05-01 10:00:00.123 UTC,"alice","app",4242,"10.0.0.1:51234",5362197c.1092,3,"SELECT",2014-05-01 09:59:58 UTC,2/14,0,ERROR,42P01,"relation ""nope"" does not exist",,,,,,"SELECT *
+  FROM nope;",15,,"psql"
+2014-05-01 10:00:01.000 UTC,,,4100,,5362197a.1004,1,,2014-05-01 09:59:50 UTC,,0,LOG,00000,"checkpoint starting: time",,,,,,,,,""
+`
+
+	got := assemble(t, &csvAssembler{}, text)
+	if len(got) != 2 {
+		t.Fatalf("expected two records, got %d", len(got))
+	}
+
+	lr := got[0]
+	if lr.Pid != 4242 || lr.SeqNum != 3 || lr.ELevel != elevelError {
+		t.Errorf("numeric fields not parsed: %s", lr.oneLine())
+	}
+
+	if *lr.ErrMessage != `relation "nope" does not exist` {
+		t.Errorf("unexpected message %q", *lr.ErrMessage)
+	}
+
+	if *lr.UserQuery != "SELECT *\n  FROM nope;" {
+		t.Errorf("multi-line field not assembled: %q", *lr.UserQuery)
+	}
+
+	if *lr.ClientAddr != "10.0.0.1" {
+		t.Errorf("expected port to be stripped, got %q", *lr.ClientAddr)
+	}
+
+	if got[1].UserName != nil || got[1].ApplicationName != nil {
+		t.Errorf("empty fields should be null: %s", got[1].oneLine())
+	}
+}
+
+func TestCSVAssemblerMalformed(t *testing.T) {
+	asm := &csvAssembler{}
+	err := asm.addLine([]byte("just,three,columns\n"),
+		func(lr *logRecord) {
+			t.Fatal("malformed record should not be emitted")
+		})
+	if m, ok := err.(*malformedRecord); !ok ||
+		string(m.data) != "just,three,columns\n" {
+		t.Fatalf("expected an error with the whole record, got %v", err)
+	}
+
+	// The assembler should recover for the next record.
+	got := assemble(t, asm, `2014-05-01 10:00:01.000 UTC,,,1,,a.b,1,,2014-05-01 09:59:50 UTC,,0,LOG,00000,"hello",,,,,,,,,""`+"\n")
+	if len(got) != 1 || *got[0].ErrMessage != "hello" {
+		t.Fatalf("assembler did not recover: %v", got)
+	}
+}
+
+func TestJSONAssembler(t *testing.T) {
+	text := `{"timestamp":"2022-10-13 10:00:00.000 UTC","user":"alice","dbname":"app","pid":4242,"remote_host":"10.0.0.1","remote_port":51234,"session_id":"6347e0f0.1092","line_num":3,"ps":"SELECT","session_start":"2022-10-13 09:59:58 UTC","vxid":"2/14","txid":0,"error_severity":"ERROR","state_code":"42P01","message":"relation \"nope\" does not exist","statement":"SELECT * FROM nope;","cursor_position":15,"func_name":"parserOpenTable","file_name":"parse_relation.c","file_line_num":1384,"application_name":"psql","backend_type":"client backend","query_id":0}
+`
+
+	got := assemble(t, &jsonAssembler{}, text)
+	if len(got) != 1 {
+		t.Fatalf("expected one record, got %d", len(got))
+	}
+
+	lr := got[0]
+	if lr.Pid != 4242 || lr.ELevel != elevelError || lr.UserQueryPos != 15 {
+		t.Errorf("fields not parsed: %s", lr.oneLine())
+	}
+
+	if *lr.FileErrPos != "parserOpenTable, parse_relation.c:1384" {
+		t.Errorf("unexpected location %q", *lr.FileErrPos)
+	}
+
+	if lr.ErrDetail != nil {
+		t.Errorf("absent key should be null, got %q", *lr.ErrDetail)
+	}
+}
+
+func TestCSVAssemblerUnbalancedQuote(t *testing.T) {
+	good := `2014-05-01 10:00:01.000 UTC,,,1,,a.b,1,,2014-05-01 09:59:50 UTC,,0,LOG,00000,"hello",,,,,,,,,""` + "\n"
+
+	asm := &csvAssembler{}
+	var got []logRecord
+	emit := func(lr *logRecord) { got = append(got, *lr) }
+
+	// A record cut short in a quoted field swallows those after
+	// it, up to the limit.
+	var malformed *malformedRecord
+	lines := []string{`2014-05-01 10:00:00.000 UTC,,,1,,a.b,1,,2014-05-01 09:59:50 UTC,,0,LOG,00000,"cut sh` + "\n"}
+	for n := 0; n < maxAssembledRecord/len(good)+1; n++ {
+		lines = append(lines, good)
+	}
+
+	for _, line := range lines {
+		if err := asm.addLine([]byte(line), emit); err != nil {
+			malformed = err.(*malformedRecord)
+			break
+		}
+	}
+
+	if malformed == nil || len(got) != 0 ||
+		!strings.HasSuffix(string(malformed.data), good) ||
+		len(malformed.data) <= maxAssembledRecord {
+		t.Fatalf("expected the whole record to be given up on, "+
+			"got %v and %d records", malformed, len(got))
+	}
+
+	// Lines are skipped until the next record begins.
+	if err := asm.addLine([]byte(`,,,"hello"`+"\n"), emit); err == nil {
+		t.Fatal("expected a line to be skipped while resynchronizing")
+	}
+
+	if got = assemble(t, asm, good); len(got) != 1 ||
+		*got[0].ErrMessage != "hello" {
+		t.Fatalf("assembler did not resynchronize: %v", got)
+	}
+}
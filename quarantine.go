@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// Once the quarantine file grows past this size it is
+	// renamed to quarantine.old, replacing any previous one, so
+	// that at most about twice this much disk is used.
+	quarantineMaxSize = 10 * MB
+
+	// Only this much of each bad record is dumped: enough to
+	// diagnose the problem, but not so much that a stream of
+	// huge records churns through the quarantine.
+	quarantineDumpLimit = 4 * KB
+)
+
+// All serves share the same quarantine file, so serialize writes to
+// it.
+var quarantineLock sync.Mutex
+
+func quarantinePath(dbDir string) string {
+	return path.Join(dbDir, "quarantine")
+}
+
+// Record a hex dump of a record that could not be processed normally
+// in the quarantine file of the serve database, so it can be
+// inspected later.
+//
+// Failures here are only logged: losing a quarantine entry is not
+// reason enough to stop processing logs.
+func quarantineRecord(sr *serveRecord, reason string, payload []byte) {
+	sr.stats().incr("quarantined")
+
+	dump := payload
+	if len(dump) > quarantineDumpLimit {
+		dump = dump[:quarantineDumpLimit]
+	}
+
+	entry := fmt.Sprintf("--- %s identity=%q path=%q size=%d reason=%q\n%s",
+		time.Now().UTC().Format(time.RFC3339), sr.I, sr.P,
+		len(payload), reason, hex.Dump(dump))
+	if len(dump) < len(payload) {
+		entry += fmt.Sprintf("(%d more bytes not shown)\n",
+			len(payload)-len(dump))
+	}
+
+	quarantineLock.Lock()
+	defer quarantineLock.Unlock()
+
+	qp := quarantinePath(sr.dbDir)
+	f, err := os.OpenFile(qp, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("could not open quarantine file %q: %v", qp, err)
+		return
+	}
+
+	_, err = f.WriteString(entry)
+	if err != nil {
+		log.Printf("could not write quarantine file %q: %v", qp, err)
+	}
+
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		log.Printf("could not stat quarantine file %q: %v", qp, err)
+		return
+	}
+
+	if fi.Size() > quarantineMaxSize {
+		if err := os.Rename(qp, qp+".old"); err != nil {
+			log.Printf("could not rotate quarantine file %q: %v",
+				qp, err)
+		}
+	}
+}
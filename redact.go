@@ -0,0 +1,336 @@
+// Redaction of what records say before it is sent anywhere, for
+// serves that may not ship query text as-is.  There are three modes,
+// any of which may be combined:
+//
+//     "passwords": mask string constants that follow the PASSWORD
+//     keyword, as in ALTER ROLE, and connection strings holding a
+//     password, as well as all parameter values logged with such
+//     statements.  The other modes imply this one.
+//
+//     "normalize": replace every constant in SQL with a $n
+//     placeholder, the way pg_stat_statements does, and the values
+//     of logged parameters with "?".
+//
+//     "scrub": replace whatever matches any of a list of regular
+//     expressions, by default ones for email addresses and card
+//     numbers.
+//
+// Query text is found in the query fields of records, and in messages
+// that quote it, such as those of log_statement and
+// log_min_duration_statement.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	redactPasswords = "passwords"
+	redactNormalize = "normalize"
+	redactScrub     = "scrub"
+
+	maskedString = "'********'"
+)
+
+type scrubRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+var defaultScrubRules = []scrubRule{
+	{regexp.MustCompile(
+		`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+		"[email]"},
+	{regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), "[card]"},
+}
+
+type redactor struct {
+	normalize bool
+	rules     []scrubRule
+}
+
+// Parse the "scrub_rules" of a serve record, a list of objects with a
+// regular expression as "pattern", and optionally what to replace
+// matches with as "replacement", in the form of
+// regexp.Regexp.Expand.
+func scrubRulesFromJSON(v interface{}) ([]scrubRule, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected list value for key " +
+			"(\"scrub_rules\") in serve record")
+	}
+
+	var rules []scrubRule
+	for _, elem := range list {
+		m, ok := elem.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected JSON map in " +
+				"\"scrub_rules\" list in serve record")
+		}
+
+		pattern, ok := m["pattern"].(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string \"pattern\" " +
+				"in \"scrub_rules\" in serve record")
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid \"pattern\" in "+
+				"\"scrub_rules\" in serve record: %v", err)
+		}
+
+		replacement := "[redacted]"
+		if r, ok := m["replacement"]; ok {
+			if replacement, ok = r.(string); !ok {
+				return nil, fmt.Errorf("expected string " +
+					"\"replacement\" in \"scrub_rules\" " +
+					"in serve record")
+			}
+		}
+
+		rules = append(rules, scrubRule{re: re, replacement: replacement})
+	}
+
+	return rules, nil
+}
+
+// Make a redactor for the given modes.  rules are only used by
+// "scrub", and if there are none, defaultScrubRules are.
+func newRedactor(modes []string, rules []scrubRule) (*redactor, error) {
+	r := &redactor{}
+
+	for _, mode := range modes {
+		switch mode {
+		case redactPasswords:
+		case redactNormalize:
+			r.normalize = true
+		case redactScrub:
+			r.rules = rules
+			if len(r.rules) == 0 {
+				r.rules = defaultScrubRules
+			}
+		default:
+			return nil, fmt.Errorf("unknown redaction mode %q, "+
+				"expected one of %q, %q, or %q", mode,
+				redactPasswords, redactNormalize, redactScrub)
+		}
+	}
+
+	return r, nil
+}
+
+// Redact the text fields of a record, returning whether anything was
+// changed.  The cursor positions of changed queries are cleared, as
+// they no longer mean anything.
+func (r *redactor) redactRecord(lr *logRecord) bool {
+	changed := false
+
+	credentials := isCredentialSQL(lr.UserQuery) ||
+		isCredentialSQL(lr.ErrMessage)
+
+	field := func(f **string, redact func(s string) string) {
+		if *f == nil {
+			return
+		}
+
+		s := redact(**f)
+		if s != **f {
+			*f = &s
+			changed = true
+		}
+	}
+
+	prose := func(s string) string {
+		return r.prose(s, credentials)
+	}
+
+	field(&lr.UserQuery, r.sql)
+	field(&lr.InternalQuery, r.sql)
+	field(&lr.ErrMessage, prose)
+	field(&lr.ErrDetail, prose)
+	field(&lr.ErrHint, prose)
+	field(&lr.ErrContext, prose)
+
+	if changed {
+		lr.UserQueryPos = 0
+		lr.InternalQueryPos = 0
+	}
+
+	return changed
+}
+
+// Redact the text of a message that is not broken into fields, such
+// as those received over syslog.
+func (r *redactor) redactText(s string) string {
+	return r.prose(s, false)
+}
+
+// Redact SQL.
+func (r *redactor) sql(q string) string {
+	return r.scrub(r.sqlOnly(q))
+}
+
+// Redact SQL, without applying scrubbing rules.
+func (r *redactor) sqlOnly(q string) string {
+	if r.normalize {
+		return normalizeSQL(q)
+	}
+
+	return maskPasswords(q)
+}
+
+// Messages that quote SQL, or its parameters.  Any statement runs to
+// the end of the message, except in the details of deadlocks, where
+// each runs to the end of its line.
+var (
+	sqlInMessage = regexp.MustCompile(
+		`\b(?:statement|(?:execute|parse|bind) [^\s:]+): `)
+	sqlInContext    = regexp.MustCompile(`(?m)^SQL statement "(.*)"$`)
+	sqlInDeadlock   = regexp.MustCompile(`(?m)^(\s*Process \d+: )(.*)$`)
+	paramsInMessage = regexp.MustCompile(`\bparameters: `)
+)
+
+// Redact text that may quote SQL.  With credentials, the text goes
+// with a statement that sets a password, and parameter values are
+// masked no matter the mode.
+func (r *redactor) prose(s string, credentials bool) string {
+	if loc := sqlInMessage.FindStringIndex(s); loc != nil {
+		s = s[:loc[1]] + r.sqlOnly(s[loc[1]:])
+	}
+
+	s = sqlInContext.ReplaceAllStringFunc(s, func(m string) string {
+		inner := sqlInContext.FindStringSubmatch(m)[1]
+		return `SQL statement "` + r.sqlOnly(inner) + `"`
+	})
+
+	s = sqlInDeadlock.ReplaceAllStringFunc(s, func(m string) string {
+		sub := sqlInDeadlock.FindStringSubmatch(m)
+		return sub[1] + r.sqlOnly(sub[2])
+	})
+
+	if r.normalize || credentials {
+		if loc := paramsInMessage.FindStringIndex(s); loc != nil {
+			s = s[:loc[1]] + replaceLiterals(s[loc[1]:],
+				func() string { return "?" })
+		}
+	}
+
+	return r.scrub(s)
+}
+
+func (r *redactor) scrub(s string) string {
+	for _, rule := range r.rules {
+		s = rule.re.ReplaceAllString(s, rule.replacement)
+	}
+
+	return s
+}
+
+// Replace every constant in q, numbering each with placeholders after
+// the highest numbered one already in it.
+func normalizeSQL(q string) string {
+	n := 0
+	lexSQL(q, func(tok sqlToken) {
+		if tok.kind == sqlParam {
+			i, err := strconv.Atoi(q[tok.start+1 : tok.end])
+			if err == nil && i > n {
+				n = i
+			}
+		}
+	})
+
+	return replaceLiterals(q, func() string {
+		n++
+		return "$" + strconv.Itoa(n)
+	})
+}
+
+// Replace every string and numeric constant in q with what
+// replacement returns.
+func replaceLiterals(q string, replacement func() string) string {
+	return rewriteSQL(q, func(tok sqlToken) (string, bool) {
+		if tok.kind == sqlString || tok.kind == sqlNumber {
+			return replacement(), true
+		}
+
+		return "", false
+	})
+}
+
+// Replace the tokens of q for which rewrite returns true with the
+// text it returns.
+func rewriteSQL(q string, rewrite func(tok sqlToken) (string, bool)) string {
+	var b bytes.Buffer
+	last := 0
+	changed := false
+
+	lexSQL(q, func(tok sqlToken) {
+		if text, ok := rewrite(tok); ok {
+			b.WriteString(q[last:tok.start])
+			b.WriteString(text)
+			last = tok.end
+			changed = true
+		}
+	})
+
+	if !changed {
+		return q
+	}
+
+	b.WriteString(q[last:])
+	return b.String()
+}
+
+// Connection strings, as given to dblink or CREATE SUBSCRIPTION,
+// that include a password.
+var connStringPassword = regexp.MustCompile(`(?i)\bpassword\s*=`)
+
+func isPasswordKeyword(q string, tok sqlToken) bool {
+	return tok.kind == sqlIdent &&
+		strings.EqualFold(q[tok.start:tok.end], "password")
+}
+
+// Mask the string constants in q that hold passwords: those after the
+// PASSWORD keyword, and connection strings with passwords in them.
+func maskPasswords(q string) string {
+	afterPassword := false
+
+	return rewriteSQL(q, func(tok sqlToken) (string, bool) {
+		if tok.kind == sqlSpace || tok.kind == sqlComment {
+			return "", false
+		}
+
+		mask := tok.kind == sqlString && (afterPassword ||
+			connStringPassword.MatchString(q[tok.start:tok.end]))
+		afterPassword = isPasswordKeyword(q, tok)
+
+		return maskedString, mask
+	})
+}
+
+// Whether s mentions the PASSWORD keyword outside of any constant,
+// comment, or quoted identifier.
+func isCredentialSQL(s *string) bool {
+	if s == nil {
+		return false
+	}
+
+	found := false
+	lexSQL(*s, func(tok sqlToken) {
+		if isPasswordKeyword(*s, tok) {
+			found = true
+		}
+	})
+
+	return found
+}
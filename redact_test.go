@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{`SELECT * FROM t WHERE a = 'x' AND b > 10`,
+			`SELECT * FROM t WHERE a = $1 AND b > $2`},
+		{`SELECT $1, E'it\'s', $body$ 'quoted' $body$, t2.c`,
+			`SELECT $1, $2, $3, t2.c`},
+		{`SELECT "col 1" FROM t -- 'not a string'`,
+			`SELECT "col 1" FROM t -- 'not a string'`},
+	} {
+		if got := normalizeSQL(tt.in); got != tt.want {
+			t.Errorf("normalizing %q: expected %q, got %q",
+				tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestMaskPasswords(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{`ALTER ROLE bob WITH ENCRYPTED PASSWORD 'hunter2' VALID UNTIL 'infinity'`,
+			`ALTER ROLE bob WITH ENCRYPTED PASSWORD '********' VALID UNTIL 'infinity'`},
+		{`CREATE USER MAPPING FOR bob SERVER s OPTIONS (user 'bob', password /* x */ 'y')`,
+			`CREATE USER MAPPING FOR bob SERVER s OPTIONS (user 'bob', password /* x */ '********')`},
+		{`SELECT dblink_connect('host=h password=secret')`,
+			`SELECT dblink_connect('********')`},
+		{`SELECT 'password'`, `SELECT 'password'`},
+	} {
+		if got := maskPasswords(tt.in); got != tt.want {
+			t.Errorf("masking %q: expected %q, got %q",
+				tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestRedactRecord(t *testing.T) {
+	r, err := newRedactor([]string{redactPasswords, redactScrub}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lr := sampleRecord
+	lr.ErrMessage = strp("execute <unnamed>: ALTER ROLE bob PASSWORD $1")
+	lr.ErrDetail = strp("parameters: $1 = 'hunter2'")
+	lr.UserQuery = strp("SELECT * FROM users WHERE email = 'bob@example.com'")
+
+	if !r.redactRecord(&lr) {
+		t.Fatal("expected record to be redacted")
+	}
+
+	if *lr.ErrDetail != "parameters: $1 = ?" {
+		t.Errorf("unexpected detail %q", *lr.ErrDetail)
+	}
+
+	if *lr.UserQuery != "SELECT * FROM users WHERE email = '[email]'" {
+		t.Errorf("unexpected query %q", *lr.UserQuery)
+	}
+
+	if lr.UserQueryPos != 0 {
+		t.Errorf("query position should be cleared")
+	}
+
+	r, err = newRedactor([]string{redactNormalize}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := "duration: 1.5 ms  statement: SELECT 1 FROM t WHERE x = 'y'"
+	if got := r.redactText(msg); got !=
+		"duration: 1.5 ms  statement: SELECT $1 FROM t WHERE x = $2" {
+		t.Errorf("unexpected redaction %q", got)
+	}
+
+	ctx := "SQL statement \"UPDATE t SET v = 42\"\nPL/pgSQL function f() line 3"
+	if got := r.redactText(ctx); got !=
+		"SQL statement \"UPDATE t SET v = $1\"\nPL/pgSQL function f() line 3" {
+		t.Errorf("unexpected redaction %q", got)
+	}
+
+	detail := "Process 1 waits for ShareLock on transaction 2; " +
+		"blocked by process 3.\nProcess 1: UPDATE t SET v = 42;"
+	if got := r.redactText(detail); got != "Process 1 waits for "+
+		"ShareLock on transaction 2; blocked by process 3.\n"+
+		"Process 1: UPDATE t SET v = $1;" {
+		t.Errorf("unexpected redaction %q", got)
+	}
+
+	if _, err := newRedactor([]string{"everything"}, nil); err == nil {
+		t.Error("expected unknown mode to be rejected")
+	}
+}
+
+func TestScrubRulesFromJSON(t *testing.T) {
+	rules, err := scrubRulesFromJSON([]interface{}{
+		map[string]interface{}{"pattern": `ssn=(\d+)`,
+			"replacement": "ssn=[ssn]"},
+		map[string]interface{}{"pattern": `secret`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newRedactor([]string{redactScrub}, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.redactText("ssn=123 secret"); got != "ssn=[ssn] [redacted]" {
+		t.Errorf("unexpected scrubbing %q", got)
+	}
+
+	for _, bad := range []interface{}{
+		"not a list",
+		[]interface{}{"not a map"},
+		[]interface{}{map[string]interface{}{"pattern": "("}},
+		[]interface{}{map[string]interface{}{"replacement": "x"}},
+	} {
+		if _, err := scrubRulesFromJSON(bad); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Detection of records lost between Postgres and the collector.
+// Every record of a session is numbered in turn, as session_line_num
+// (%l in log_line_prefix) is, so a skip in the numbers of a session
+// means records were dropped on the way, such as by pg_logfebe when
+// it cannot keep up, and a number that goes back means the numbering
+// started over.
+//
+// Serves with "gap_markers" set also get a record in place of those
+// lost, saying how many they were:
+//
+//     12 log lines lost
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The most sessions whose numbering is tracked for a connection or
+// file at once.  Sessions not seen for the longest are forgotten
+// first, after which their next record is taken as a first one.
+const maxTrackedSessions = 10000
+
+// The last numbers of the records of sessions, over one connection or
+// log file.
+type seqTracker struct {
+	last *lruCache
+}
+
+func newSeqTracker() *seqTracker {
+	return &seqTracker{last: newLRUCache(maxTrackedSessions, nil)}
+}
+
+// Account for the number of a record, returning how many records of
+// its session were skipped since the last one seen, and whether its
+// numbering started over.
+func (t *seqTracker) observe(lr *logRecord, now time.Time) (int64, bool) {
+	if lr.SessionID == "" || lr.SeqNum == 0 {
+		return 0, false
+	}
+
+	// Records folded from several lines of a log file end on the
+	// number of their last.
+	end := lr.SeqNum
+	if lr.lastSeqNum > end {
+		end = lr.lastSeqNum
+	}
+
+	key := fmt.Sprintf("%s/%d", lr.SessionID, lr.Pid)
+	v, ok := t.last.get(key, now)
+	t.last.put(key, end, now)
+
+	if !ok {
+		return 0, false
+	}
+
+	last := v.(int64)
+	switch {
+	case lr.SeqNum <= last:
+		return 0, true
+	case lr.SeqNum > last+1:
+		return lr.SeqNum - last - 1, false
+	}
+
+	return 0, false
+}
+
+// Check a record for records lost before it, counting them, and for
+// serves that ask for them, sending a marker in their place.
+func checkSeq(t *seqTracker, lr *logRecord, clients *serveClients,
+	sr *serveRecord, exit exitFn) {
+	lost, restarted := t.observe(lr, time.Now())
+
+	if restarted {
+		sr.stats().incr("seq_restarts")
+	}
+
+	if lost == 0 {
+		return
+	}
+
+	sr.stats().incr("seq_gaps")
+	sr.stats().add("lines_lost", uint64(lost))
+
+	if !sr.gapMarkers {
+		return
+	}
+
+	msg := fmt.Sprintf("%d log lines lost", lost)
+	marker := &logRecord{
+		LogTime:         lr.LogTime,
+		UserName:        lr.UserName,
+		DatabaseName:    lr.DatabaseName,
+		Pid:             lr.Pid,
+		ClientAddr:      lr.ClientAddr,
+		SessionID:       lr.SessionID,
+		SeqNum:          lr.SeqNum - 1,
+		SessionStart:    lr.SessionStart,
+		ELevel:          elevelWarning,
+		ErrMessage:      &msg,
+		ApplicationName: lr.ApplicationName,
+	}
+
+	emitLogRecord(marker, sr, clients.primary, false, nil, exit)
+}
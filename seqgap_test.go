@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	var evicted []string
+	c := newLRUCache(2, func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	})
+
+	start := time.Date(2014, 5, 1, 10, 0, 0, 0, time.UTC)
+	c.put("a", 1, start)
+	c.put("b", 2, start.Add(time.Second))
+
+	// Using "a" leaves "b" the least recently used.
+	if v, ok := c.get("a", start.Add(2*time.Second)); !ok || v != 1 {
+		t.Fatalf("unexpected value %v", v)
+	}
+
+	c.put("c", 3, start.Add(3*time.Second))
+	if !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Fatalf("unexpected evictions %v", evicted)
+	}
+
+	c.expire(start.Add(3 * time.Second))
+	if !reflect.DeepEqual(evicted, []string{"b", "a"}) || c.len() != 1 {
+		t.Fatalf("unexpected evictions %v", evicted)
+	}
+
+	if v, ok := c.remove("c"); !ok || v != 3 || c.len() != 0 {
+		t.Fatalf("unexpected removal %v", v)
+	}
+
+	if len(evicted) != 2 {
+		t.Fatalf("removal should not evict, got %v", evicted)
+	}
+}
+
+func TestSeqTracker(t *testing.T) {
+	tr := newSeqTracker()
+	now := time.Now()
+
+	lr := sampleRecord
+	for _, tc := range []struct {
+		seq       int64
+		lost      int64
+		restarted bool
+	}{
+		{seq: 7},
+		{seq: 8},
+		{seq: 12, lost: 3},
+		{seq: 13},
+		{seq: 1, restarted: true},
+		{seq: 2},
+	} {
+		lr.SeqNum = tc.seq
+		lost, restarted := tr.observe(&lr, now)
+		if lost != tc.lost || restarted != tc.restarted {
+			t.Errorf("at %d: got %d lost and restart %v, want %d "+
+				"and %v", tc.seq, lost, restarted, tc.lost,
+				tc.restarted)
+		}
+	}
+
+	// Other sessions are numbered on their own.
+	other := sampleRecord
+	other.SessionID = "5362197c.4d3"
+	other.SeqNum = 100
+	if lost, _ := tr.observe(&other, now); lost != 0 {
+		t.Errorf("unexpected loss %d in new session", lost)
+	}
+}
+
+func TestSeqTrackerFoldedLines(t *testing.T) {
+	p, err := newPrefixLineParser("%m [%p] %c %l ", "")
+	if err != nil {
+		t.Fatalf("could not compile prefix: %v", err)
+	}
+
+	// The STATEMENT line takes a number of its own, which is not
+	// lost for being folded into the record before it.
+	text := "2014-05-01 10:00:00.123 UTC [4242] 5362197c.1092 5 ERROR:  relation \"nope\" does not exist\n" +
+		"2014-05-01 10:00:00.123 UTC [4242] 5362197c.1092 6 DETAIL:  none\n" +
+		"2014-05-01 10:00:00.123 UTC [4242] 5362197c.1092 7 STATEMENT:  SELECT * FROM nope;\n" +
+		"2014-05-01 10:00:01.000 UTC [4242] 5362197c.1092 8 LOG:  duration: 1.000 ms\n" +
+		"2014-05-01 10:00:02.000 UTC [4242] 5362197c.1092 10 LOG:  duration: 2.000 ms\n" +
+		"2014-05-01 10:00:03.000 UTC [4100] 5362197a.1004 1 LOG:  checkpoint starting: time\n"
+
+	got := assemble(t, &lineAssembler{p: p}, text)
+	if len(got) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(got))
+	}
+
+	tr := newSeqTracker()
+	now := time.Now()
+	for i, want := range []int64{0, 0, 1} {
+		if lost, _ := tr.observe(&got[i], now); lost != want {
+			t.Errorf("record %d: got %d lost, want %d", i, lost, want)
+		}
+	}
+}
@@ -11,10 +11,13 @@
 // this:
 //
 //     servedb
+//     ├── checkpoints/
 //     ├── last_error
+//     ├── quarantine
 //     ├── serves.loaded
 //     ├── serves.new
-//     └── serves.rej
+//     ├── serves.rej
+//     └── stats
 //
 // The general idea is that another program may rename() (for
 // atomicity) a new serve file into serves.new.  Subsequently, any
@@ -54,13 +57,151 @@
 //       ]
 //     }
 //
+// Serve records may also carry optional keys:
+//
+//     "protocol": how logs are received at "p".  "logfebe", the
+//     default, listens on a unix socket for pg_logfebe.  "syslog"
+//     listens on a unix datagram socket, "syslog-stream" on a unix
+//     stream socket, and "syslog-tcp" and "syslog-tls" on a TCP
+//     address, the latter with the certificate and key in the files
+//     named by "tls_cert" and "tls_key".  "logfile" tails a file of
+//     lines.  "csvlog" and "jsonlog" tail a file written by Postgres
+//     with that log_destination, handling its records just like
+//     those from pg_logfebe.
+//
+//     "syslog_sequence_numbers": for syslog protocols, whether
+//     Postgres numbers its messages, as its setting of the same name
+//     does by default.  Numbered messages are marked "[n] ", or
+//     "[n-m] " for fragments; unnumbered fragments "[m] ".
+//
+//     "start": for protocols that tail files, where to start reading
+//     a file seen for the first time: "beginning", "end", or
+//     "checkpoint", the default, which resumes from the position
+//     recorded in the checkpoints directory of the serve database,
+//     or starts at the end without one.
+//
+//     "line_regex", "log_line_prefix", "continuation": for the
+//     logfile protocol, how to parse lines into records, either with
+//     a regular expression with named groups, or according to a
+//     Postgres log_line_prefix setting, and which lines continue the
+//     record before them.  See lineparser.go.
+//
+//     "app": the application name records are sent with, by default
+//     "postgres", or "redis" for logfile without a parser.
+//
+//     "name": a human readable name, prefixed to formatted records.
+//
+//     "tolerant": when true, malformed records are written to the
+//     quarantine file and skipped, and oversized ones are truncated,
+//     rather than disconnecting the client.
+//
+//     "compression", "compression_level", "compression_threshold":
+//     compress requests with Content-Encoding "gzip" or "deflate", at
+//     a level from 1 to 9, when they are at least the threshold in
+//     bytes (1024 by default).
+//
+//     "request_size_trigger", "concurrency", "period",
+//     "time_trigger": how records are batched into requests.  A
+//     request is made once request_size_trigger bytes (100KB by
+//     default) are buffered, and, when time_trigger is "periodic"
+//     (the default), every period, a Go duration such as "250ms"
+//     (the default); "immediate" makes a request for every record,
+//     and "never" only when enough bytes are buffered, or for what
+//     remains once the client is retired, as on reloads and when
+//     connections close.  Up to
+//     concurrency (3 by default) requests are outstanding at once;
+//     records beyond that are dropped.
+//
+//     "redact", "scrub_rules": one or a list of "passwords",
+//     "normalize", and "scrub", to redact records before sending
+//     them, and for "scrub", a list of {"pattern": ...,
+//     "replacement": ...} objects.  See redact.go.
+//
+//     "statement_stats", "statement_stats_interval",
+//     "statement_stats_top": when true, aggregate the durations of
+//     logged statements by fingerprint, sending the top ones (20 by
+//     default) every interval (by default "1m").  See statements.go.
+//
+//     "format": "text", the default, or "json", how records are
+//     formatted.  See output.go.
+//
+//     "template": for the "text" format, "legacy", the default,
+//     "logfmt", "stderr", or a Go text/template to render records
+//     with.  See template.go.
+//
+//     "line_policy", "max_frame_size": for the "text" format, how
+//     records with many lines are sent: "keep", the default, as they
+//     are, "escape" on one line with newlines escaped, "split" as a
+//     frame per line, marked as parts of one record, or "truncate";
+//     and the most bytes in a frame (by default 8KB for "split" and
+//     "truncate", and no limit otherwise).  See frames.go.
+//
+//     "metrics": when true, metrics derived from records, such as
+//     those of autovacuum and checkpoints, are sent to "url" too.
+//     See metrics.go and extract.go.
+//
+//     "lock_events": where to send events about lock waits and
+//     deadlocks: "primary", "audit", or another URL.  See locks.go,
+//     events.go, and destinations.go.
+//
+//     "connection_events", "auth_failure_threshold",
+//     "auth_failure_window": where to send events about connections,
+//     disconnections, and failures to authenticate, as for
+//     "lock_events", in place of the text records otherwise sent to
+//     "audit" about connections.  A brute_force_suspected event is
+//     sent when a client address fails to authenticate threshold
+//     times (10 by default, 0 for never) within the window (by
+//     default "1m").  See connections.go.
+//
+//     "ddl_events": where to send events about statements that
+//     change schemas or privileges, as logged with log_statement, as
+//     for "lock_events".  See ddl.go.
+//
+//     "gap_markers": when true, a record saying how many records of
+//     a session were lost is sent in their place.  See seqgap.go.
+//
+//     "session_summaries", "session_idle_timeout": where to send a
+//     summary of every session when it disconnects, or when nothing
+//     is heard of it for the timeout (by default "30m"), as for
+//     "lock_events".  See sessions.go.
+//
+//     "lifecycle_events": where to send events about the server
+//     starting up, recovering, accepting connections, crashing, and
+//     shutting down, as for "lock_events", in place of "audit", or
+//     "url" without one.  See lifecycle.go.
+//
+//     "audit_sqlstates": a list of SQLSTATE codes, classes, and
+//     condition names of records to send to "audit" as well as
+//     "url", by default those of system_error, config_file_error,
+//     and internal_error.  See sqlstate.go.
+//
+//     "encoding", "encoding_errors", "detect_invalid_utf8": the
+//     server_encoding of the server, such as "LATIN1" or "EUC_JP",
+//     to transcode records from to UTF-8, and what to do with
+//     sequences invalid in it: "replace", the default, "escape", or
+//     "drop"; and for serves without an encoding, when true, whether
+//     to count records that are not valid UTF-8.  See encoding.go.
+//
+//     "labels", "enrich": an object of static labels saying where
+//     records come from, such as {"cluster": "main", "region":
+//     "us-east-1"}, and when true, labels for the host and instance
+//     of the collector and the version of Postgres, sent with every
+//     record and event.  See labels.go.
+//
 // Any other auxiliary keys and values as siblings to the "serves" key
 // are acceptable, and recommended for use for bookkeeping in other
 // programs.
+//
+// pg_logplexcollector also writes some files of its own for other
+// programs to read: "stats", which holds running counters for each
+// serve, "quarantine", which holds hex dumps of records that could
+// not be processed, and "checkpoints", which holds the positions
+// reached in tailed files.
 
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -68,6 +209,19 @@ import (
 	"os"
 	"path"
 	"sync"
+	"text/template"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+// Defaults and limits for how serves batch records into requests.
+const (
+	defaultRequestSizeTrigger = 100 * KB
+	maxRequestSizeTrigger     = 1 * MB
+	defaultConcurrency        = 3
+	maxConcurrency            = 64
+	defaultPeriod             = time.Second / 4
 )
 
 type sKey struct {
@@ -83,6 +237,142 @@ type serveRecord struct {
 
 	// Auxiliary fields for formatting
 	Name string
+
+	// Directory of the serve database the record was loaded
+	// from, where per-serve state like quarantined records is
+	// kept.
+	dbDir string
+
+	// Skip or truncate malformed records rather than
+	// disconnecting the client.
+	tolerant bool
+
+	// For protocols that tail files, where to start reading a
+	// file: one of startBeginning, startEnd, or startCheckpoint.
+	start string
+
+	// For the logfile protocol, how to turn lines into records.
+	// When nil, the original redis-oriented parsing is used.
+	lineParser *lineParser
+
+	// Application name to send records with, when not the
+	// default for the protocol.
+	app string
+
+	// For syslog-tls, the files holding the certificate and key
+	// to present to clients.
+	tlsCert string
+	tlsKey  string
+
+	// For syslog protocols, whether Postgres numbers its messages,
+	// as with syslog_sequence_numbers.
+	syslogSequenceNumbers bool
+
+	// Content-Encoding to compress requests with, if any, and at
+	// what level, skipping bodies smaller than the threshold.
+	compression          string
+	compressionLevel     int
+	compressionThreshold int
+
+	// How records are batched into requests: once this many bytes
+	// are buffered, or according to the time trigger, with up to
+	// concurrency requests outstanding at a time.
+	requestSizeTrigger int
+	concurrency        int
+	period             time.Duration
+	timeTrigger        logplexc.TimeTriggerBehavior
+
+	// Redacts records before they are sent, or nil to send them
+	// as they are.
+	redactor *redactor
+
+	// Whether to keep statistics on logged statements, and how
+	// often to send them, and about how many fingerprints.
+	statementStats         bool
+	statementStatsInterval time.Duration
+	statementStatsTop      int
+
+	// How records are formatted for sending, formatText or
+	// formatJSON, and whether metrics derived from them are sent
+	// too.
+	format  string
+	metrics bool
+
+	// Where to send events about lock waits and deadlocks, as for
+	// parseDestination, or nowhere if empty.
+	lockEvents string
+
+	// Where to send events about connections, as for lockEvents,
+	// and when to suspect brute force: after authFailureThreshold
+	// failures from one address within authFailureWindow, or
+	// never if the threshold is 0.
+	connectionEvents     string
+	authFailureThreshold int
+	authFailureWindow    time.Duration
+
+	// Where to send events about changes to schemas and
+	// privileges, as for lockEvents.
+	ddlEvents string
+
+	// Whether to send a record in place of those found to be
+	// lost.  See seqgap.go.
+	gapMarkers bool
+
+	// Where to send summaries of sessions, as for lockEvents, and
+	// how long a session may go unheard from before it is
+	// summarized anyway.  See sessions.go.
+	sessionSummaries   string
+	sessionIdleTimeout time.Duration
+
+	// Where to send events about the lifecycle of the server, as
+	// for lockEvents, or if empty, to the audit URL or the primary
+	// one.
+	lifecycleEvents string
+
+	// Rules for the SQLSTATEs of records to send to the audit
+	// URL as well.  See sqlstate.go.
+	auditSQLStates []string
+
+	// How records are rendered in the text format, or nil for the
+	// legacy format.  See template.go.
+	template *template.Template
+
+	// How records are framed for drains, and the most bytes in a
+	// frame, or 0 for no limit.  See frames.go.
+	linePolicy   string
+	maxFrameSize int
+
+	// Static labels of the serve, as given and as rendered by
+	// setLabels, and whether to add those of the collector and
+	// server to them.  See labels.go.
+	labels   map[string]string
+	labelSet labelSet
+	enrich   bool
+
+	// The encoding to transcode records from, or nil to leave
+	// them be, what to do with invalid sequences, and whether to
+	// count records with invalid UTF-8 otherwise.  See encoding.go.
+	encoding          *charset
+	encodingErrors    string
+	detectInvalidUTF8 bool
+}
+
+// The application name records of the serve are sent with.
+func (sr *serveRecord) appName() string {
+	switch {
+	case sr.app != "":
+		return sr.app
+	case sr.protocol == "logfile" && sr.lineParser == nil:
+		return "redis"
+	}
+
+	return "postgres"
+}
+
+// What records sent to the audit URL begin with: the audit endpoint
+// may be multiplexed, so add the identity to help tell them apart.
+func (sr *serveRecord) auditHeader() string {
+	return "instance_type=shogun identity=" + sr.I + " "
 }
 
 type serveDb struct {
@@ -339,6 +629,34 @@ func (t *serveDb) persistLoaded(contents []byte) (err error) {
 	return nil
 }
 
+// Replace the file at dst with contents via a temporary file and a
+// rename, so readers never see a partially written file.
+//
+// Unlike persistLoaded, nothing is flushed to disk, so this is only
+// suitable for files that are frequently re-written anyway.
+func replaceFile(dst string, contents []byte) error {
+	tempf, err := ioutil.TempFile(path.Dir(dst), "tmp_")
+	if err != nil {
+		return err
+	}
+
+	_, err = tempf.Write(contents)
+	if e := tempf.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(tempf.Name(), dst)
+	}
+
+	if err != nil {
+		os.Remove(tempf.Name())
+		return err
+	}
+
+	return nil
+}
+
 func (t *serveDb) reject(submitPath string, nonfatale error) (err error) {
 	// Perform move to the rejection file
 	err = os.Rename(submitPath, t.rejPath())
@@ -384,6 +702,39 @@ func projectFromJSON(v interface{}) (*serveRecord, error) {
 		return s, nil
 	}
 
+	// Optional boolean fields are false when not present.
+	lookupBool := func(key string) (bool, error) {
+		mb, ok := maybeMap[key]
+		if !ok {
+			return false, nil
+		}
+
+		b, ok := mb.(bool)
+		if !ok {
+			return false, fmt.Errorf("expected boolean value for key "+
+				"(\"%s\") key in serve record", key)
+		}
+
+		return b, nil
+	}
+
+	// Optional integer fields are def when not present.
+	lookupInt := func(key string, def int) (int, error) {
+		mn, ok := maybeMap[key]
+		if !ok {
+			return def, nil
+		}
+
+		// encoding/json produces float64 for all numbers.
+		f, ok := mn.(float64)
+		if !ok || f != float64(int(f)) {
+			return 0, fmt.Errorf("expected integer value for key "+
+				"(\"%s\") key in serve record", key)
+		}
+
+		return int(f), nil
+	}
+
 	path, err := lookup("p")
 	if err != nil {
 		return nil, err
@@ -434,8 +785,486 @@ func projectFromJSON(v interface{}) (*serveRecord, error) {
 	// Optional fields: okay to not explode if not present.
 	name, _ := lookup("name")
 
-	return &serveRecord{sKey: sKey{P: path, I: ident},
-		u: *u, audit: audit, protocol: proto, Name: name}, nil
+	tolerant, err := lookupBool("tolerant")
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := lookup("start")
+	if err != nil {
+		start = startCheckpoint
+	}
+
+	switch start {
+	case startBeginning, startEnd, startCheckpoint:
+	default:
+		return nil, fmt.Errorf("unknown \"start\" value %q in serve "+
+			"record, expected one of %q, %q, or %q", start,
+			startBeginning, startEnd, startCheckpoint)
+	}
+
+	lp, err := func() (*lineParser, error) {
+		continuation, _ := lookup("continuation")
+		lineRegex, regexErr := lookup("line_regex")
+		linePrefix, prefixErr := lookup("log_line_prefix")
+
+		switch {
+		case regexErr == nil && prefixErr == nil:
+			return nil, fmt.Errorf("serve record may have only " +
+				"one of \"line_regex\" and \"log_line_prefix\"")
+		case regexErr == nil:
+			return newLineParser(lineRegex, continuation)
+		case prefixErr == nil:
+			return newPrefixLineParser(linePrefix, continuation)
+		}
+
+		return nil, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	app, _ := lookup("app")
+
+	var tlsCert, tlsKey string
+	if proto == "syslog-tls" {
+		if tlsCert, err = lookup("tls_cert"); err != nil {
+			return nil, err
+		}
+
+		if tlsKey, err = lookup("tls_key"); err != nil {
+			return nil, err
+		}
+	}
+
+	// On by default, as in Postgres.
+	syslogSequenceNumbers := true
+	if _, ok := maybeMap["syslog_sequence_numbers"]; ok {
+		syslogSequenceNumbers, err = lookupBool(
+			"syslog_sequence_numbers")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	compression, _ := lookup("compression")
+	if compression != "" && !validCompression(compression) {
+		return nil, fmt.Errorf("unknown \"compression\" value %q in "+
+			"serve record, expected \"gzip\" or \"deflate\"",
+			compression)
+	}
+
+	compressionLevel, err := lookupInt("compression_level",
+		gzip.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if compressionLevel != gzip.DefaultCompression &&
+		(compressionLevel < gzip.BestSpeed ||
+			compressionLevel > gzip.BestCompression) {
+		return nil, fmt.Errorf("\"compression_level\" in serve "+
+			"record must be between %d and %d, got %d",
+			gzip.BestSpeed, gzip.BestCompression, compressionLevel)
+	}
+
+	compressionThreshold, err := lookupInt("compression_threshold",
+		defaultCompressionThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if compressionThreshold < 0 {
+		return nil, fmt.Errorf("\"compression_threshold\" in serve "+
+			"record must not be negative, got %d",
+			compressionThreshold)
+	}
+
+	batching, err := func() (rec serveRecord, err error) {
+		rec.requestSizeTrigger, err = lookupInt("request_size_trigger",
+			defaultRequestSizeTrigger)
+		if err != nil {
+			return rec, err
+		}
+
+		if rec.requestSizeTrigger < 1 ||
+			rec.requestSizeTrigger > maxRequestSizeTrigger {
+			return rec, fmt.Errorf("\"request_size_trigger\" in "+
+				"serve record must be between 1 and %d, got %d",
+				maxRequestSizeTrigger, rec.requestSizeTrigger)
+		}
+
+		rec.concurrency, err = lookupInt("concurrency",
+			defaultConcurrency)
+		if err != nil {
+			return rec, err
+		}
+
+		if rec.concurrency < 1 || rec.concurrency > maxConcurrency {
+			return rec, fmt.Errorf("\"concurrency\" in serve "+
+				"record must be between 1 and %d, got %d",
+				maxConcurrency, rec.concurrency)
+		}
+
+		rec.period = defaultPeriod
+		if periodText, err := lookup("period"); err == nil {
+			rec.period, err = time.ParseDuration(periodText)
+			if err != nil {
+				return rec, fmt.Errorf("invalid \"period\" in "+
+					"serve record: %v", err)
+			}
+
+			if rec.period <= 0 {
+				return rec, fmt.Errorf("\"period\" in serve "+
+					"record must be positive, got %v",
+					rec.period)
+			}
+		}
+
+		trigger, err := lookup("time_trigger")
+		if err != nil {
+			trigger = "periodic"
+		}
+
+		switch trigger {
+		case "periodic":
+			rec.timeTrigger = logplexc.TimeTriggerPeriodic
+		case "immediate":
+			rec.timeTrigger = logplexc.TimeTriggerImmediate
+		case "never":
+			rec.timeTrigger = logplexc.TimeTriggerNever
+		default:
+			return rec, fmt.Errorf("unknown \"time_trigger\" value "+
+				"%q in serve record, expected one of "+
+				"\"periodic\", \"immediate\", or \"never\"",
+				trigger)
+		}
+
+		return rec, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	redactor, err := func() (*redactor, error) {
+		var modes []string
+		switch v := maybeMap["redact"].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			modes = []string{v}
+		case []interface{}:
+			for _, mode := range v {
+				s, ok := mode.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected string " +
+						"values in \"redact\" list in " +
+						"serve record")
+				}
+
+				modes = append(modes, s)
+			}
+		default:
+			return nil, fmt.Errorf("expected string or list value " +
+				"for key (\"redact\") in serve record")
+		}
+
+		rules, err := scrubRulesFromJSON(maybeMap["scrub_rules"])
+		if err != nil {
+			return nil, err
+		}
+
+		return newRedactor(modes, rules)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	auditSQLStates := defaultAuditSQLStates
+	if v, ok := maybeMap["audit_sqlstates"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected list value for key " +
+				"(\"audit_sqlstates\") in serve record")
+		}
+
+		auditSQLStates = nil
+		for _, elem := range list {
+			rule, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected string values " +
+					"in \"audit_sqlstates\" list in serve record")
+			}
+
+			if err := parseSQLStateRule("audit_sqlstates",
+				rule); err != nil {
+				return nil, err
+			}
+
+			auditSQLStates = append(auditSQLStates, rule)
+		}
+	}
+
+	var labels map[string]string
+	if v, ok := maybeMap["labels"]; ok {
+		if labels, err = parseLabels(v); err != nil {
+			return nil, err
+		}
+	}
+
+	enrich, err := lookupBool("enrich")
+	if err != nil {
+		return nil, err
+	}
+
+	var encoding *charset
+	if name, err := lookup("encoding"); err == nil {
+		if encoding, err = lookupCharset(name); err != nil {
+			return nil, err
+		}
+	}
+
+	encodingErrors, err := lookup("encoding_errors")
+	if err != nil {
+		encodingErrors = encodingErrorsReplace
+	}
+
+	if !validEncodingErrors(encodingErrors) {
+		return nil, fmt.Errorf("unknown \"encoding_errors\" value "+
+			"%q in serve record, expected %q, %q, or %q",
+			encodingErrors, encodingErrorsReplace,
+			encodingErrorsEscape, encodingErrorsDrop)
+	}
+
+	detectInvalidUTF8, err := lookupBool("detect_invalid_utf8")
+	if err != nil {
+		return nil, err
+	}
+
+	statementStats, err := lookupBool("statement_stats")
+	if err != nil {
+		return nil, err
+	}
+
+	statementStatsInterval := defaultStatementStatsInterval
+	if text, err := lookup("statement_stats_interval"); err == nil {
+		statementStatsInterval, err = time.ParseDuration(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid "+
+				"\"statement_stats_interval\" in serve "+
+				"record: %v", err)
+		}
+
+		if statementStatsInterval < time.Second {
+			return nil, fmt.Errorf("\"statement_stats_interval\" "+
+				"in serve record must be at least 1s, got %v",
+				statementStatsInterval)
+		}
+	}
+
+	statementStatsTop, err := lookupInt("statement_stats_top",
+		defaultStatementStatsTop)
+	if err != nil {
+		return nil, err
+	}
+
+	if statementStatsTop < 1 {
+		return nil, fmt.Errorf("\"statement_stats_top\" in serve "+
+			"record must be positive, got %d", statementStatsTop)
+	}
+
+	format, err := lookup("format")
+	if err != nil {
+		format = formatText
+	}
+
+	if !validFormat(format) {
+		return nil, fmt.Errorf("unknown \"format\" value %q in serve "+
+			"record, expected %q or %q", format, formatText,
+			formatJSON)
+	}
+
+	var tmpl *template.Template
+	if text, err := lookup("template"); err == nil {
+		if format != formatText {
+			return nil, fmt.Errorf("\"template\" in serve record " +
+				"only applies to the \"text\" format")
+		}
+
+		if tmpl, err = parseRecordTemplate(text); err != nil {
+			return nil, err
+		}
+	}
+
+	linePolicy, err := lookup("line_policy")
+	if err != nil {
+		linePolicy = linePolicyKeep
+	}
+
+	if !validLinePolicy(linePolicy) {
+		return nil, fmt.Errorf("unknown \"line_policy\" value %q in "+
+			"serve record, expected %q, %q, %q, or %q", linePolicy,
+			linePolicyKeep, linePolicyEscape, linePolicySplit,
+			linePolicyTruncate)
+	}
+
+	if linePolicy != linePolicyKeep && format != formatText {
+		return nil, fmt.Errorf("\"line_policy\" in serve record " +
+			"only applies to the \"text\" format")
+	}
+
+	defFrameSize := 0
+	if linePolicy == linePolicySplit || linePolicy == linePolicyTruncate {
+		defFrameSize = defaultMaxFrameSize
+	}
+
+	maxFrameSize, err := lookupInt("max_frame_size", defFrameSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxFrameSize != 0 && maxFrameSize < minMaxFrameSize {
+		return nil, fmt.Errorf("\"max_frame_size\" in serve record "+
+			"must be at least %d, got %d", minMaxFrameSize,
+			maxFrameSize)
+	}
+
+	if linePolicy == linePolicySplit && maxFrameSize == 0 {
+		return nil, fmt.Errorf("\"max_frame_size\" in serve record " +
+			"must be given for the \"split\" policy")
+	}
+
+	metrics, err := lookupBool("metrics")
+	if err != nil {
+		return nil, err
+	}
+
+	lockEvents, _ := lookup("lock_events")
+	if lockEvents != "" {
+		if err := parseDestination("lock_events", lockEvents,
+			audit); err != nil {
+			return nil, err
+		}
+	}
+
+	connectionEvents, _ := lookup("connection_events")
+	if connectionEvents != "" {
+		if err := parseDestination("connection_events",
+			connectionEvents, audit); err != nil {
+			return nil, err
+		}
+	}
+
+	ddlEvents, _ := lookup("ddl_events")
+	if ddlEvents != "" {
+		if err := parseDestination("ddl_events", ddlEvents,
+			audit); err != nil {
+			return nil, err
+		}
+	}
+
+	authFailureThreshold, err := lookupInt("auth_failure_threshold",
+		defaultAuthFailureThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if authFailureThreshold < 0 {
+		return nil, fmt.Errorf("\"auth_failure_threshold\" in serve "+
+			"record must not be negative, got %d",
+			authFailureThreshold)
+	}
+
+	authFailureWindow := defaultAuthFailureWindow
+	if text, err := lookup("auth_failure_window"); err == nil {
+		authFailureWindow, err = time.ParseDuration(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid \"auth_failure_window\" "+
+				"in serve record: %v", err)
+		}
+
+		if authFailureWindow <= 0 {
+			return nil, fmt.Errorf("\"auth_failure_window\" in "+
+				"serve record must be positive, got %v",
+				authFailureWindow)
+		}
+	}
+
+	gapMarkers, err := lookupBool("gap_markers")
+	if err != nil {
+		return nil, err
+	}
+
+	sessionSummaries, _ := lookup("session_summaries")
+	if sessionSummaries != "" {
+		if err := parseDestination("session_summaries",
+			sessionSummaries, audit); err != nil {
+			return nil, err
+		}
+	}
+
+	sessionIdleTimeout := defaultSessionIdleTimeout
+	if text, err := lookup("session_idle_timeout"); err == nil {
+		sessionIdleTimeout, err = time.ParseDuration(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid \"session_idle_timeout\" "+
+				"in serve record: %v", err)
+		}
+
+		if sessionIdleTimeout <= 0 {
+			return nil, fmt.Errorf("\"session_idle_timeout\" in "+
+				"serve record must be positive, got %v",
+				sessionIdleTimeout)
+		}
+	}
+
+	lifecycleEvents, _ := lookup("lifecycle_events")
+	if lifecycleEvents != "" {
+		if err := parseDestination("lifecycle_events",
+			lifecycleEvents, audit); err != nil {
+			return nil, err
+		}
+	}
+
+	rec := &serveRecord{sKey: sKey{P: path, I: ident},
+		u: *u, audit: audit, protocol: proto, Name: name,
+		tolerant: tolerant, start: start, lineParser: lp,
+		app: app, tlsCert: tlsCert, tlsKey: tlsKey,
+		compression:          compression,
+		compressionLevel:     compressionLevel,
+		compressionThreshold: compressionThreshold,
+		requestSizeTrigger:   batching.requestSizeTrigger,
+		concurrency:          batching.concurrency,
+		period:               batching.period,
+		timeTrigger:          batching.timeTrigger,
+		redactor:             redactor,
+
+		syslogSequenceNumbers:  syslogSequenceNumbers,
+		statementStats:         statementStats,
+		statementStatsInterval: statementStatsInterval,
+		statementStatsTop:      statementStatsTop,
+		format:                 format,
+		metrics:                metrics,
+		lockEvents:             lockEvents,
+		connectionEvents:       connectionEvents,
+		authFailureThreshold:   authFailureThreshold,
+		authFailureWindow:      authFailureWindow,
+		ddlEvents:              ddlEvents,
+		gapMarkers:             gapMarkers,
+		sessionSummaries:       sessionSummaries,
+		sessionIdleTimeout:     sessionIdleTimeout,
+		lifecycleEvents:        lifecycleEvents,
+		auditSQLStates:         auditSQLStates,
+		template:               tmpl,
+		linePolicy:             linePolicy,
+		maxFrameSize:           maxFrameSize,
+		enrich:                 enrich,
+		encoding:               encoding,
+		encodingErrors:         encodingErrors,
+		detectInvalidUTF8:      detectInvalidUTF8}
+
+	rec.setLabels(labels)
+	return rec, nil
 }
 
 func (t *serveDb) parse(contents []byte) (map[sKey]*serveRecord, error) {
@@ -470,6 +1299,7 @@ func (t *serveDb) parse(contents []byte) (map[sKey]*serveRecord, error) {
 			return nil, err
 		}
 
+		rec.dbDir = t.path
 		newMapping[rec.sKey] = rec
 	}
 
@@ -0,0 +1,264 @@
+// Summaries of sessions, correlated from their records by session id,
+// for some session analytics without log_statement = 'all'.  Once a
+// session disconnects, as log_disconnections logs, or once nothing is
+// heard of it for a while, a summary of it is sent:
+//
+//     event=session_summary identity=... session_id=5362197c.4d2 user=bob database=db duration_s=3723.5 records=40 statements=12 errors=2 errors_by_class.23=1 errors_by_class.42=1 end=disconnection ...
+//
+// Statements are counted as far as they are logged, such as by
+// log_statement or log_min_duration_statement, and errors by the class
+// of their SQLSTATE, its first two characters.  Sessions are tracked
+// for one connection or log file at a time; any left when it ends are
+// summarized then.  Idle sessions are looked for every minute, or as
+// often as the timeout if that is shorter, so that those of a quiet
+// connection are summarized without waiting for its next record.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSessionIdleTimeout = 30 * time.Minute
+
+	// How often idle sessions are looked for, at the most.
+	sessionExpiryInterval = time.Minute
+
+	// The most sessions summarized at once for a connection or
+	// log file, beyond which those not heard from for the longest
+	// are summarized early.
+	maxSummarizedSessions = 10000
+)
+
+// Layouts of the timestamps of records, as of %m and %s in
+// log_line_prefix.
+const (
+	logTimeLayout      = "2006-01-02 15:04:05.000 MST"
+	sessionStartLayout = "2006-01-02 15:04:05 MST"
+)
+
+type sessionSummary struct {
+	sessionID    string
+	pid          int32
+	user         string
+	database     string
+	clientAddr   string
+	application  string
+	sessionStart string
+	first        string
+	last         string
+	records      int
+	statements   int
+	errors       map[string]int
+
+	// The session time logged on disconnection, in seconds, or
+	// -1 if it was not.
+	sessionTime float64
+}
+
+// Sessions being summarized, over one connection or log file.  The
+// worker reading its records and sessionExpiryWorker both use it.
+type sessionTracker struct {
+	sync.Mutex
+
+	sessions *lruCache
+	idle     time.Duration
+	emit     func(s *sessionSummary, end string)
+
+	// Why sessions are being evicted from sessions.
+	reason string
+}
+
+func newSessionTracker(idle time.Duration,
+	emit func(s *sessionSummary, end string)) *sessionTracker {
+	t := &sessionTracker{idle: idle, emit: emit, reason: "evicted"}
+	t.sessions = newLRUCache(maxSummarizedSessions,
+		func(key string, value interface{}) {
+			t.emit(value.(*sessionSummary), t.reason)
+		})
+
+	return t
+}
+
+// Make a tracker that sends the summaries of sessions of sr, or
+// return nil if sr does not ask for them.
+func trackSessions(clients *serveClients, sr *serveRecord) *sessionTracker {
+	if sr.sessionSummaries == "" {
+		return nil
+	}
+
+	target := clients.resolve(sr.sessionSummaries)
+	return newSessionTracker(sr.sessionIdleTimeout,
+		func(s *sessionSummary, end string) {
+			sr.stats().incr("session_summaries")
+			emitEvent(sr, target, time.Now(), s.event(end))
+		})
+}
+
+// Send the summaries of sessions that have gone idle.
+func (t *sessionTracker) expire(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.expireIdle(now)
+}
+
+func (t *sessionTracker) expireIdle(now time.Time) {
+	t.reason = "idle"
+	t.sessions.expire(now.Add(-t.idle))
+	t.reason = "evicted"
+}
+
+// Account for a record, sending the summary of its session if the
+// record ends it, and of any sessions that have gone idle.
+func (t *sessionTracker) observe(lr *logRecord, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.expireIdle(now)
+
+	if lr.SessionID == "" {
+		return
+	}
+
+	var s *sessionSummary
+	if v, ok := t.sessions.get(lr.SessionID, now); ok {
+		s = v.(*sessionSummary)
+	} else {
+		s = &sessionSummary{sessionID: lr.SessionID, pid: lr.Pid,
+			sessionStart: lr.SessionStart, first: lr.LogTime,
+			errors: make(map[string]int), sessionTime: -1}
+		t.sessions.put(lr.SessionID, s, now)
+	}
+
+	s.observe(lr)
+
+	if lr.ErrMessage != nil {
+		if m := disconnection.FindStringSubmatch(*lr.ErrMessage); m != nil {
+			s.sessionTime = parseSessionTime(m)
+			t.sessions.remove(lr.SessionID)
+			t.emit(s, "disconnection")
+		}
+	}
+}
+
+// Summarize every session still being tracked.
+func (t *sessionTracker) flush(reason string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.reason = reason
+	t.sessions.evictAll()
+}
+
+// Periodically send the summaries of sessions of t that have gone
+// idle, until told to die, for records may stop coming well before
+// the connection or log file they come by ends.
+func sessionExpiryWorker(die dieCh, t *sessionTracker) {
+	interval := sessionExpiryInterval
+	if t.idle < interval {
+		interval = t.idle
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-die:
+			return
+		case now := <-ticker.C:
+			t.expire(now)
+		}
+	}
+}
+
+func (s *sessionSummary) observe(lr *logRecord) {
+	set := func(dst *string, src *string) {
+		if *dst == "" && src != nil {
+			*dst = *src
+		}
+	}
+
+	set(&s.user, lr.UserName)
+	set(&s.database, lr.DatabaseName)
+	set(&s.application, lr.ApplicationName)
+	if s.clientAddr == "" {
+		s.clientAddr = recordClientAddr(lr)
+	}
+
+	s.records++
+	s.last = lr.LogTime
+
+	if lr.ErrMessage != nil {
+		msg := *lr.ErrMessage
+		if _, ok := parseStatementLine(msg); ok ||
+			loggedStatement.MatchString(msg) {
+			s.statements++
+		}
+	}
+
+	if lr.ELevel >= elevelError && lr.SQLState != nil &&
+		len(*lr.SQLState) >= 2 {
+		s.errors[(*lr.SQLState)[:2]]++
+	}
+}
+
+// How long the session lasted, in seconds, as logged on
+// disconnection, or failing that, from its start or first record to
+// its last record.
+func (s *sessionSummary) duration() float64 {
+	if s.sessionTime >= 0 {
+		return s.sessionTime
+	}
+
+	last, err := time.Parse(logTimeLayout, s.last)
+	if err != nil {
+		return 0
+	}
+
+	first, err := time.Parse(sessionStartLayout, s.sessionStart)
+	if err != nil {
+		if first, err = time.Parse(logTimeLayout, s.first); err != nil {
+			return 0
+		}
+	}
+
+	return last.Sub(first).Seconds()
+}
+
+func (s *sessionSummary) event(end string) *event {
+	var classes []string
+	total := 0
+	for class, n := range s.errors {
+		classes = append(classes, class)
+		total += n
+	}
+
+	sort.Strings(classes)
+
+	byClass := newEvent("")
+	for _, class := range classes {
+		byClass.add(class, s.errors[class])
+	}
+
+	return newEvent("session_summary").
+		add("session_id", s.sessionID).
+		add("pid", s.pid).
+		add("user", s.user).
+		add("database", s.database).
+		add("client_addr", s.clientAddr).
+		add("application_name", s.application).
+		add("session_start", s.sessionStart).
+		add("first", s.first).
+		add("last", s.last).
+		add("duration_s", s.duration()).
+		add("records", s.records).
+		add("statements", s.statements).
+		add("errors", total).
+		add("errors_by_class", byClass).
+		add("end", end)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionSummaries(t *testing.T) {
+	var summaries []*event
+	tr := newSessionTracker(time.Minute, func(s *sessionSummary, end string) {
+		summaries = append(summaries, s.event(end))
+	})
+
+	start := time.Date(2014, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	record := func(seq int64, logTime, msg, state string, elevel int32) {
+		lr := sampleRecord
+		lr.SeqNum = seq
+		lr.LogTime = logTime
+		lr.ErrMessage = strp(msg)
+		lr.SQLState = strp(state)
+		lr.ELevel = elevel
+		tr.observe(&lr, start)
+	}
+
+	record(1, "2014-05-01 10:00:00.000 UTC", "statement: SELECT 1",
+		"00000", elevelLog)
+	record(2, "2014-05-01 10:00:01.000 UTC",
+		"relation \"nope\" does not exist", "42P01", elevelError)
+	record(3, "2014-05-01 10:00:02.000 UTC",
+		"duplicate key value violates unique constraint \"t_pkey\"",
+		"23505", elevelError)
+	record(4, "2014-05-01 10:00:03.000 UTC",
+		"disconnection: session time: 0:00:05.500 user=postgres "+
+			"database=postgres host=[local]", "00000", elevelLog)
+
+	if len(summaries) != 1 {
+		t.Fatalf("expected one summary, got %d", len(summaries))
+	}
+
+	sr := &serveRecord{sKey: sKey{I: "ident"}}
+	got := string(summaries[0].format(sr))
+	want := "event=session_summary identity=ident " +
+		"session_id=5362197c.4d2 pid=1234 user=postgres " +
+		"database=postgres application_name=psql " +
+		"session_start=\"2014-05-01 09:59:58 UTC\" " +
+		"first=\"2014-05-01 10:00:00.000 UTC\" " +
+		"last=\"2014-05-01 10:00:03.000 UTC\" duration_s=5.5 " +
+		"records=4 statements=1 errors=2 errors_by_class.23=1 " +
+		"errors_by_class.42=1 end=disconnection"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Sessions that go quiet are summarized on the next record
+	// after the timeout, and those left at the end on flushing.
+	record(1, "2014-05-01 10:00:00.000 UTC", "statement: SELECT 1",
+		"00000", elevelLog)
+
+	lr := sampleRecord
+	lr.SessionID = "5362197c.4d3"
+	tr.observe(&lr, start.Add(2*time.Minute))
+
+	if len(summaries) != 2 || summaries[1].value("end") != "idle" ||
+		summaries[1].value("duration_s") != 2.0 {
+		t.Fatalf("unexpected summaries %v", summaries)
+	}
+
+	tr.flush("connection_closed")
+	if len(summaries) != 3 ||
+		summaries[2].value("end") != "connection_closed" {
+		t.Fatalf("unexpected summaries %v", summaries)
+	}
+
+	// Nor need there be a next record for a quiet session to be
+	// summarized.
+	tr.observe(&lr, start)
+	tr.expire(start.Add(30 * time.Second))
+	if len(summaries) != 3 {
+		t.Fatalf("unexpected summaries %v", summaries)
+	}
+
+	tr.expire(start.Add(2 * time.Minute))
+	if len(summaries) != 4 || summaries[3].value("end") != "idle" {
+		t.Fatalf("unexpected summaries %v", summaries)
+	}
+}
+
+func TestSessionExpiryWorker(t *testing.T) {
+	summarized := make(chan string, 1)
+	tr := newSessionTracker(10*time.Millisecond,
+		func(s *sessionSummary, end string) {
+			summarized <- end
+		})
+
+	lr := sampleRecord
+	tr.observe(&lr, time.Now())
+
+	die := make(chan struct{})
+	defer close(die)
+	go sessionExpiryWorker(die, tr)
+
+	select {
+	case end := <-summarized:
+		if end != "idle" {
+			t.Fatalf("got end=%s, want end=idle", end)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle session to be summarized")
+	}
+}
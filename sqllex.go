@@ -0,0 +1,253 @@
+// A lexer for the SQL of Postgres, enough to tell literals, comments,
+// and quoted identifiers from everything else, as needed to rewrite
+// query text without being fooled by what is inside strings.
+//
+// It follows scan.l in the Postgres source in the essentials:
+// standard strings with doubled quotes, E'' strings with backslash
+// escapes, the B, X, N, and U& prefixes, dollar quoting, and nested
+// block comments.  It never fails: text it cannot make sense of, such
+// as an unterminated string, runs to the end of the input as one
+// token.
+
+package main
+
+type sqlTokenKind int
+
+const (
+	sqlSpace sqlTokenKind = iota
+	sqlComment
+	sqlIdent
+	sqlQuotedIdent
+	sqlString
+	sqlNumber
+	sqlParam
+	sqlOperator
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+
+	// Offsets of the token in the lexed text.
+	start int
+	end   int
+}
+
+func isSQLIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= 0x80
+}
+
+func isSQLIdentCont(c byte) bool {
+	return isSQLIdentStart(c) || c == '$' || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSQLSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+
+	return false
+}
+
+// Split s into tokens, calling emit with each in turn.
+func lexSQL(s string, emit func(tok sqlToken)) {
+	for i := 0; i < len(s); {
+		kind, end := lexSQLToken(s, i)
+		emit(sqlToken{kind: kind, start: i, end: end})
+		i = end
+	}
+}
+
+// Find the kind and end of the token starting at s[i].
+func lexSQLToken(s string, i int) (sqlTokenKind, int) {
+	c := s[i]
+
+	switch {
+	case isSQLSpace(c):
+		j := i + 1
+		for j < len(s) && isSQLSpace(s[j]) {
+			j++
+		}
+
+		return sqlSpace, j
+
+	case c == '-' && i+1 < len(s) && s[i+1] == '-':
+		j := i + 2
+		for j < len(s) && s[j] != '\n' {
+			j++
+		}
+
+		return sqlComment, j
+
+	case c == '/' && i+1 < len(s) && s[i+1] == '*':
+		return sqlComment, lexBlockComment(s, i)
+
+	case c == '\'':
+		return sqlString, lexQuoted(s, i+1, '\'', false)
+
+	case c == '"':
+		return sqlQuotedIdent, lexQuoted(s, i+1, '"', false)
+
+	case c == '$':
+		j := i + 1
+		for j < len(s) && isDigit(s[j]) {
+			j++
+		}
+
+		if j > i+1 {
+			return sqlParam, j
+		}
+
+		if end, ok := lexDollarQuoted(s, i); ok {
+			return sqlString, end
+		}
+
+		return sqlOperator, i + 1
+
+	case isDigit(c) || c == '.' && i+1 < len(s) && isDigit(s[i+1]):
+		return sqlNumber, lexNumber(s, i)
+
+	case isSQLIdentStart(c):
+		// String constants with a prefix: E'', B'', X'', N'',
+		// and U&''.
+		if i+1 < len(s) && s[i+1] == '\'' {
+			switch c {
+			case 'e', 'E':
+				return sqlString, lexQuoted(s, i+2, '\'', true)
+			case 'b', 'B', 'x', 'X', 'n', 'N':
+				return sqlString, lexQuoted(s, i+2, '\'', false)
+			}
+		}
+
+		if (c == 'u' || c == 'U') && i+2 < len(s) && s[i+1] == '&' {
+			switch s[i+2] {
+			case '\'':
+				return sqlString, lexQuoted(s, i+3, '\'', false)
+			case '"':
+				return sqlQuotedIdent, lexQuoted(s, i+3, '"', false)
+			}
+		}
+
+		j := i + 1
+		for j < len(s) && isSQLIdentCont(s[j]) {
+			j++
+		}
+
+		return sqlIdent, j
+	}
+
+	return sqlOperator, i + 1
+}
+
+// Find the end of text quoted with q, starting just after the opening
+// quote.  A doubled quote stands for itself, as does a quote escaped
+// with a backslash if backslashes are escapes.  Postgres also joins
+// string constants separated only by whitespace including a newline,
+// but treating those as two tokens is just as good for rewriting
+// them.
+func lexQuoted(s string, i int, q byte, backslash bool) int {
+	for i < len(s) {
+		switch s[i] {
+		case '\\':
+			if backslash {
+				i += 2
+				continue
+			}
+		case q:
+			if i+1 < len(s) && s[i+1] == q {
+				i += 2
+				continue
+			}
+
+			return i + 1
+		}
+
+		i++
+	}
+
+	return len(s)
+}
+
+// Find the end of a block comment starting at s[i], which may nest.
+func lexBlockComment(s string, i int) int {
+	depth := 0
+
+	for i < len(s) {
+		switch {
+		case s[i] == '/' && i+1 < len(s) && s[i+1] == '*':
+			depth++
+			i += 2
+		case s[i] == '*' && i+1 < len(s) && s[i+1] == '/':
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+
+	return len(s)
+}
+
+// Find the end of a dollar-quoted string starting at s[i], if one
+// starts there: $$...$$ or $tag$...$tag$.
+func lexDollarQuoted(s string, i int) (int, bool) {
+	j := i + 1
+	if j < len(s) && isSQLIdentStart(s[j]) {
+		for j < len(s) && isSQLIdentCont(s[j]) && s[j] != '$' {
+			j++
+		}
+	}
+
+	if j >= len(s) || s[j] != '$' {
+		return 0, false
+	}
+
+	tag := s[i : j+1]
+	for k := j + 1; k+len(tag) <= len(s); k++ {
+		if s[k:k+len(tag)] == tag {
+			return k + len(tag), true
+		}
+	}
+
+	return len(s), true
+}
+
+// Find the end of a numeric constant starting at s[i]: digits with an
+// optional fraction and exponent.
+func lexNumber(s string, i int) int {
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+
+	if i < len(s) && s[i] == '.' &&
+		!(i+1 < len(s) && s[i+1] == '.') {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+
+		if j < len(s) && isDigit(s[j]) {
+			i = j
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+		}
+	}
+
+	return i
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLexSQL(t *testing.T) {
+	type tok struct {
+		kind sqlTokenKind
+		text string
+	}
+
+	for _, tt := range []struct {
+		in   string
+		want []tok
+	}{
+		{`SELECT 'it''s', E'a\'b' -- c`, []tok{
+			{sqlIdent, "SELECT"}, {sqlSpace, " "},
+			{sqlString, `'it''s'`}, {sqlOperator, ","},
+			{sqlSpace, " "}, {sqlString, `E'a\'b'`},
+			{sqlSpace, " "}, {sqlComment, "-- c"}}},
+		{`$fn$ it's $$ $fn$||$$x$$`, []tok{
+			{sqlString, `$fn$ it's $$ $fn$`}, {sqlOperator, "|"},
+			{sqlOperator, "|"}, {sqlString, "$$x$$"}}},
+		{`/* a /* b */ c */"x""y"$1`, []tok{
+			{sqlComment, "/* a /* b */ c */"},
+			{sqlQuotedIdent, `"x""y"`}, {sqlParam, "$1"}}},
+		{`t1.a>=1.5e-3 U&'\0041' x'ff'`, []tok{
+			{sqlIdent, "t1"}, {sqlOperator, "."}, {sqlIdent, "a"},
+			{sqlOperator, ">"}, {sqlOperator, "="},
+			{sqlNumber, "1.5e-3"}, {sqlSpace, " "},
+			{sqlString, `U&'\0041'`}, {sqlSpace, " "},
+			{sqlString, "x'ff'"}}},
+		{`'unterminated`, []tok{{sqlString, `'unterminated`}}},
+	} {
+		var got []tok
+		lexSQL(tt.in, func(t sqlToken) {
+			got = append(got, tok{t.kind, tt.in[t.start:t.end]})
+		})
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lexing %q: expected %v, got %v",
+				tt.in, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Names for SQLSTATE codes, and rules that pick codes out by code,
+// class, or name.  A rule may be:
+//
+//     a code, such as "23505", matching only that code;
+//
+//     a class, the first two characters of codes, such as "23";
+//
+//     a condition name, such as "unique_violation", matching the
+//     codes of that name, or if it names a class, such as
+//     "integrity_constraint_violation", every code of the class, as
+//     in the exception handlers of PL/pgSQL.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The codes of the classes audited by default: system_error,
+// config_file_error, and internal_error.
+var defaultAuditSQLStates = []string{"58", "F0", "XX"}
+
+var (
+	sqlstateCode  = regexp.MustCompile(`^[0-9A-Z]{5}$`)
+	sqlstateClass = regexp.MustCompile(`^[0-9A-Z]{2}$`)
+
+	// Condition names, and the codes of each.
+	sqlstateNames = func() map[string][]string {
+		names := make(map[string][]string, len(sqlstateConditions))
+		for code, name := range sqlstateConditions {
+			names[name] = append(names[name], code)
+		}
+
+		return names
+	}()
+)
+
+// The condition name of a code, or "" if it has none.
+func sqlstateCondition(code string) string {
+	return sqlstateConditions[code]
+}
+
+// The condition name of the class of a code, or "" if it has none.
+func sqlstateClassName(code string) string {
+	if len(code) < 2 {
+		return ""
+	}
+
+	return sqlstateConditions[code[:2]+"000"]
+}
+
+// Whether a code is worth describing in formatted records: those of
+// class 00, successful completion, which most records have, are not.
+func describeSQLState(code *string) bool {
+	return code != nil && *code != "" && !strings.HasPrefix(*code, "00")
+}
+
+// Check a rule given for key in a serve record.
+func parseSQLStateRule(key string, rule string) error {
+	if sqlstateCode.MatchString(rule) || sqlstateClass.MatchString(rule) {
+		return nil
+	}
+
+	if _, ok := sqlstateNames[rule]; ok {
+		return nil
+	}
+
+	return fmt.Errorf("unknown SQLSTATE %q in %q in serve record, "+
+		"expected a code, a class, or a condition name", rule, key)
+}
+
+// Whether code matches any of rules.
+func sqlstateMatches(code string, rules []string) bool {
+	for _, rule := range rules {
+		switch {
+		case len(rule) == 5 && rule == code:
+			return true
+		case len(rule) == 2 && strings.HasPrefix(code, rule):
+			return true
+		case rule == sqlstateCondition(code),
+			rule == sqlstateClassName(code):
+			return true
+		}
+	}
+
+	return false
+}
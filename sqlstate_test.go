@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestSQLStateNames(t *testing.T) {
+	if c := sqlstateCondition("23505"); c != "unique_violation" {
+		t.Errorf("unexpected condition %q", c)
+	}
+
+	if c := sqlstateClassName("23505"); c != "integrity_constraint_violation" {
+		t.Errorf("unexpected class %q", c)
+	}
+
+	// Every class has a code that names it.
+	for code := range sqlstateConditions {
+		if sqlstateClassName(code) == "" {
+			t.Errorf("no class name for %q", code)
+		}
+	}
+
+	lr := sampleRecord
+	lr.SQLState = strp("23505")
+	lr.ErrMessage = strp("duplicate key value violates unique constraint")
+	lr.UserQuery = nil
+
+	got := string(formatTextMessage(&lr))
+	want := "duplicate key value violates unique constraint\n" +
+		"sqlstate=23505 condition=unique_violation " +
+		"class=integrity_constraint_violation\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	lr.SQLState = strp("00000")
+	if got := string(formatTextMessage(&lr)); got !=
+		"duplicate key value violates unique constraint\n" {
+		t.Errorf("unexpected text %q", got)
+	}
+}
+
+func TestSQLStateRules(t *testing.T) {
+	rules := []string{"40P01", "58", "unique_violation",
+		"insufficient_resources"}
+
+	for code, want := range map[string]bool{
+		"40P01": true,
+		"40001": false,
+		"58030": true,
+		"23505": true,
+		"23503": false,
+		"53100": true,
+		"XX000": false,
+	} {
+		if got := sqlstateMatches(code, rules); got != want {
+			t.Errorf("sqlstateMatches(%q) = %v, want %v", code,
+				got, want)
+		}
+	}
+
+	for _, rule := range rules {
+		if err := parseSQLStateRule("audit_sqlstates", rule); err != nil {
+			t.Errorf("rule %q should be valid: %v", rule, err)
+		}
+	}
+
+	if err := parseSQLStateRule("audit_sqlstates",
+		"unique_violations"); err == nil {
+		t.Error("expected unknown condition to be rejected")
+	}
+}
@@ -0,0 +1,328 @@
+// Statistics on statements gathered from what Postgres logs about
+// them, for some of the insight of pg_stat_statements where the
+// database itself cannot be queried.
+//
+// Postgres logs statements with their durations, as
+// log_min_duration_statement does, like so:
+//
+//     duration: 12.345 ms  statement: SELECT ...
+//     duration: 0.050 ms  parse <unnamed>: SELECT ...
+//     duration: 0.100 ms  bind S_1: SELECT ...
+//     duration: 3.000 ms  execute S_1: SELECT ...
+//
+// Each is attributed to a fingerprint of its query, which is the same
+// for queries that differ only in their constants, whitespace,
+// comments, and the case of keywords and unquoted identifiers.  For
+// every fingerprint and kind of line, the count, total, maximum, and
+// percentiles of durations are kept over an interval, at the end of
+// which the busiest fingerprints are sent to the serve's primary URL
+// as one line each, and the slate is wiped clean.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+const (
+	defaultStatementStatsInterval = time.Minute
+	defaultStatementStatsTop      = 20
+
+	// Bounds on memory: the most fingerprints kept in an
+	// interval, beyond which statements are counted as dropped,
+	// and the most durations of each fingerprint kept to estimate
+	// percentiles from.
+	maxStatementFingerprints = 1000
+	statementReservoirSize   = 128
+)
+
+// Matches a statement logged with its duration.
+var statementLine = regexp.MustCompile(
+	`(?s)^duration: ([0-9.]+) ms  (statement|parse|bind|execute)(?: ([^:]*))?: (.*)$`)
+
+type statementLogLine struct {
+	duration float64 // In milliseconds
+	kind     string
+	name     string
+	query    string
+}
+
+// Parse a message about a statement, returning false if it is not
+// one.
+func parseStatementLine(msg string) (statementLogLine, bool) {
+	m := statementLine.FindStringSubmatch(msg)
+	if m == nil {
+		return statementLogLine{}, false
+	}
+
+	duration, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return statementLogLine{}, false
+	}
+
+	return statementLogLine{duration: duration, kind: m[2], name: m[3],
+		query: m[4]}, true
+}
+
+// Render q in a canonical form: constants and parameters become "?",
+// unquoted identifiers and keywords are folded to lower case, and
+// tokens are separated by single spaces, without comments.
+func canonicalSQL(q string) string {
+	var b bytes.Buffer
+
+	lexSQL(q, func(tok sqlToken) {
+		var text string
+		switch tok.kind {
+		case sqlSpace, sqlComment:
+			return
+		case sqlString, sqlNumber, sqlParam:
+			text = "?"
+		case sqlIdent:
+			text = strings.ToLower(q[tok.start:tok.end])
+		default:
+			text = q[tok.start:tok.end]
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(text)
+	})
+
+	return b.String()
+}
+
+// Identify the canonical form of a query, briefly.
+func fingerprintSQL(canonical string) string {
+	sum := sha1.Sum([]byte(canonical))
+	return hex.EncodeToString(sum[:8])
+}
+
+type statementKey struct {
+	fingerprint string
+	kind        string
+}
+
+type statementAgg struct {
+	query string
+	count int
+	total float64
+	max   float64
+
+	// A uniform sample of durations, by reservoir sampling.
+	reservoir []float64
+}
+
+// Percentile p (from 0 to 100) of sorted durations, by the
+// nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+
+	return sorted[rank]
+}
+
+// Aggregates of statements of one serve over the current interval.
+type statementStats struct {
+	lock    sync.Mutex
+	start   time.Time
+	entries map[statementKey]*statementAgg
+	rand    *rand.Rand
+
+	// Statements not accounted for because there were too many
+	// fingerprints.
+	untracked int
+}
+
+func newStatementStats(now time.Time) *statementStats {
+	return &statementStats{
+		start:   now,
+		entries: make(map[statementKey]*statementAgg),
+		rand:    rand.New(rand.NewSource(now.UnixNano())),
+	}
+}
+
+// All statementStats, which outlive reloads of the serve database
+// like serveStats do.
+var statementStatsRegistry = struct {
+	sync.Mutex
+	m map[sKey]*statementStats
+}{m: make(map[sKey]*statementStats)}
+
+func (sr *serveRecord) statements() *statementStats {
+	statementStatsRegistry.Lock()
+	defer statementStatsRegistry.Unlock()
+
+	s, ok := statementStatsRegistry.m[sr.sKey]
+	if !ok {
+		s = newStatementStats(time.Now())
+		statementStatsRegistry.m[sr.sKey] = s
+	}
+
+	return s
+}
+
+// Account for a record, if it is about a statement.
+func (s *statementStats) observe(lr *logRecord) {
+	if lr.ErrMessage == nil {
+		return
+	}
+
+	line, ok := parseStatementLine(*lr.ErrMessage)
+	if !ok {
+		return
+	}
+
+	canonical := canonicalSQL(line.query)
+	key := statementKey{fingerprint: fingerprintSQL(canonical),
+		kind: line.kind}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	agg, ok := s.entries[key]
+	if !ok {
+		if len(s.entries) >= maxStatementFingerprints {
+			s.untracked++
+			return
+		}
+
+		agg = &statementAgg{query: canonical}
+		s.entries[key] = agg
+	}
+
+	agg.count++
+	agg.total += line.duration
+	if line.duration > agg.max {
+		agg.max = line.duration
+	}
+
+	if len(agg.reservoir) < statementReservoirSize {
+		agg.reservoir = append(agg.reservoir, line.duration)
+	} else if i := s.rand.Intn(agg.count); i < statementReservoirSize {
+		agg.reservoir[i] = line.duration
+	}
+}
+
+type statementSummary struct {
+	statementKey
+	*statementAgg
+}
+
+type summariesByTotal []statementSummary
+
+func (ss summariesByTotal) Len() int      { return len(ss) }
+func (ss summariesByTotal) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
+func (ss summariesByTotal) Less(i, j int) bool {
+	if ss[i].total != ss[j].total {
+		return ss[i].total > ss[j].total
+	}
+
+	return ss[i].fingerprint < ss[j].fingerprint
+}
+
+// End the current interval, rendering a line for each of the top
+// fingerprints by total duration, and one about what was left out.
+func (s *statementStats) flush(now time.Time, top int) [][]byte {
+	s.lock.Lock()
+	entries, untracked, start := s.entries, s.untracked, s.start
+	s.entries = make(map[statementKey]*statementAgg)
+	s.untracked = 0
+	s.start = now
+	s.lock.Unlock()
+
+	summaries := make(summariesByTotal, 0, len(entries))
+	for k, agg := range entries {
+		summaries = append(summaries, statementSummary{k, agg})
+	}
+
+	sort.Sort(summaries)
+	omitted := 0
+	if len(summaries) > top {
+		omitted = len(summaries) - top
+		summaries = summaries[:top]
+	}
+
+	interval := now.Sub(start).Seconds()
+
+	var lines [][]byte
+	for _, sum := range summaries {
+		sorted := append([]float64(nil), sum.reservoir...)
+		sort.Float64s(sorted)
+
+		lines = append(lines, []byte(fmt.Sprintf(
+			"statement_stats fingerprint=%s kind=%s "+
+				"interval=%.0fs count=%d total_ms=%.3f "+
+				"p50_ms=%.3f p95_ms=%.3f p99_ms=%.3f "+
+				"max_ms=%.3f query=%q",
+			sum.fingerprint, sum.kind, interval, sum.count,
+			sum.total, percentile(sorted, 50), percentile(sorted, 95),
+			percentile(sorted, 99), sum.max, sum.query)))
+	}
+
+	if omitted > 0 || untracked > 0 {
+		lines = append(lines, []byte(fmt.Sprintf(
+			"statement_stats interval=%.0fs omitted=%d untracked=%d",
+			interval, omitted, untracked)))
+	}
+
+	return lines
+}
+
+// Periodically send statement statistics of sr to its primary URL,
+// until told to die.  The statistics themselves carry over to the
+// next worker for the serve.
+func statementStatsWorker(die dieCh, cfg logplexc.Config, sr *serveRecord) {
+	target, err := acquireClient(sr, cfg, &sr.u)
+	if err != nil {
+		log.Fatalf("could not create statement statistics client: %v",
+			err)
+	}
+	defer releaseClient(target)
+
+	app := sr.appName()
+
+	ticker := time.NewTicker(sr.statementStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-die:
+			return
+		case now := <-ticker.C:
+			for _, line := range sr.statements().flush(now,
+				sr.statementStatsTop) {
+				line = append([]byte(sr.labelPrefix()), line...)
+				if sr.Name != "" {
+					line = append([]byte("["+sr.Name+"] "),
+						line...)
+				}
+
+				target.BufferMessage(134, now, app,
+					app+".statements", line)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatementLine(t *testing.T) {
+	line, ok := parseStatementLine(
+		"duration: 12.345 ms  execute S_1: SELECT * FROM t WHERE a = $1")
+	if !ok || line.duration != 12.345 || line.kind != "execute" ||
+		line.name != "S_1" || line.query != "SELECT * FROM t WHERE a = $1" {
+		t.Fatalf("unexpected parse %+v (ok %v)", line, ok)
+	}
+
+	line, ok = parseStatementLine("duration: 1.000 ms  statement: SELECT 1;\nSELECT 2")
+	if !ok || line.kind != "statement" || line.query != "SELECT 1;\nSELECT 2" {
+		t.Fatalf("unexpected parse %+v (ok %v)", line, ok)
+	}
+
+	for _, msg := range []string{
+		"statement: SELECT 1",
+		"duration: 1.000 ms",
+		"connection authorized: user=postgres",
+	} {
+		if _, ok := parseStatementLine(msg); ok {
+			t.Errorf("%q should not parse as a statement", msg)
+		}
+	}
+}
+
+func TestFingerprintSQL(t *testing.T) {
+	a := canonicalSQL("SELECT * FROM t WHERE a = 'x' -- comment\n  AND b IN (1, 2)")
+	b := canonicalSQL("select *\tfrom T where A = $1 and B in (3, 4)")
+	if a != b {
+		t.Fatalf("expected equal canonical forms, got %q and %q", a, b)
+	}
+
+	if a != "select * from t where a = ? and b in ( ? , ? )" {
+		t.Errorf("unexpected canonical form %q", a)
+	}
+
+	if fingerprintSQL(a) == fingerprintSQL(canonicalSQL(`SELECT * FROM "T"`)) {
+		t.Error("different queries should have different fingerprints")
+	}
+}
+
+func TestStatementStats(t *testing.T) {
+	start := time.Date(2014, time.May, 1, 10, 0, 0, 0, time.UTC)
+	s := newStatementStats(start)
+
+	observe := func(msg string) {
+		lr := sampleRecord
+		lr.ErrMessage = &msg
+		s.observe(&lr)
+	}
+
+	for i := 1; i <= 100; i++ {
+		observe(fmt.Sprintf("duration: %d.000 ms  statement: "+
+			"SELECT * FROM t WHERE id = %d", i, i))
+	}
+
+	observe("duration: 0.500 ms  statement: SELECT now()")
+	observe("statement: SELECT 'no duration'")
+
+	lines := s.flush(start.Add(time.Minute), 1)
+	if len(lines) != 2 {
+		t.Fatalf("expected two lines, got %q", lines)
+	}
+
+	want := "statement_stats fingerprint=" +
+		fingerprintSQL("select * from t where id = ?") +
+		" kind=statement interval=60s count=100 total_ms=5050.000 " +
+		"p50_ms=50.000 p95_ms=95.000 p99_ms=99.000 max_ms=100.000 " +
+		`query="select * from t where id = ?"`
+	if string(lines[0]) != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, lines[0])
+	}
+
+	if !strings.HasSuffix(string(lines[1]), "omitted=1 untracked=0") {
+		t.Errorf("unexpected trailer %q", lines[1])
+	}
+
+	if lines := s.flush(start.Add(2*time.Minute), 1); len(lines) != 0 {
+		t.Errorf("expected nothing after flushing, got %q", lines)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Running counters for a serve, which are kept for the life of the
+// process so that they survive serve database reloads and client
+// reconnections.
+type serveStats struct {
+	sKey
+
+	lock     sync.Mutex
+	counters map[string]uint64
+
+	// The last known lifecycle state of the server.  See
+	// lifecycle.go.
+	lifecycle lifecycleState
+
+	// The version of Postgres last seen.  See labels.go.
+	version string
+}
+
+// All serveStats ever handed out, keyed the same way as the serve
+// database.
+var statsRegistry = struct {
+	sync.Mutex
+	m map[sKey]*serveStats
+}{m: make(map[sKey]*serveStats)}
+
+func (sr *serveRecord) stats() *serveStats {
+	statsRegistry.Lock()
+	defer statsRegistry.Unlock()
+
+	s, ok := statsRegistry.m[sr.sKey]
+	if !ok {
+		s = &serveStats{sKey: sr.sKey, counters: make(map[string]uint64)}
+		statsRegistry.m[sr.sKey] = s
+	}
+
+	return s
+}
+
+// Add n to the counter with the given name.
+func (s *serveStats) add(name string, n uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.counters[name] += n
+}
+
+func (s *serveStats) incr(name string) {
+	s.add(name, 1)
+}
+
+// The value of the counter with the given name.
+func (s *serveStats) get(name string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.counters[name]
+}
+
+// Render the counters as a JSON-friendly map, alongside the
+// identifying keys of the serve.
+func (s *serveStats) snapshot() map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	snap := make(map[string]interface{}, len(s.counters)+2)
+	for k, v := range s.counters {
+		snap[k] = v
+	}
+
+	snap["i"] = s.I
+	snap["p"] = s.P
+
+	if s.lifecycle.state != "" {
+		snap["lifecycle"] = map[string]interface{}{
+			"state": s.lifecycle.state,
+			"event": s.lifecycle.event,
+			"since": s.lifecycle.since.UTC().Format(time.RFC3339),
+		}
+	}
+
+	if s.version != "" {
+		snap["pg_version"] = s.version
+	}
+
+	return snap
+}
+
+type statsSnapshots []map[string]interface{}
+
+func (ss statsSnapshots) Len() int      { return len(ss) }
+func (ss statsSnapshots) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
+func (ss statsSnapshots) Less(i, j int) bool {
+	pi, pj := ss[i]["p"].(string), ss[j]["p"].(string)
+	if pi != pj {
+		return pi < pj
+	}
+
+	return ss[i]["i"].(string) < ss[j]["i"].(string)
+}
+
+func (t *serveDb) statsPath() string {
+	return path.Join(t.path, "stats")
+}
+
+// Write out the statistics of every serve seen by this process to
+// the "stats" file of the serve database, for the inspection of
+// other programs.
+//
+// Much like serves.loaded, readers never see a partially written
+// file, but no effort is made to make it durable: it's re-written
+// frequently anyway.
+func (t *serveDb) persistStats() error {
+	statsRegistry.Lock()
+	snaps := make(statsSnapshots, 0, len(statsRegistry.m))
+	for _, s := range statsRegistry.m {
+		snaps = append(snaps, s.snapshot())
+	}
+	statsRegistry.Unlock()
+
+	sort.Sort(snaps)
+
+	contents, err := json.MarshalIndent(
+		map[string]interface{}{"serves": snaps}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(t.statsPath(), append(contents, '\n'))
+}
@@ -1,45 +1,58 @@
 package main
 
 import (
+	"bytes"
 	"log"
 	"net"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/logplex/logplexc"
 )
 
-func syslogWorker(die dieCh, conn net.PacketConn, cfg logplexc.Config, sr *serveRecord) {
-	// Make world-writable so anything can connect and send logs.
-	// This may be be worth locking down more, but as-is unless
-	// pg_logplexcollector and the Postgres server share the same
-	// running user common umasks will be useless.
-	fi, err := os.Stat(sr.P)
+// Make a socket world-writable so anything can connect and send
+// logs.  This may be be worth locking down more, but as-is unless
+// pg_logplexcollector and the Postgres server share the same running
+// user common umasks will be useless.
+func makeWorldWritable(path string) {
+	fi, err := os.Stat(path)
 	if err != nil {
 		log.Fatalf(
 			"exiting, cannot stat just created socket %q: %v",
-			sr.P, err)
+			path, err)
 	}
 
-	err = os.Chmod(sr.P, fi.Mode().Perm()|0222)
+	err = os.Chmod(path, fi.Mode().Perm()|0222)
 	if err != nil {
 		log.Fatalf(
 			"exiting, cannot make just created socket "+
 				"world-writable %q: %v",
-			sr.P, err)
+			path, err)
 	}
+}
 
-	cfg.Logplex = sr.u
+func syslogWorker(die dieCh, conn net.PacketConn, cfg logplexc.Config, sr *serveRecord) {
+	makeWorldWritable(sr.P)
 
-	buf := make([]byte, 9*KB)
-	target, err := logplexc.NewClient(&cfg)
+	// Big enough for any datagram a unix socket will carry by
+	// default; anything longer is truncated, and counted.
+	buf := make([]byte, 208*KB)
+	target, err := acquireClient(sr, cfg, &sr.u)
 	if err != nil {
 		log.Fatalf("could not create auditing client: %v", err)
 	}
+	defer releaseClient(target)
+
+	frags := newFragmentReassembler(sr.syslogSequenceNumbers)
+	emit := func(m *syslogMessage) {
+		emitSyslogMessage(m, sr, target)
+	}
 
 	for {
 		select {
 		case <-die:
+			frags.flush(time.Time{}, emit)
 			return
 		default:
 			break
@@ -50,17 +63,23 @@ func syslogWorker(die dieCh, conn net.PacketConn, cfg logplexc.Config, sr *serve
 			log.Fatalf("could not set connection deadline: %v", err)
 		}
 
-		n, _, err := conn.ReadFrom(buf)
+		n, truncated, err := readDatagram(conn, buf)
+		if truncated {
+			sr.stats().incr("truncated")
+		}
+
+		now := time.Now()
 		if n > 0 {
-			// Just send the message wholesale, which
-			// leads to some weird syslog-in-syslog
-			// framing, but perhaps it's good enough.
-			target.BufferMessage(134, time.Now(),
-				"audit", "-", append([]byte(
-					"instance_type=shogun identity="+
-						sr.I+" "), buf[:n]...))
+			// buf is re-used for the next datagram, but
+			// messages may be held for reassembly.
+			data := append([]byte(nil), buf[:n]...)
+			frags.add(parseSyslogLeniently(data, now), now, emit)
 		}
 
+		// Messages whose last fragment was a while ago are
+		// as complete as they are going to get.
+		frags.flush(now.Add(-time.Second), emit)
+
 		if err != nil {
 			if err, ok := err.(net.Error); ok {
 				if err.Timeout() || err.Temporary() {
@@ -72,3 +91,98 @@ func syslogWorker(die dieCh, conn net.PacketConn, cfg logplexc.Config, sr *serve
 		}
 	}
 }
+
+// Read a datagram into buf, reporting whether it was too big to fit.
+func readDatagram(conn net.PacketConn, buf []byte) (int, bool, error) {
+	if uc, ok := conn.(*net.UnixConn); ok {
+		n, _, flags, _, err := uc.ReadMsgUnix(buf, nil)
+		return n, flags&syscall.MSG_TRUNC != 0, err
+	}
+
+	n, _, err := conn.ReadFrom(buf)
+	return n, false, err
+}
+
+// Parse a syslog message, falling back to taking all of data as the
+// message if it cannot be parsed, as was always done before syslog
+// messages were parsed at all.
+func parseSyslogLeniently(data []byte, now time.Time) *syslogMessage {
+	m, err := parseSyslog(data, now)
+	if err != nil {
+		return &syslogMessage{Priority: 134, Timestamp: now,
+			Message: data}
+	}
+
+	return m
+}
+
+// Send a syslog message on, preserving its metadata as far as
+// logplex's framing allows: the hostname (or application name) takes
+// the place logplex uses as the host, the application name and
+// process id are joined in the manner of emitLogRecord, and the
+// structured data, with the labels of the serve, is prefixed to the
+// message.
+func emitSyslogMessage(m *syslogMessage, sr *serveRecord,
+	target *logplexc.Client) {
+	host := m.Hostname
+	if host == "" {
+		host = m.AppName
+	}
+
+	if host == "" {
+		host = "audit"
+	}
+
+	procID := m.AppName
+	if m.ProcID != "" {
+		if procID == "" {
+			procID = m.ProcID
+		} else {
+			procID += "." + m.ProcID
+		}
+	}
+
+	if procID == "" {
+		procID = "-"
+	}
+
+	msg := bytes.Buffer{}
+	msg.WriteString(sr.auditHeader())
+
+	// Labels join the structured data the message came with, if
+	// any.
+	sd := m.StructuredData
+	if labels := sr.labelSDElement(); labels != "" {
+		if sd == "" || sd == "-" {
+			sd = labels
+		} else {
+			sd += labels
+		}
+	}
+
+	if sd != "" {
+		msg.WriteString(sd)
+		msg.WriteByte(' ')
+	}
+
+	msg.Write(redactMessage(sr, m.Message))
+
+	target.BufferMessage(m.Priority, m.Timestamp, host, procID,
+		msg.Bytes())
+}
+
+// Redact a message that is not broken into fields, if the serve calls
+// for it.
+func redactMessage(sr *serveRecord, text []byte) []byte {
+	if sr.redactor == nil {
+		return text
+	}
+
+	redacted := sr.redactor.redactText(string(text))
+	if redacted == string(text) {
+		return text
+	}
+
+	sr.stats().incr("redacted")
+	return []byte(redacted)
+}
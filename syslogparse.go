@@ -0,0 +1,367 @@
+// Parsing of syslog messages, in both the traditional BSD format of
+// RFC 3164, as written by syslog(3), and the format of RFC 5424.
+//
+// Also handled here is reassembly of messages Postgres splits into
+// fragments when log_destination includes syslog: Postgres breaks
+// messages at newlines and at about 900 bytes, and with
+// syslog_sequence_numbers (the default) it marks each fragment with
+// "[n-m] ", where n numbers the message and m the fragment.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type syslogMessage struct {
+	Priority  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+
+	// Structured data exactly as it appears in the message, or
+	// empty if there is none.
+	StructuredData string
+
+	Message []byte
+}
+
+var errNoPriority = errors.New("syslog message lacks a priority")
+
+// Parse a syslog message in either format.  now is used to fill in
+// the year RFC 3164 timestamps lack, and to date messages without a
+// timestamp at all.
+func parseSyslog(data []byte, now time.Time) (*syslogMessage, error) {
+	// Both formats start with <PRI>.
+	if len(data) < 3 || data[0] != '<' {
+		return nil, errNoPriority
+	}
+
+	end := bytes.IndexByte(data[:minInt(len(data), 5)], '>')
+	if end < 2 {
+		return nil, errNoPriority
+	}
+
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri > 191 {
+		return nil, fmt.Errorf("syslog message has invalid "+
+			"priority %q", data[1:end])
+	}
+
+	m := &syslogMessage{Priority: pri}
+	rest := data[end+1:]
+
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		return m, m.parse5424(rest[2:], now)
+	}
+
+	m.parse3164(rest, now)
+	return m, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// Split off the next space-delimited field.
+func nextSyslogField(data []byte) (field string, rest []byte) {
+	i := bytes.IndexByte(data, ' ')
+	if i < 0 {
+		return string(data), nil
+	}
+
+	return string(data[:i]), data[i+1:]
+}
+
+// RFC 5424's nil value.
+func syslogNil(s string) string {
+	if s == "-" {
+		return ""
+	}
+
+	return s
+}
+
+func (m *syslogMessage) parse5424(data []byte, now time.Time) error {
+	var ts string
+	ts, data = nextSyslogField(data)
+	m.Hostname, data = nextSyslogField(data)
+	m.AppName, data = nextSyslogField(data)
+	m.ProcID, data = nextSyslogField(data)
+	m.MsgID, data = nextSyslogField(data)
+
+	m.Hostname = syslogNil(m.Hostname)
+	m.AppName = syslogNil(m.AppName)
+	m.ProcID = syslogNil(m.ProcID)
+	m.MsgID = syslogNil(m.MsgID)
+
+	m.Timestamp = now
+	if ts != "-" {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return fmt.Errorf("syslog message has invalid "+
+				"timestamp %q", ts)
+		}
+
+		m.Timestamp = t
+	}
+
+	sdLen, err := structuredDataLen(data)
+	if err != nil {
+		return err
+	}
+
+	if sd := string(data[:sdLen]); sd != "-" {
+		m.StructuredData = sd
+	}
+
+	data = data[sdLen:]
+	if len(data) > 0 && data[0] == ' ' {
+		data = data[1:]
+	}
+
+	// Drop any UTF-8 byte order mark.
+	m.Message = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	return nil
+}
+
+// Find the length of the structured data at the start of data, which
+// is either "-", or one or more bracketed elements, inside of which
+// quoted values may contain escaped brackets and quotes.
+func structuredDataLen(data []byte) (int, error) {
+	if len(data) > 0 && data[0] == '-' {
+		return 1, nil
+	}
+
+	i := 0
+	for i < len(data) && data[i] == '[' {
+		inQuote := false
+		for i++; ; i++ {
+			if i >= len(data) {
+				return 0, errors.New("syslog message has " +
+					"unterminated structured data")
+			}
+
+			c := data[i]
+			if inQuote && c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuote = !inQuote
+			} else if c == ']' && !inQuote {
+				i++
+				break
+			}
+		}
+	}
+
+	if i == 0 {
+		return 0, errors.New("syslog message lacks structured data")
+	}
+
+	return i, nil
+}
+
+// Matches a tag of RFC 3164, such as "postgres[1234]:".
+var syslogTag = regexp.MustCompile(`^([^\s\[\]:]+)(?:\[([^\]]*)\])?:`)
+
+func (m *syslogMessage) parse3164(data []byte, now time.Time) {
+	// "Mmm dd hh:mm:ss ", where single-digit days are padded
+	// with a space.
+	const stampLen = len(time.Stamp)
+
+	m.Timestamp = now
+	if len(data) > stampLen && data[stampLen] == ' ' {
+		t, err := time.ParseInLocation(time.Stamp,
+			string(data[:stampLen]), now.Location())
+		if err == nil {
+			// Assume the current year, unless that puts the
+			// message well in the future, as happens around
+			// the new year.
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.Sub(now) > 24*time.Hour {
+				t = t.AddDate(-1, 0, 0)
+			}
+
+			m.Timestamp = t
+			data = data[stampLen+1:]
+		}
+	}
+
+	// Messages from syslog(3) through a local socket go without a
+	// hostname, so only take the first field as one if what
+	// follows it looks like a tag and it does not.
+	if !syslogTag.Match(data) {
+		host, rest := nextSyslogField(data)
+		if syslogTag.Match(rest) {
+			m.Hostname = host
+			data = rest
+		}
+	}
+
+	if tag := syslogTag.FindSubmatchIndex(data); tag != nil {
+		m.AppName = string(data[tag[2]:tag[3]])
+		if tag[4] >= 0 {
+			m.ProcID = string(data[tag[4]:tag[5]])
+		}
+
+		data = bytes.TrimPrefix(data[tag[1]:], []byte(" "))
+	}
+
+	m.Message = data
+}
+
+// Matches Postgres's markers of messages.  With
+// syslog_sequence_numbers, the default, every message is numbered:
+// "[n] " for a whole message, and "[n-m] " for its mth fragment
+// when syslog_split_messages breaks it up.  Without, only fragments
+// are marked, "[m] ".
+var pgSyslogFragment = regexp.MustCompile(`^\[(?:(\d+)-)?(\d+)\] `)
+
+const (
+	// Postgres breaks messages longer than this, PG_SYSLOG_LIMIT,
+	// preferably at a space.  Fragments nearly this long are
+	// taken to be broken because of their length, rather than at a
+	// newline.
+	pgSyslogLimit = 900
+	pgSyslogSlack = 100
+
+	// The most messages to hold while waiting for their
+	// remaining fragments, to bound memory.
+	maxPendingFragments = 1024
+)
+
+type fragmentKey struct {
+	host string
+	app  string
+	proc string
+}
+
+type fragmentedMessage struct {
+	*syslogMessage
+	seq     string
+	part    int
+	lastLen int
+	updated time.Time
+}
+
+// Reassembles Postgres's syslog fragments into whole messages.
+// Messages from other programs, or without fragment markers, are
+// passed through as-is, as are numbered messages that were not split.
+//
+// A fragmentReassembler may be shared by goroutines.
+type fragmentReassembler struct {
+	lock    sync.Mutex
+	pending map[fragmentKey]*fragmentedMessage
+
+	// Whether Postgres numbers its messages, which decides what
+	// a marker of one number is.
+	sequenceNumbers bool
+}
+
+func newFragmentReassembler(sequenceNumbers bool) *fragmentReassembler {
+	return &fragmentReassembler{
+		pending:         make(map[fragmentKey]*fragmentedMessage),
+		sequenceNumbers: sequenceNumbers,
+	}
+}
+
+// Add a message, calling emit for each message that is known to be
+// complete.
+func (r *fragmentReassembler) add(m *syslogMessage, now time.Time,
+	emit func(m *syslogMessage)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	match := pgSyslogFragment.FindSubmatchIndex(m.Message)
+	if match == nil {
+		emit(m)
+		return
+	}
+
+	text := m.Message[match[1]:]
+	key := fragmentKey{host: m.Hostname, app: m.AppName, proc: m.ProcID}
+
+	// "[n] " is a whole message when messages are numbered.
+	whole := r.sequenceNumbers && match[2] < 0
+
+	var seq string
+	var part int
+	if match[2] >= 0 {
+		seq = string(m.Message[match[2]:match[3]])
+	}
+
+	if !whole {
+		part, _ = strconv.Atoi(string(m.Message[match[4]:match[5]]))
+	}
+
+	if pm, ok := r.pending[key]; ok {
+		if !whole && pm.seq == seq && part == pm.part+1 {
+			if pm.lastLen < pgSyslogLimit-pgSyslogSlack {
+				pm.Message = append(pm.Message, '\n')
+			}
+
+			pm.Message = append(pm.Message, text...)
+			pm.part = part
+			pm.lastLen = len(text)
+			pm.updated = now
+			return
+		}
+
+		// A new message from the same process means the
+		// previous one is complete.
+		delete(r.pending, key)
+		emit(pm.syslogMessage)
+	}
+
+	if whole {
+		m.Message = text
+		emit(m)
+		return
+	}
+
+	if len(r.pending) >= maxPendingFragments {
+		r.flushUnsync(time.Time{}, emit)
+	}
+
+	m.Message = append([]byte(nil), text...)
+	r.pending[key] = &fragmentedMessage{
+		syslogMessage: m,
+		seq:           seq,
+		part:          part,
+		lastLen:       len(text),
+		updated:       now,
+	}
+}
+
+// Emit pending messages that have not been added to since before.
+// A zero before emits all of them.
+func (r *fragmentReassembler) flush(before time.Time,
+	emit func(m *syslogMessage)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.flushUnsync(before, emit)
+}
+
+func (r *fragmentReassembler) flushUnsync(before time.Time,
+	emit func(m *syslogMessage)) {
+	for key, pm := range r.pending {
+		if before.IsZero() || pm.updated.Before(before) {
+			delete(r.pending, key)
+			emit(pm.syslogMessage)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var syslogNow = time.Date(2014, time.May, 1, 10, 0, 0, 0, time.UTC)
+
+func TestParseSyslog3164(t *testing.T) {
+	for _, tt := range []struct {
+		in       string
+		host     string
+		app      string
+		proc     string
+		message  string
+		priority int
+	}{
+		// As written by syslog(3) to a local socket.
+		{"<134>May  1 09:59:59 postgres[4242]: [3-1] LOG:  hello",
+			"", "postgres", "4242", "[3-1] LOG:  hello", 134},
+		// As relayed with a hostname.
+		{"<13>May  1 09:59:59 db1 audit: something",
+			"db1", "audit", "", "something", 13},
+		// No tag at all.
+		{"<13>May  1 09:59:59 just words",
+			"", "", "", "just words", 13},
+	} {
+		m, err := parseSyslog([]byte(tt.in), syslogNow)
+		if err != nil {
+			t.Errorf("could not parse %q: %v", tt.in, err)
+			continue
+		}
+
+		if m.Hostname != tt.host || m.AppName != tt.app ||
+			m.ProcID != tt.proc || string(m.Message) != tt.message ||
+			m.Priority != tt.priority {
+			t.Errorf("parsed %q as %+v", tt.in, m)
+		}
+
+		want := time.Date(2014, time.May, 1, 9, 59, 59, 0, time.UTC)
+		if !m.Timestamp.Equal(want) {
+			t.Errorf("parsed timestamp of %q as %v", tt.in, m.Timestamp)
+		}
+	}
+}
+
+func TestParseSyslog5424(t *testing.T) {
+	in := `<165>1 2014-05-01T09:59:59.123Z db1 postgres 4242 ID47 ` +
+		`[exampleSDID@32473 iut="3" eventSource="App\]lication"] ` +
+		"\xef\xbb\xbfan event"
+
+	m, err := parseSyslog([]byte(in), syslogNow)
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+
+	if m.Priority != 165 || m.Hostname != "db1" || m.AppName != "postgres" ||
+		m.ProcID != "4242" || m.MsgID != "ID47" ||
+		string(m.Message) != "an event" {
+		t.Errorf("unexpected parse %+v", m)
+	}
+
+	if m.StructuredData != `[exampleSDID@32473 iut="3" eventSource="App\]lication"]` {
+		t.Errorf("unexpected structured data %q", m.StructuredData)
+	}
+
+	m, err = parseSyslog([]byte("<14>1 - - - - - -"), syslogNow)
+	if err != nil {
+		t.Fatalf("could not parse all-nil message: %v", err)
+	}
+
+	if m.Hostname != "" || m.StructuredData != "" || len(m.Message) != 0 {
+		t.Errorf("unexpected parse %+v", m)
+	}
+
+	for _, bad := range []string{"no priority", "<999>1 - - - - - -",
+		"<14>1 bogus-time - - - - -", "<14>1 - - - - - [unterminated"} {
+		if _, err := parseSyslog([]byte(bad), syslogNow); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	r := newFragmentReassembler(true)
+
+	var got []string
+	emit := func(m *syslogMessage) {
+		got = append(got, string(m.Message))
+	}
+
+	add := func(s string) {
+		m, err := parseSyslog([]byte(s), syslogNow)
+		if err != nil {
+			t.Fatalf("could not parse %q: %v", s, err)
+		}
+
+		r.add(m, syslogNow, emit)
+	}
+
+	long := strings.Repeat("x", pgSyslogLimit)
+
+	add("<134>May  1 09:59:59 postgres[1]: [5-1] LOG:  statement: SELECT 1,")
+	add("<134>May  1 09:59:59 postgres[1]: [5-2] #011  2")
+	add("<134>May  1 09:59:59 postgres[2]: [1-1] " + long)
+	add("<134>May  1 09:59:59 postgres[2]: [1-2]  and more")
+	add("<134>May  1 09:59:59 postgres[1]: [6] LOG:  next")
+	add("<134>May  1 09:59:59 postgres[1]: [7] LOG:  and the next")
+	add("<134>May  1 09:59:59 cron[3]: unfragmented")
+
+	// Whole messages are numbered, and go out at once.
+	if len(got) != 4 ||
+		got[0] != "LOG:  statement: SELECT 1,\n#011  2" ||
+		got[1] != "LOG:  next" || got[2] != "LOG:  and the next" ||
+		got[3] != "unfragmented" {
+		t.Fatalf("unexpected messages before flush: %q", got)
+	}
+
+	got = nil
+	r.flush(syslogNow.Add(time.Second), emit)
+
+	if len(got) != 1 || got[0] != long+" and more" {
+		t.Fatalf("unexpected messages from flush: %q", got)
+	}
+
+	// Without sequence numbers, only fragments are marked.
+	r = newFragmentReassembler(false)
+	got = nil
+	add("<134>May  1 09:59:59 postgres[1]: [1] LOG:  statement: SELECT 1,")
+	add("<134>May  1 09:59:59 postgres[1]: [2] #011  2")
+	add("<134>May  1 09:59:59 postgres[1]: [1] LOG:  next")
+	r.flush(time.Time{}, emit)
+
+	if len(got) != 2 ||
+		got[0] != "LOG:  statement: SELECT 1,\n#011  2" ||
+		got[1] != "LOG:  next" {
+		t.Fatalf("unexpected messages without sequence numbers: %q",
+			got)
+	}
+}
@@ -0,0 +1,260 @@
+// Receipt of syslog messages over stream sockets: unix stream
+// sockets, TCP, and TCP with TLS, as used by forwarders like rsyslog.
+//
+// Unlike datagrams, streams need framing to separate messages.  Both
+// methods of RFC 6587 are supported, and may even be mixed on one
+// connection: octet counting, where each message is preceded by its
+// length in decimal and a space, and non-transparent framing, where
+// each message ends with a newline.  Octet counting is preferred, as
+// it allows messages to contain newlines.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/logplex/logplexc"
+)
+
+// The longest syslog message accepted; longer ones are truncated.
+// This matches the limit on records from pg_logfebe.
+const maxSyslogMessage = 1 * MB
+
+// Listen on sr.P for the stream-oriented syslog protocols.
+func listenSyslogStream(sr *serveRecord) (net.Listener, error) {
+	switch sr.protocol {
+	case "syslog-stream":
+		l, err := net.Listen("unix", sr.P)
+		if err != nil {
+			return nil, err
+		}
+
+		// The next generation of the serve removes the socket
+		// and binds it anew; closing this listener must not
+		// remove that one.
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		return l, nil
+	case "syslog-tcp":
+		return net.Listen("tcp", sr.P)
+	case "syslog-tls":
+		cert, err := tls.LoadX509KeyPair(sr.tlsCert, sr.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return tls.Listen("tcp", sr.P, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+	}
+
+	return nil, fmt.Errorf("not a syslog stream protocol: %q",
+		sr.protocol)
+}
+
+// Accept connections on l until die is closed, then close l and
+// call closed.
+func syslogStreamWorker(die dieCh, l net.Listener, closed func(),
+	cfg logplexc.Config, sr *serveRecord) {
+	if sr.protocol == "syslog-stream" {
+		makeWorldWritable(sr.P)
+	}
+
+	target, err := acquireClient(sr, cfg, &sr.u)
+	if err != nil {
+		log.Fatalf("could not create auditing client: %v", err)
+	}
+	defer releaseClient(target)
+
+	// Fragments are reassembled across all connections: a
+	// forwarder may well reconnect part of the way through a
+	// message.
+	frags := newFragmentReassembler(sr.syslogSequenceNumbers)
+	emit := func(m *syslogMessage) {
+		emitSyslogMessage(m, sr, target)
+	}
+
+	// Periodically send messages whose last fragment was a while
+	// ago, and close the listener when asked to exit, to break
+	// out of Accept and let the next generation of the serve
+	// listen in its place.
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-die:
+				l.Close()
+				closed()
+				frags.flush(time.Time{}, emit)
+				return
+			case now := <-ticker.C:
+				frags.flush(now.Add(-time.Second), emit)
+			}
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-die:
+				log.Print("listener exits normally from die request")
+				return
+			default:
+			}
+
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				log.Printf("accept error: %v", err)
+				continue
+			}
+
+			log.Fatalf("serve database suffers unrecoverable "+
+				"error: %v", err)
+		}
+
+		go serveSyslogStream(die, conn, sr, frags, emit)
+	}
+}
+
+func serveSyslogStream(die dieCh, conn net.Conn, sr *serveRecord,
+	frags *fragmentReassembler, emit func(m *syslogMessage)) {
+	// Close the connection when asked to exit, to break out of
+	// reading from it.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-die:
+		case <-done:
+		}
+
+		conn.Close()
+	}()
+
+	r := newSyslogFrameReader(conn, maxSyslogMessage)
+	for {
+		frame, truncated, err := r.next()
+		if truncated {
+			sr.stats().incr("truncated")
+		}
+
+		if len(frame) > 0 {
+			now := time.Now()
+			frags.add(parseSyslogLeniently(frame, now), now, emit)
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-die:
+				default:
+					log.Printf("syslog stream error from %v: %v",
+						conn.RemoteAddr(), err)
+				}
+			}
+
+			return
+		}
+	}
+}
+
+// Reads RFC 6587 frames from a stream.
+type syslogFrameReader struct {
+	r   *bufio.Reader
+	max int
+}
+
+func newSyslogFrameReader(r io.Reader, max int) *syslogFrameReader {
+	return &syslogFrameReader{r: bufio.NewReader(r), max: max}
+}
+
+// Read the next frame, which is a fresh copy.  Frames longer than the
+// maximum are truncated to it, and reported as such.
+func (f *syslogFrameReader) next() (frame []byte, truncated bool, err error) {
+	// Skip stray whitespace between frames, which some senders
+	// emit after octet-counted frames.
+	for {
+		c, err := f.r.ReadByte()
+		if err != nil {
+			return nil, false, err
+		}
+
+		if c != '\n' && c != '\r' && c != ' ' && c != 0 {
+			f.r.UnreadByte()
+			break
+		}
+	}
+
+	if c, _ := f.r.Peek(1); len(c) == 1 && c[0] >= '1' && c[0] <= '9' {
+		return f.nextCounted()
+	}
+
+	return f.nextDelimited()
+}
+
+func (f *syslogFrameReader) nextCounted() ([]byte, bool, error) {
+	lenText, err := f.r.ReadSlice(' ')
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed octet count: %v", err)
+	}
+
+	n, err := strconv.Atoi(string(lenText[:len(lenText)-1]))
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed octet count %q",
+			lenText)
+	}
+
+	keep := n
+	if keep > f.max {
+		keep = f.max
+	}
+
+	frame := make([]byte, keep)
+	if _, err := io.ReadFull(f.r, frame); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, f.r, int64(n-keep)); err != nil {
+		return frame, true, err
+	}
+
+	return frame, keep < n, nil
+}
+
+func (f *syslogFrameReader) nextDelimited() ([]byte, bool, error) {
+	var frame []byte
+	truncated := false
+
+	for {
+		chunk, err := f.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			frame, truncated = f.appendLimited(frame, chunk, truncated)
+			continue
+		}
+
+		frame, truncated = f.appendLimited(frame,
+			bytes.TrimRight(chunk, "\r\n\x00"), truncated)
+		return frame, truncated, err
+	}
+}
+
+func (f *syslogFrameReader) appendLimited(frame []byte, chunk []byte,
+	truncated bool) ([]byte, bool) {
+	room := f.max - len(frame)
+	if len(chunk) > room {
+		chunk = chunk[:room]
+		truncated = true
+	}
+
+	return append(frame, chunk...), truncated
+}
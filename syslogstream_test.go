@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSyslogFrameReader(t *testing.T) {
+	in := "25 <13>1 - - - - - - one\ntwo" +
+		"<13>Oct 11 22:14:15 app: three\n" +
+		"\n" +
+		"5 <13>x" +
+		"<13>Oct 11 22:14:15 app: unterminated"
+
+	r := newSyslogFrameReader(strings.NewReader(in), 1*KB)
+
+	var got []string
+	for {
+		frame, truncated, err := r.next()
+		if truncated {
+			t.Errorf("frame %q should not be truncated", frame)
+		}
+
+		if len(frame) > 0 {
+			got = append(got, string(frame))
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	want := []string{
+		"<13>1 - - - - - - one\ntwo",
+		"<13>Oct 11 22:14:15 app: three",
+		"<13>x",
+		"<13>Oct 11 22:14:15 app: unterminated",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected frames %q, got %q", want, got)
+	}
+}
+
+func TestSyslogFrameReaderTruncation(t *testing.T) {
+	in := "23 <13>1 - - - - - - 12345" +
+		"<13>" + strings.Repeat("y", 20) + "\n" +
+		"<13>ok\n"
+
+	r := newSyslogFrameReader(strings.NewReader(in), 10)
+
+	for _, want := range []struct {
+		frame     string
+		truncated bool
+	}{
+		{"<13>1 - - ", true},
+		{"<13>yyyyyy", true},
+		{"<13>ok", false},
+	} {
+		frame, truncated, err := r.next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if string(frame) != want.frame || truncated != want.truncated {
+			t.Errorf("expected %q (truncated %v), got %q (%v)",
+				want.frame, want.truncated, frame, truncated)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+// Following of log files through rotation and truncation.
+//
+// A file is identified by its device and inode rather than its name,
+// because rotation (by logrotate, or Postgres's own log_rotation_age
+// and log_rotation_size) renames or re-creates files under the same
+// name.  When a new file appears at the tailed path, the old one is
+// read to its end before switching, so lines written just before the
+// rotation are not lost.  When a file shrinks, or its first bytes
+// change, as when it is truncated by copytruncate and written past
+// where it was read to before the next look at it, it is taken to
+// have been truncated and is read again from its beginning.
+//
+// The position reached is checkpointed in the serve database, so
+// that a restart of pg_logplexcollector, or a reload of the serve
+// database, resumes where it left off rather than starting over:
+//
+//     servedb
+//     └── checkpoints
+//         └── %2Fvar%2Flog%2Fpostgresql%2Fpostgresql.csv
+//
+// Checkpoints are named after the escaped path of the tailed file,
+// and hold its identity, its first bytes, and the offset of the first
+// byte not yet handled.  Only one tailer of a path runs at a time, so
+// that on a reload, the tailer of the new generation loads the
+// checkpoint only once that of the old has written its last.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/go-fsnotify/fsnotify"
+)
+
+// Where to start reading a file that is tailed for the first time.
+const (
+	startBeginning  = "beginning"
+	startEnd        = "end"
+	startCheckpoint = "checkpoint"
+)
+
+const (
+	// How often to look for changes to the tailed file even
+	// without notification from the file system, which can miss
+	// events such as rotations.
+	tailPollInterval = time.Second
+
+	// How often, at most, to rewrite the checkpoint.
+	checkpointInterval = time.Second
+
+	// How many of the first bytes of a file are remembered, to
+	// tell when it has been truncated and written anew.
+	headSize = 128
+)
+
+// The persisted position in a tailed file.
+type tailCheckpoint struct {
+	Dev    uint64 `json:"dev"`
+	Ino    uint64 `json:"ino"`
+	Offset int64  `json:"offset"`
+	Head   []byte `json:"head,omitempty"`
+}
+
+type tailer struct {
+	path     string
+	ckptPath string
+	start    string
+	handle   func(line []byte)
+
+	// Called after every check of the file, once there is
+	// nothing more to read for the moment, and once tailing stops,
+	// before the last checkpoint is written.  Either may be nil.
+	idle func()
+	stop func()
+
+	// How many bytes of the lines handled so far are held back in
+	// a record not yet complete, or nil if none ever are.
+	held func() int
+
+	// The file currently being read, or nil if it has not been
+	// opened yet.
+	f  *os.File
+	fi os.FileInfo
+	r  *bufio.Reader
+
+	// Offset in f of the first byte not yet handed to handle,
+	// and the bytes beyond it that do not yet form a whole
+	// line.
+	offset  int64
+	pending []byte
+
+	// The first bytes of f, as far as they have been read, up
+	// to headSize.
+	head []byte
+
+	lastCheckpoint time.Time
+	checkpointed   int64
+}
+
+func checkpointsDir(dbDir string) string {
+	return path.Join(dbDir, "checkpoints")
+}
+
+func newTailer(sr *serveRecord, handle func(line []byte)) *tailer {
+	return &tailer{
+		path: sr.P,
+		ckptPath: path.Join(checkpointsDir(sr.dbDir),
+			url.QueryEscape(sr.P)),
+		start:        sr.start,
+		handle:       handle,
+		checkpointed: -1,
+	}
+}
+
+// Call handle with each complete line appended to the file at
+// sr.P, including its trailing newline, until die is closed.  Each
+// time the end of the file is reached, idle is called, and once die
+// is closed, stop is called before the last checkpoint is written, so
+// that anything held back from lines already read is handled first.
+// Checkpoints otherwise stop short of the last held bytes, as told by
+// held, so that they are read again should the collector exit
+// without stopping.  Any of the three may be nil.
+//
+// A line that is still being written when the end of the file is
+// reached is held back until the rest of it arrives.
+func tailFile(die dieCh, sr *serveRecord, handle func(line []byte),
+	idle func(), stop func(), held func() int) {
+	t := newTailer(sr, handle)
+	t.idle = idle
+	t.stop = stop
+	t.held = held
+
+	// Wait for any tailer of the last generation of the serve
+	// database to write its final checkpoint.
+	defer lockPath(t.ckptPath)()
+	defer t.close()
+
+	// Watch the directory rather than the file, to learn of
+	// files being renamed and created as well as written.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("can't create watcher: %v", err)
+	} else {
+		defer watcher.Close()
+
+		if err := watcher.Add(path.Dir(t.path)); err != nil {
+			log.Printf("can't add watcher: %v", err)
+		}
+	}
+
+	var events chan fsnotify.Event
+	var errors chan error
+	if watcher != nil {
+		events = watcher.Events
+		errors = watcher.Errors
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+
+	t.poll()
+
+	for {
+		select {
+		case <-die:
+			return
+		case <-events:
+			t.poll()
+		case err := <-errors:
+			log.Printf("unexpected fs watch error %v:", err)
+		case <-ticker.C:
+			t.poll()
+		}
+	}
+}
+
+// Catch up with whatever has happened to the tailed file.
+func (t *tailer) poll() {
+	if t.f == nil && !t.open() {
+		return
+	}
+
+	// Detect truncation: the file is now shorter than what has
+	// already been read, or begins differently.  What lies past
+	// the offset then is not the rest of what was read.
+	if t.truncated() {
+		log.Printf("%q was truncated, reading it from the start",
+			t.path)
+		t.seek(0)
+	}
+
+	t.readToEOF()
+	t.rememberHead()
+
+	// Detect rotation: another file now sits at the tailed path.
+	// The old one has just been read to its end, so switch to
+	// the new one.
+	if fi, err := os.Stat(t.path); err == nil && !os.SameFile(fi, t.fi) {
+		log.Printf("%q was rotated, following the new file", t.path)
+		t.f.Close()
+		t.f = nil
+
+		if t.open() {
+			t.readToEOF()
+		}
+	}
+
+	if t.idle != nil {
+		t.idle()
+	}
+
+	t.maybeCheckpoint(false)
+}
+
+// Open the file at the tailed path, positioning it according to the
+// start setting.  Returns false if the file cannot be opened, which
+// is expected while it is being rotated.
+func (t *tailer) open() bool {
+	f, err := os.Open(t.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("cannot open %q for tailing: %v", t.path, err)
+		}
+
+		return false
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("cannot stat %q for tailing: %v", t.path, err)
+		f.Close()
+		return false
+	}
+
+	t.f = f
+	t.fi = fi
+
+	var offset int64
+	switch t.start {
+	case startBeginning:
+		offset = 0
+	case startEnd:
+		offset = fi.Size()
+	default:
+		// Resume from the checkpoint if it is for this very
+		// file.  A checkpoint for some other file means this
+		// one was created by a rotation while nobody was
+		// watching, so it is all new.  Without any checkpoint
+		// at all, skip what has been written in the past.
+		ckpt, err := t.loadCheckpoint()
+		switch {
+		case err != nil:
+			offset = fi.Size()
+		case !sameFileAsCheckpoint(fi, ckpt):
+			offset = 0
+		case ckpt.Offset > fi.Size():
+			offset = 0
+		case !bytes.Equal(t.readHead(int64(len(ckpt.Head))),
+			ckpt.Head):
+			offset = 0
+		default:
+			offset = ckpt.Offset
+		}
+	}
+
+	t.seek(offset)
+	t.rememberHead()
+
+	// Once a file has been opened, later files at the same path
+	// are new ones produced by rotation.
+	t.start = startBeginning
+
+	return true
+}
+
+func (t *tailer) seek(offset int64) {
+	if _, err := t.f.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("cannot seek %q to %d: %v", t.path, offset, err)
+	}
+
+	t.offset = offset
+	t.pending = nil
+	t.head = nil
+	t.r = bufio.NewReader(t.f)
+}
+
+// Read up to n of the first bytes of the file.
+func (t *tailer) readHead(n int64) []byte {
+	b := make([]byte, n)
+	m, err := t.f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		log.Printf("cannot read %q: %v", t.path, err)
+	}
+
+	return b[:m]
+}
+
+// Remember more of the first bytes of the file, as far as they have
+// been read.
+func (t *tailer) rememberHead() {
+	n := t.offset
+	if n > headSize {
+		n = headSize
+	}
+
+	if int64(len(t.head)) < n {
+		t.head = t.readHead(n)
+	}
+}
+
+// Whether the file has been truncated since it was last read.
+func (t *tailer) truncated() bool {
+	fi, err := t.f.Stat()
+	if err != nil {
+		return false
+	}
+
+	if fi.Size() < t.offset {
+		return true
+	}
+
+	return len(t.head) > 0 &&
+		!bytes.Equal(t.readHead(int64(len(t.head))), t.head)
+}
+
+func (t *tailer) readToEOF() {
+	for {
+		l, err := t.r.ReadBytes('\n')
+		if err == nil {
+			if t.pending != nil {
+				l = append(t.pending, l...)
+				t.pending = nil
+			}
+
+			t.offset += int64(len(l))
+			t.handle(l)
+			continue
+		}
+
+		t.pending = append(t.pending, l...)
+		if err != io.EOF {
+			log.Printf("unexpected read error: %v", err)
+		}
+
+		return
+	}
+}
+
+// The offset of the first byte of f not yet handled as part of a
+// whole record.
+func (t *tailer) committed() int64 {
+	if t.held == nil {
+		return t.offset
+	}
+
+	// A record begun in the file before a rotation is held along
+	// with all of this one that has been read.
+	offset := t.offset - int64(t.held())
+	if offset < 0 {
+		offset = 0
+	}
+
+	return offset
+}
+
+func (t *tailer) close() {
+	if t.stop != nil {
+		t.stop()
+		t.stop = nil
+	}
+
+	if t.f != nil {
+		t.maybeCheckpoint(true)
+		t.f.Close()
+	}
+}
+
+func fileIdentity(fi os.FileInfo) (dev uint64, ino uint64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+
+	return 0, 0
+}
+
+func sameFileAsCheckpoint(fi os.FileInfo, ckpt *tailCheckpoint) bool {
+	dev, ino := fileIdentity(fi)
+	return dev == ckpt.Dev && ino == ckpt.Ino
+}
+
+func (t *tailer) loadCheckpoint() (*tailCheckpoint, error) {
+	contents, err := ioutil.ReadFile(t.ckptPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ckpt tailCheckpoint
+	if err := json.Unmarshal(contents, &ckpt); err != nil {
+		return nil, fmt.Errorf("corrupt checkpoint %q: %v",
+			t.ckptPath, err)
+	}
+
+	return &ckpt, nil
+}
+
+// Persist the current position, unless it has not changed or was
+// persisted very recently; force skips the latter check.
+func (t *tailer) maybeCheckpoint(force bool) {
+	offset := t.committed()
+	if t.f == nil || offset == t.checkpointed {
+		return
+	}
+
+	if !force && time.Since(t.lastCheckpoint) < checkpointInterval {
+		return
+	}
+
+	dev, ino := fileIdentity(t.fi)
+	contents, err := json.Marshal(&tailCheckpoint{
+		Dev: dev, Ino: ino, Offset: offset, Head: t.head})
+	if err != nil {
+		panic(err)
+	}
+
+	dir := path.Dir(t.ckptPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("cannot create checkpoint directory %q: %v",
+			dir, err)
+		return
+	}
+
+	if err := replaceFile(t.ckptPath, contents); err != nil {
+		log.Printf("cannot write checkpoint %q: %v", t.ckptPath, err)
+		return
+	}
+
+	t.checkpointed = offset
+	t.lastCheckpoint = time.Now()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type tailFixture struct {
+	t     *testing.T
+	dir   string
+	sr    serveRecord
+	lines []string
+}
+
+func newTailFixture(t *testing.T, start string) *tailFixture {
+	dir := newTmpDb(t)
+	return &tailFixture{
+		t:   t,
+		dir: dir,
+		sr: serveRecord{
+			sKey:  sKey{I: "tail", P: path.Join(dir, "postgresql.log")},
+			dbDir: dir,
+			start: start,
+		},
+	}
+}
+
+func (f *tailFixture) tailer() *tailer {
+	return newTailer(&f.sr, func(l []byte) {
+		f.lines = append(f.lines, string(l))
+	})
+}
+
+func (f *tailFixture) append(s string) {
+	fh, err := os.OpenFile(f.sr.P,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		f.t.Fatalf("could not open log file: %v", err)
+	}
+	defer fh.Close()
+
+	if _, err := fh.WriteString(s); err != nil {
+		f.t.Fatalf("could not write log file: %v", err)
+	}
+}
+
+func (f *tailFixture) expect(lines ...string) {
+	if len(lines) == 0 {
+		lines = nil
+	}
+
+	if !reflect.DeepEqual(f.lines, lines) {
+		f.t.Fatalf("expected lines %q, got %q", lines, f.lines)
+	}
+
+	f.lines = nil
+}
+
+func TestTailPartialLines(t *testing.T) {
+	f := newTailFixture(t, startBeginning)
+	defer os.RemoveAll(f.dir)
+
+	f.append("one\ntw")
+	tl := f.tailer()
+	defer tl.close()
+
+	tl.poll()
+	f.expect("one\n")
+
+	f.append("o\n")
+	tl.poll()
+	f.expect("two\n")
+}
+
+func TestTailRotation(t *testing.T) {
+	f := newTailFixture(t, startBeginning)
+	defer os.RemoveAll(f.dir)
+
+	f.append("one\n")
+	tl := f.tailer()
+	defer tl.close()
+	tl.poll()
+	f.expect("one\n")
+
+	// Write to the old file after it has been renamed away, and
+	// then start a new one: both lines should be seen, in order.
+	f.append("two\n")
+	if err := os.Rename(f.sr.P, f.sr.P+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f.append("three\n")
+
+	tl.poll()
+	f.expect("two\n", "three\n")
+}
+
+func TestTailTruncation(t *testing.T) {
+	f := newTailFixture(t, startBeginning)
+	defer os.RemoveAll(f.dir)
+
+	f.append("a long first line\n")
+	tl := f.tailer()
+	defer tl.close()
+	tl.poll()
+	f.expect("a long first line\n")
+
+	if err := os.Truncate(f.sr.P, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.append("short\n")
+
+	tl.poll()
+	f.expect("short\n")
+}
+
+func TestTailCheckpoint(t *testing.T) {
+	f := newTailFixture(t, startCheckpoint)
+	defer os.RemoveAll(f.dir)
+
+	// Without a checkpoint, what is already in the file is
+	// skipped.
+	f.append("old\n")
+	tl := f.tailer()
+	tl.poll()
+	f.expect()
+
+	f.append("new\n")
+	tl.poll()
+	f.expect("new\n")
+	tl.close()
+
+	if _, err := ioutil.ReadFile(tl.ckptPath); err != nil {
+		t.Fatalf("expected a checkpoint to be written: %v", err)
+	}
+
+	// A new tailer resumes where the old one left off.
+	f.append("newer\n")
+	tl = f.tailer()
+	defer tl.close()
+	tl.poll()
+	f.expect("newer\n")
+}
+
+func TestTailCopyTruncate(t *testing.T) {
+	f := newTailFixture(t, startBeginning)
+	defer os.RemoveAll(f.dir)
+
+	f.append("2014-05-01 10:00:00 first\n")
+	tl := f.tailer()
+	defer tl.close()
+	tl.poll()
+	f.expect("2014-05-01 10:00:00 first\n")
+
+	// Truncated and written past where it was read to, all
+	// between two looks at it.
+	if err := os.Truncate(f.sr.P, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.append("2014-05-01 11:00:00 after copytruncate\n")
+
+	tl.poll()
+	f.expect("2014-05-01 11:00:00 after copytruncate\n")
+
+	// The same goes for a file truncated while nobody watched.
+	tl.close()
+	if err := os.Truncate(f.sr.P, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.append("2014-05-01 12:00:00 while stopped, and long\n")
+
+	f.sr.start = startCheckpoint
+	tl = f.tailer()
+	defer tl.close()
+	tl.poll()
+	f.expect("2014-05-01 12:00:00 while stopped, and long\n")
+}
+
+func TestTailHandoff(t *testing.T) {
+	f := newTailFixture(t, startCheckpoint)
+	defer os.RemoveAll(f.dir)
+
+	// The tailer of a new generation waits for that of the old to
+	// let go of the path.
+	unlock := lockPath(f.tailer().ckptPath)
+
+	locked := make(chan struct{})
+	go func() {
+		defer lockPath(f.tailer().ckptPath)()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("expected the second tailer to wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+}
+
+func TestTailStop(t *testing.T) {
+	f := newTailFixture(t, startBeginning)
+	defer os.RemoveAll(f.dir)
+
+	f.append("one\n")
+	tl := f.tailer()
+	tl.poll()
+	f.append("two\n")
+	tl.poll()
+
+	offset := func() int64 {
+		var ckpt tailCheckpoint
+		contents, err := ioutil.ReadFile(tl.ckptPath)
+		if err == nil {
+			err = json.Unmarshal(contents, &ckpt)
+		}
+
+		if err != nil {
+			t.Fatalf("could not read checkpoint: %v", err)
+		}
+
+		return ckpt.Offset
+	}
+
+	// Whatever is held back from lines already read is handled
+	// before the last checkpoint says they were.
+	stopped := false
+	tl.stop = func() {
+		stopped = true
+		if n := offset(); n != int64(len("one\n")) {
+			t.Fatalf("checkpoint written before stop: %d", n)
+		}
+	}
+
+	tl.close()
+	if !stopped || offset() != int64(len("one\ntwo\n")) {
+		t.Fatalf("expected stop and then the last checkpoint, "+
+			"got %v and %d", stopped, offset())
+	}
+}
+
+func TestTailHeld(t *testing.T) {
+	f := newTailFixture(t, startBeginning)
+	defer os.RemoveAll(f.dir)
+
+	// "two" begins a record that is not yet complete.
+	f.append("one\ntwo\n")
+	tl := f.tailer()
+	tl.held = func() int {
+		if n := len(f.lines); n > 0 && f.lines[n-1] == "two\n" {
+			return len("two\n")
+		}
+
+		return 0
+	}
+
+	tl.poll()
+	f.expect("one\n", "two\n")
+
+	// Exiting without stopping leaves the checkpoint at the start
+	// of the held record, which is read again.
+	tl.f.Close()
+	f.sr.start = startCheckpoint
+	tl = f.tailer()
+	defer tl.close()
+	tl.poll()
+	f.expect("two\n")
+}
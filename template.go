@@ -0,0 +1,159 @@
+// Formatting of records in the text format by a template of the
+// serve, in the language of text/template, or one of the presets:
+//
+//     "legacy", the default, the message followed by the detail,
+//     hint, and query, a line each, as formatTextMessage renders it.
+//
+//     "logfmt", every field of the record as key=value pairs on one
+//     line.
+//
+//     "stderr", like Postgres's own stderr log, with a line for the
+//     message and for each of the detail, hint, context, and query.
+//
+// Templates are given a recordTemplateData, whose fields are strings
+// that are empty where the record has nothing, and may use "quote" to
+// quote a string as Go would.  Records sent to the audit URL are
+// prefixed with the identity of the serve whatever the template, as
+// the audit endpoint may be multiplexed, and with the labels of the
+// serve, if it has any.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"text/template"
+)
+
+const (
+	templateLegacy = "legacy"
+	templateLogfmt = "logfmt"
+	templateStderr = "stderr"
+)
+
+var templatePresets = map[string]string{
+	templateLogfmt: `{{.OneLine}}`,
+	templateStderr: `{{with .Name}}[{{.}}] {{end}}` +
+		`{{.Time}} [{{.Pid}}] {{.Severity}}:  {{.Message}}` +
+		`{{with .Detail}}` + "\n" + `DETAIL:  {{.}}{{end}}` +
+		`{{with .Hint}}` + "\n" + `HINT:  {{.}}{{end}}` +
+		`{{with .Context}}` + "\n" + `CONTEXT:  {{.}}{{end}}` +
+		`{{with .Query}}` + "\n" + `STATEMENT:  {{.}}{{end}}`,
+}
+
+var templateFuncs = template.FuncMap{"quote": strconv.Quote}
+
+// What templates are given to render a record with.
+type recordTemplateData struct {
+	// Of the serve.
+	Name     string
+	Identity string
+
+	Time        string
+	Pid         int32
+	Severity    string
+	SQLState    string
+	Condition   string
+	Class       string
+	User        string
+	Database    string
+	ClientAddr  string
+	Application string
+	SessionID   string
+	SeqNum      int64
+	Message     string
+	Detail      string
+	Hint        string
+	Context     string
+	Query       string
+
+	// The record itself, for anything else.
+	Record *logRecord
+}
+
+func newRecordTemplateData(lr *logRecord, sr *serveRecord) *recordTemplateData {
+	d := &recordTemplateData{
+		Name:        sr.Name,
+		Identity:    sr.I,
+		Time:        lr.LogTime,
+		Pid:         lr.Pid,
+		Severity:    elevelName(lr.ELevel),
+		User:        nullString(lr.UserName),
+		Database:    nullString(lr.DatabaseName),
+		ClientAddr:  nullString(lr.ClientAddr),
+		Application: nullString(lr.ApplicationName),
+		SessionID:   lr.SessionID,
+		SeqNum:      lr.SeqNum,
+		Message:     nullString(lr.ErrMessage),
+		Detail:      nullString(lr.ErrDetail),
+		Hint:        nullString(lr.ErrHint),
+		Context:     nullString(lr.ErrContext),
+		Query:       nullString(lr.UserQuery),
+		Record:      lr,
+	}
+
+	if lr.SQLState != nil {
+		d.SQLState = *lr.SQLState
+		d.Condition = sqlstateCondition(d.SQLState)
+		d.Class = sqlstateClassName(d.SQLState)
+	}
+
+	return d
+}
+
+// The record as key=value pairs on one line.
+func (d *recordTemplateData) OneLine() string {
+	return string(d.Record.oneLine())
+}
+
+// Compile the "template" of a serve record: a preset, or the text of
+// a template.  Templates are tried on a record to catch references to
+// fields that do not exist.  The legacy preset needs no template, and
+// nil is returned for it.
+func parseRecordTemplate(text string) (*template.Template, error) {
+	if text == templateLegacy {
+		return nil, nil
+	}
+
+	if preset, ok := templatePresets[text]; ok {
+		text = preset
+	}
+
+	tmpl, err := template.New("record").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid \"template\" in serve "+
+			"record: %v", err)
+	}
+
+	lr := &logRecord{ErrMessage: new(string)}
+	if err := tmpl.Execute(ioutil.Discard,
+		newRecordTemplateData(lr, &serveRecord{})); err != nil {
+		return nil, fmt.Errorf("invalid \"template\" in serve "+
+			"record: %v", err)
+	}
+
+	return tmpl, nil
+}
+
+// Render a record by the template of the serve, falling back to the
+// legacy format should the template fail, keeping what it begins with
+// apart from the rest.
+func formatTemplateParts(lr *logRecord, sr *serveRecord,
+	isAudit bool) (string, []byte) {
+	var b bytes.Buffer
+
+	if err := sr.template.Execute(&b,
+		newRecordTemplateData(lr, sr)); err != nil {
+		sr.stats().incr("template_errors")
+		return textRecordHead(sr, isAudit), formatTextMessage(lr)
+	}
+
+	head := sr.labelPrefix()
+	if isAudit {
+		head = sr.auditHeader() + head
+	}
+
+	return head, b.Bytes()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRecordTemplates(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "ident"}, Name: "cluster1"}
+
+	lr := sampleRecord
+	lr.ErrHint = strp("Check the spelling.")
+
+	for _, tc := range []struct {
+		template, want string
+	}{
+		{templateStderr, "[cluster1] 2014-05-01 10:00:00.000 UTC " +
+			"[1234] ERROR:  relation \"nope\" does not exist\n" +
+			"HINT:  Check the spelling.\n" +
+			"STATEMENT:  SELECT * FROM nope;"},
+		{templateLogfmt, string(lr.oneLine())},
+		{`{{.Severity}} {{.Condition}} {{quote .Message}}`,
+			`ERROR undefined_table "relation \"nope\" does not exist"`},
+	} {
+		tmpl, err := parseRecordTemplate(tc.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sr.template = tmpl
+		head, msg := formatTemplateParts(&lr, sr, false)
+		if got := head + string(msg); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+
+	// The audit endpoint still gets to tell serves apart.
+	head, msg := formatTemplateParts(&lr, sr, true)
+	if head != "instance_type=shogun identity=ident " ||
+		!strings.HasPrefix(string(msg), "ERROR") {
+		t.Errorf("unexpected audit record %q", head+string(msg))
+	}
+
+	if tmpl, err := parseRecordTemplate(templateLegacy); tmpl != nil ||
+		err != nil {
+		t.Errorf("legacy should need no template, got %v, %v", tmpl, err)
+	}
+
+	for _, bad := range []string{`{{.Nope}}`, `{{.Message`, `{{nope}}`} {
+		if _, err := parseRecordTemplate(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestTemplateConfig(t *testing.T) {
+	project := func(extra string) (*serveRecord, error) {
+		var v interface{}
+		err := json.Unmarshal([]byte(`{"i": "x", "p": "/p", `+
+			`"url": "https://token:t@localhost"`+extra+`}`), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return projectFromJSON(v)
+	}
+
+	rec, err := project(`, "template": "stderr"`)
+	if err != nil || rec.template == nil {
+		t.Fatalf("unexpected result %v, %v", rec, err)
+	}
+
+	if _, err := project(`, "format": "json", "template": "stderr"`); err == nil {
+		t.Error("expected template with json format to be rejected")
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"bytes"
 	"errors"
+	"strings"
 	"testing"
 
 	"github.com/deafbybeheading/femebe/buf"
@@ -42,11 +43,21 @@ func TestVersionCheck(t *testing.T) {
 		onBadVersion := func(args ...interface{}) {
 			ok = false
 		}
-		processVerMsg(msgInit, onBadVersion)
+		version := processVerMsg(msgInit, onBadVersion)
 		if ok != tt.Ok {
 			t.Errorf("%d: Ver Message well formed: %v; want %v",
 				i, ok, tt.Ok)
 		}
+
+		// Versions that are refused give nothing to compare.
+		if !tt.Ok {
+			continue
+		}
+
+		want := tt.Version[3:strings.Index(tt.Version, "/")]
+		if ok && version != want {
+			t.Errorf("%d: got version %q; want %q", i, version, want)
+		}
 	}
 }
 